@@ -0,0 +1,164 @@
+package obs
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mixpanel/obs/logging"
+)
+
+// adminHandler serves the endpoints documented on FlightRecorder.AdminHandler.
+type adminHandler struct {
+	fr *flightRecorder
+}
+
+func (h *adminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch path := strings.TrimSuffix(r.URL.Path, "/"); {
+	case strings.HasSuffix(path, "/log_level"):
+		h.logLevel(w, r)
+	case strings.HasSuffix(path, "/sampling"):
+		h.sampling(w, r)
+	case strings.HasSuffix(path, "/flush"):
+		h.flush(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+type logLevelResponse struct {
+	Level string            `json:"level"`
+	Named map[string]string `json:"named"`
+}
+
+func (h *adminHandler) logLevel(w http.ResponseWriter, r *http.Request) {
+	ls, ok := h.fr.l.(logging.LevelSetter)
+	if !ok {
+		http.Error(w, "log levels can't be changed for this logger", http.StatusNotImplemented)
+		return
+	}
+
+	name := r.FormValue("name")
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost, http.MethodPut:
+		duration, err := parseAdminDuration(r.FormValue("duration"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		level := strings.ToUpper(r.FormValue("level"))
+		if err := setLogLevel(ls, name, level, duration); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		h.fr.WithSpan(r.Context()).Info("log level changed", Vals{"logger_name": name, "level": level, "duration": duration.String()})
+	case http.MethodDelete:
+		if name == "" {
+			http.Error(w, "name is required", http.StatusBadRequest)
+			return
+		}
+		ls.ClearNamedLevel(name)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeAdminJSON(w, logLevelResponse{Level: ls.Level(), Named: ls.NamedLevels()})
+}
+
+// setLogLevel sets the level of the logger called name, or of every logger if name is empty. If duration is non-zero,
+// the previous level is restored after it elapses unless the level was changed again in the meantime.
+func setLogLevel(ls logging.LevelSetter, name, level string, duration time.Duration) error {
+	if name == "" {
+		previous := ls.Level()
+		if err := ls.SetLevel(level); err != nil {
+			return err
+		}
+		if duration > 0 {
+			time.AfterFunc(duration, func() {
+				if ls.Level() == level {
+					ls.SetLevel(previous)
+				}
+			})
+		}
+		return nil
+	}
+
+	previous, hadPrevious := ls.NamedLevels()[name]
+	if err := ls.SetNamedLevel(name, level); err != nil {
+		return err
+	}
+	if duration > 0 {
+		time.AfterFunc(duration, func() {
+			if ls.NamedLevels()[name] != level {
+				return
+			}
+			if hadPrevious {
+				ls.SetNamedLevel(name, previous)
+			} else {
+				ls.ClearNamedLevel(name)
+			}
+		})
+	}
+	return nil
+}
+
+type samplingResponse struct {
+	SampleOneInN uint64 `json:"sample_one_in_n"`
+}
+
+func (h *adminHandler) sampling(w http.ResponseWriter, r *http.Request) {
+	sampler := h.fr.sampler
+	if sampler == nil {
+		http.Error(w, "the sample rate can't be changed for this tracer", http.StatusNotImplemented)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost, http.MethodPut:
+		n, err := strconv.ParseUint(r.FormValue("one_in_n"), 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid one_in_n: %v", err), http.StatusBadRequest)
+			return
+		}
+		sampler.SetOneInN(n)
+		h.fr.WithSpan(r.Context()).Info("trace sample rate changed", Vals{"sample_one_in_n": n})
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeAdminJSON(w, samplingResponse{SampleOneInN: sampler.OneInN()})
+}
+
+func (h *adminHandler) flush(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	h.fr.flush()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func parseAdminDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration: %v", err)
+	}
+	return d, nil
+}
+
+func writeAdminJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
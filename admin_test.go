@@ -0,0 +1,113 @@
+package obs
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mixpanel/obs/logging"
+	"github.com/mixpanel/obs/metrics"
+	"github.com/mixpanel/obs/tracing"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func newAdminTestRecorder() (FlightRecorder, *tracing.Sampler) {
+	sampler := tracing.NewSampler(100)
+	fr := newFlightRecorder("test", metrics.NewReceiver(metrics.NewMockSink()), logging.New("NEVER", "INFO", "", "text"), opentracing.NoopTracer{})
+	fr.sampler = sampler
+	return fr, sampler
+}
+
+func adminRequest(t *testing.T, handler http.Handler, method, target string, v interface{}) int {
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+	if v != nil && w.Code == http.StatusOK {
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), v))
+	}
+	return w.Code
+}
+
+func TestAdminLogLevel(t *testing.T) {
+	fr, _ := newAdminTestRecorder()
+	handler := fr.ScopeName("scoped").AdminHandler()
+
+	var res logLevelResponse
+	assert.Equal(t, http.StatusOK, adminRequest(t, handler, "GET", "/debug/obs/log_level", &res))
+	assert.Equal(t, "INFO", res.Level)
+	assert.Empty(t, res.Named)
+
+	assert.Equal(t, http.StatusOK, adminRequest(t, handler, "POST", "/debug/obs/log_level?level=debug", &res))
+	assert.Equal(t, "DEBUG", res.Level)
+	assert.True(t, fr.ScopeName("other").(*flightRecorder).l.IsDebug())
+
+	assert.Equal(t, http.StatusOK, adminRequest(t, handler, "POST", "/debug/obs/log_level?level=ERROR&name=test.query", &res))
+	assert.Equal(t, map[string]string{"test.query": "ERROR"}, res.Named)
+	assert.False(t, fr.ScopeName("query").(*flightRecorder).l.IsWarn())
+
+	var cleared logLevelResponse
+	assert.Equal(t, http.StatusOK, adminRequest(t, handler, "DELETE", "/debug/obs/log_level?name=test.query", &cleared))
+	assert.Empty(t, cleared.Named)
+
+	assert.Equal(t, http.StatusBadRequest, adminRequest(t, handler, "POST", "/debug/obs/log_level?level=LOUD", nil))
+	assert.Equal(t, http.StatusBadRequest, adminRequest(t, handler, "POST", "/debug/obs/log_level?level=INFO&duration=forever", nil))
+	assert.Equal(t, http.StatusNotFound, adminRequest(t, handler, "GET", "/debug/obs/unknown", nil))
+}
+
+func TestAdminLogLevelDuration(t *testing.T) {
+	fr, _ := newAdminTestRecorder()
+	handler := fr.AdminHandler()
+
+	assert.Equal(t, http.StatusOK, adminRequest(t, handler, "POST", "/log_level?level=DEBUG&name=test.query&duration=10ms", nil))
+	assert.Eventually(t, func() bool {
+		var res logLevelResponse
+		adminRequest(t, handler, "GET", "/log_level", &res)
+		return len(res.Named) == 0
+	}, time.Second, time.Millisecond)
+
+	assert.Equal(t, http.StatusOK, adminRequest(t, handler, "POST", "/log_level?level=DEBUG&duration=10ms", nil))
+	assert.Eventually(t, func() bool {
+		var res logLevelResponse
+		adminRequest(t, handler, "GET", "/log_level", &res)
+		return res.Level == "INFO"
+	}, time.Second, time.Millisecond)
+}
+
+func TestAdminSampling(t *testing.T) {
+	fr, sampler := newAdminTestRecorder()
+	handler := fr.AdminHandler()
+
+	var res samplingResponse
+	assert.Equal(t, http.StatusOK, adminRequest(t, handler, "GET", "/sampling", &res))
+	assert.Equal(t, uint64(100), res.SampleOneInN)
+
+	assert.Equal(t, http.StatusOK, adminRequest(t, handler, "POST", "/sampling?one_in_n=1", &res))
+	assert.Equal(t, uint64(1), res.SampleOneInN)
+	assert.True(t, sampler.ShouldSample(12345))
+
+	assert.Equal(t, http.StatusBadRequest, adminRequest(t, handler, "POST", "/sampling?one_in_n=-1", nil))
+	assert.Equal(t, http.StatusNotImplemented, adminRequest(t, NullFlightRecorder.AdminHandler(), "GET", "/sampling", nil))
+}
+
+func TestAdminFlush(t *testing.T) {
+	fr, _ := newAdminTestRecorder()
+	handler := fr.AdminHandler()
+
+	assert.Equal(t, http.StatusNoContent, adminRequest(t, handler, "POST", "/flush", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, adminRequest(t, handler, "GET", "/flush", nil))
+}
+
+func TestAdminHandlerPaths(t *testing.T) {
+	fr, _ := newAdminTestRecorder()
+	mux := http.NewServeMux()
+	mux.Handle("/debug/obs/", fr.AdminHandler())
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/debug/obs/sampling/", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, strings.Contains(w.Body.String(), "sample_one_in_n"))
+}
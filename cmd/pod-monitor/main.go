@@ -4,6 +4,7 @@ import (
 	"context"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
@@ -35,7 +36,8 @@ func initOptions() *Options {
 func main() {
 	options := initOptions()
 	rootCtx := context.Background()
-	fr, closer := obs.InitGCP(rootCtx, "pod-monitor", options.LogLevel)
+	fr, closer := obs.InitGCP(rootCtx, "pod-monitor", options.LogLevel, obs.LogLevels(options.LogLevels),
+		obs.MetricsAddress(options.MetricsAddress))
 	defer closer()
 
 	fs := fr.WithSpan(rootCtx)
@@ -62,7 +64,12 @@ func run(ctx context.Context, fr obs.FlightRecorder, options *Options) error {
 	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
 
 	ticker := time.NewTicker(20 * time.Second)
-	rpt := &reporter{lastRun: time.Now(), cs: clientset, fr: fr.ScopeName("pods")}
+	rpt := &reporter{
+		lastRun:  time.Now(),
+		cs:       clientset,
+		fr:       fr.ScopeName("pods"),
+		throttle: isUDP(options.MetricsAddress),
+	}
 	for {
 		select {
 		case <-ticker.C:
@@ -93,6 +100,12 @@ type reporter struct {
 	lastPods map[podKey]struct{}
 	cs       *kubernetes.Clientset
 	fr       obs.FlightRecorder
+	// throttle pauses between batches of pods, since statsd drops UDP packets when it's flooded.
+	throttle bool
+}
+
+func isUDP(addr string) bool {
+	return !strings.Contains(addr, "://") || strings.HasPrefix(addr, "udp://")
 }
 
 func (r *reporter) report(ctx context.Context) error {
@@ -127,7 +140,7 @@ func (r *reporter) report(ctx context.Context) error {
 			containerFS := containerFR.WithSpan(ctx)
 			containerFS.SetGauge("container.restarts", float64(container.RestartCount))
 		}
-		if i%100 == 0 {
+		if r.throttle && i%100 == 0 {
 			// sleep to prevent statsd from dropping UDP packets by flooding it
 			// with a bunch of stats at once.
 			time.Sleep(20 * time.Millisecond)
@@ -0,0 +1,456 @@
+package obs
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mixpanel/obs/logging"
+	"github.com/mixpanel/obs/metrics"
+	"github.com/mixpanel/obs/tracing"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Config describes how InitFromConfig sets up metrics, logging and tracing. Use DefaultConfig for the same setup as
+// InitGCP, LoadConfig to read it from a file, and ApplyEnv to override it with OBS_* environment variables.
+type Config struct {
+	ServiceName string `yaml:"service_name"`
+	// Tags are added to every metric, log line and span.
+	Tags map[string]string `yaml:"tags"`
+
+	Metrics MetricsConfig `yaml:"metrics"`
+	Log     LogConfig     `yaml:"log"`
+	Trace   TraceConfig   `yaml:"trace"`
+}
+
+type MetricsConfig struct {
+	// Sink is one of statsd, wavefront, otlp, influx, multi or none.
+	Sink string `yaml:"sink"`
+	// Destinations are the sinks the multi sink sends metrics to.
+	Destinations []MetricsDestinationConfig `yaml:"destinations"`
+	// Address is the host:port of the statsd daemon or OTLP collector. Statsd also accepts tcp://host:port,
+	// unix:///path and unixgram:///path. Influx takes udp://host:port or the URL of its HTTP write API.
+	Address string `yaml:"address"`
+	// OTLPHTTP exports OTLP/HTTP instead of OTLP/gRPC.
+	OTLPHTTP bool `yaml:"otlp_http"`
+	// OTLPInsecure disables TLS to the OTLP collector.
+	OTLPInsecure bool `yaml:"otlp_insecure"`
+	// StatsdOverflow is what happens to metrics when statsd can't keep up: drop_newest (the default), drop_oldest or
+	// block.
+	StatsdOverflow string `yaml:"statsd_overflow"`
+	// StatsdAggregation sums counters, keeps the last value of gauges and batches the values of stats in process, and
+	// sends one line per series to statsd on every flush.
+	StatsdAggregation bool `yaml:"statsd_aggregation"`
+	// StrictSanitization drops statsd and wavefront metrics whose names or tags contain characters that would corrupt
+	// the line, and counts them, instead of replacing those characters with underscores.
+	StrictSanitization bool `yaml:"strict_sanitization"`
+	// WavefrontHosts are the host:port addresses of the wavefront proxies.
+	WavefrontHosts []string `yaml:"wavefront_hosts"`
+	// LocalAggregation aggregates metrics in process and reports summaries to Sink on every flush.
+	LocalAggregation bool `yaml:"local_aggregation"`
+	// LocalFlushThreshold is the number of flushes an aggregated metric is reported for after it was last updated.
+	LocalFlushThreshold int `yaml:"local_flush_threshold"`
+	// LocalSeriesTTL is how long an aggregated metric is kept after it was last updated, or forever if it's zero.
+	LocalSeriesTTL time.Duration `yaml:"local_series_ttl"`
+	// TagCardinalityLimit is how many distinct values each tag key can take under each metric prefix before new values
+	// are reported as __other__, or unlimited if it's zero.
+	TagCardinalityLimit int `yaml:"tag_cardinality_limit"`
+	// FlushInterval is how often the sink is flushed.
+	FlushInterval time.Duration `yaml:"flush_interval"`
+	// Relabel rules rename, drop and retag metrics before they're aggregated or sent to Sink.
+	Relabel []metrics.RelabelRule `yaml:"relabel"`
+}
+
+// MetricsDestinationConfig is one of the destinations of the multi sink.
+type MetricsDestinationConfig struct {
+	// MetricsConfig sets up the destination's sink like the top level one sets up its own, from Sink and the settings
+	// of that sink. Local aggregation, relabeling and the flush interval apply to the multi sink as a whole, so they're
+	// taken from the top level.
+	MetricsConfig `yaml:",inline"`
+	// Filter selects the metrics sent to the destination, all of them if it's empty.
+	Filter metrics.SinkFilter `yaml:"filter"`
+	// QueueSize is how many metrics can wait to be sent to the destination, 1024 if it's zero.
+	QueueSize int `yaml:"queue_size"`
+	// FlushTimeout is how long a flush waits for the destination, 10 seconds if it's zero.
+	FlushTimeout time.Duration `yaml:"flush_timeout"`
+}
+
+type LogConfig struct {
+	// Level is one of NEVER, DEBUG, INFO, WARN, ERROR or CRITICAL.
+	Level string `yaml:"level"`
+	// Format is one of json or text.
+	Format string `yaml:"format"`
+	// Path is the file to log to. Logs go to stderr if it's empty.
+	Path string `yaml:"path"`
+	// SyslogLevel is the level logged to syslog, NEVER to disable it.
+	SyslogLevel string `yaml:"syslog_level"`
+	// NamedLevels override Level for specific loggers, keyed by the dotted names of scoped FlightRecorders. The most
+	// specific prefix wins, so {myservice.query: WARN, myservice.query.planner: DEBUG} logs the planner at DEBUG and
+	// the rest of myservice.query at WARN.
+	NamedLevels map[string]string `yaml:"named_levels"`
+}
+
+type TraceConfig struct {
+	// Exporter is one of cloudtrace, otlp or none.
+	Exporter string `yaml:"exporter"`
+	// Endpoint is the host:port of the OTLP collector.
+	Endpoint string `yaml:"endpoint"`
+	// OTLPHTTP exports OTLP/HTTP instead of OTLP/gRPC.
+	OTLPHTTP bool `yaml:"otlp_http"`
+	// OTLPInsecure disables TLS to the OTLP collector.
+	OTLPInsecure bool `yaml:"otlp_insecure"`
+	// SampleOneInN samples 1 in n traces, or none if it's 0.
+	SampleOneInN uint64 `yaml:"sample_one_in_n"`
+}
+
+// DefaultConfig returns the configuration used by InitGCP: metrics to statsd at 127.0.0.1:8125, json logs to stderr,
+// and traces to Cloud Trace sampled 1 in 100.
+func DefaultConfig(serviceName string) Config {
+	return Config{
+		ServiceName: serviceName,
+		Metrics: MetricsConfig{
+			Sink:                "statsd",
+			Address:             "127.0.0.1:8125",
+			LocalFlushThreshold: 60,
+			FlushInterval:       10 * time.Second,
+		},
+		Log: LogConfig{
+			Level:       "INFO",
+			Format:      "json",
+			SyslogLevel: "NEVER",
+		},
+		Trace: TraceConfig{
+			Exporter:     "cloudtrace",
+			SampleOneInN: 100,
+		},
+	}
+}
+
+// LoadConfig reads a YAML or JSON configuration file on top of DefaultConfig, then applies OBS_* environment
+// variables. If path is empty, OBS_CONFIG is used, and if that is empty too only the environment is read.
+func LoadConfig(path string) (Config, error) {
+	cfg := DefaultConfig("")
+	if path == "" {
+		path = os.Getenv("OBS_CONFIG")
+	}
+	if path != "" {
+		bs, err := ioutil.ReadFile(path)
+		if err != nil {
+			return cfg, fmt.Errorf("error reading obs config: %v", err)
+		}
+		// JSON is valid YAML, so both are decoded the same way.
+		if err := yaml.UnmarshalStrict(bs, &cfg); err != nil {
+			return cfg, fmt.Errorf("error parsing obs config %s: %v", path, err)
+		}
+	}
+	err := cfg.ApplyEnv()
+	return cfg, err
+}
+
+// ApplyEnv overrides the configuration with any of the following environment variables that are set:
+//
+//	OBS_SERVICE_NAME, OBS_TAGS (k1=v1,k2=v2),
+//	OBS_METRICS_SINK, OBS_METRICS_ADDRESS, OBS_METRICS_WAVEFRONT_HOSTS (comma separated),
+//	OBS_METRICS_OTLP_HTTP, OBS_METRICS_OTLP_INSECURE, OBS_METRICS_STATSD_OVERFLOW, OBS_METRICS_STATSD_AGGREGATION,
+//	OBS_METRICS_STRICT_SANITIZATION, OBS_METRICS_LOCAL_AGGREGATION, OBS_METRICS_LOCAL_FLUSH_THRESHOLD,
+//	OBS_METRICS_LOCAL_SERIES_TTL, OBS_METRICS_TAG_CARDINALITY_LIMIT, OBS_METRICS_FLUSH_INTERVAL,
+//	OBS_LOG_LEVEL, OBS_LOG_FORMAT, OBS_LOG_PATH, OBS_LOG_SYSLOG_LEVEL, OBS_LOG_NAMED_LEVELS (name1=LEVEL,name2=LEVEL),
+//	OBS_TRACE_EXPORTER, OBS_TRACE_ENDPOINT, OBS_TRACE_OTLP_HTTP, OBS_TRACE_OTLP_INSECURE, OBS_TRACE_SAMPLE_ONE_IN_N
+func (cfg *Config) ApplyEnv() error {
+	env := func(name string, f func(string) error) error {
+		if v, ok := os.LookupEnv(name); ok {
+			if err := f(v); err != nil {
+				return fmt.Errorf("invalid %s %q: %v", name, v, err)
+			}
+		}
+		return nil
+	}
+	str := func(dst *string) func(string) error {
+		return func(v string) error {
+			*dst = v
+			return nil
+		}
+	}
+	boolean := func(dst *bool) func(string) error {
+		return func(v string) (err error) {
+			*dst, err = strconv.ParseBool(v)
+			return err
+		}
+	}
+
+	return firstError(
+		env("OBS_SERVICE_NAME", str(&cfg.ServiceName)),
+		env("OBS_TAGS", func(v string) (err error) {
+			cfg.Tags, err = parseEnvTags(v)
+			return err
+		}),
+		env("OBS_METRICS_SINK", str(&cfg.Metrics.Sink)),
+		env("OBS_METRICS_ADDRESS", str(&cfg.Metrics.Address)),
+		env("OBS_METRICS_WAVEFRONT_HOSTS", func(v string) error {
+			cfg.Metrics.WavefrontHosts = strings.Split(v, ",")
+			return nil
+		}),
+		env("OBS_METRICS_OTLP_HTTP", boolean(&cfg.Metrics.OTLPHTTP)),
+		env("OBS_METRICS_OTLP_INSECURE", boolean(&cfg.Metrics.OTLPInsecure)),
+		env("OBS_METRICS_STATSD_OVERFLOW", str(&cfg.Metrics.StatsdOverflow)),
+		env("OBS_METRICS_STATSD_AGGREGATION", boolean(&cfg.Metrics.StatsdAggregation)),
+		env("OBS_METRICS_STRICT_SANITIZATION", boolean(&cfg.Metrics.StrictSanitization)),
+		env("OBS_METRICS_LOCAL_AGGREGATION", boolean(&cfg.Metrics.LocalAggregation)),
+		env("OBS_METRICS_LOCAL_FLUSH_THRESHOLD", func(v string) (err error) {
+			cfg.Metrics.LocalFlushThreshold, err = strconv.Atoi(v)
+			return err
+		}),
+		env("OBS_METRICS_LOCAL_SERIES_TTL", func(v string) (err error) {
+			cfg.Metrics.LocalSeriesTTL, err = time.ParseDuration(v)
+			return err
+		}),
+		env("OBS_METRICS_TAG_CARDINALITY_LIMIT", func(v string) (err error) {
+			cfg.Metrics.TagCardinalityLimit, err = strconv.Atoi(v)
+			return err
+		}),
+		env("OBS_METRICS_FLUSH_INTERVAL", func(v string) (err error) {
+			cfg.Metrics.FlushInterval, err = time.ParseDuration(v)
+			return err
+		}),
+		env("OBS_LOG_LEVEL", str(&cfg.Log.Level)),
+		env("OBS_LOG_FORMAT", str(&cfg.Log.Format)),
+		env("OBS_LOG_PATH", str(&cfg.Log.Path)),
+		env("OBS_LOG_SYSLOG_LEVEL", str(&cfg.Log.SyslogLevel)),
+		env("OBS_LOG_NAMED_LEVELS", func(v string) (err error) {
+			cfg.Log.NamedLevels, err = logging.ParseNamedLevels(v)
+			return err
+		}),
+		env("OBS_TRACE_EXPORTER", str(&cfg.Trace.Exporter)),
+		env("OBS_TRACE_ENDPOINT", str(&cfg.Trace.Endpoint)),
+		env("OBS_TRACE_OTLP_HTTP", boolean(&cfg.Trace.OTLPHTTP)),
+		env("OBS_TRACE_OTLP_INSECURE", boolean(&cfg.Trace.OTLPInsecure)),
+		env("OBS_TRACE_SAMPLE_ONE_IN_N", func(v string) (err error) {
+			cfg.Trace.SampleOneInN, err = strconv.ParseUint(v, 10, 64)
+			return err
+		}),
+	)
+}
+
+func parseEnvTags(v string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, pair := range strings.Split(v, ",") {
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("expected key=value, got %q", pair)
+		}
+		tags[kv[0]] = kv[1]
+	}
+	return tags, nil
+}
+
+func firstError(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// InitFromConfig initializes metrics, logging and tracing as described by cfg, and returns the root FlightRecorder
+// along with a Closer that flushes and releases everything.
+func InitFromConfig(ctx context.Context, cfg Config) (FlightRecorder, Closer, error) {
+	if cfg.ServiceName == "" {
+		return nil, nil, fmt.Errorf("obs config is missing service_name")
+	}
+
+	dst, err := newConfigSink(ctx, cfg.ServiceName, cfg.Metrics)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tracer, sampler, closeTracer, err := newConfigTracer(ctx, cfg.ServiceName, cfg.Trace)
+	if err != nil {
+		dst.Close()
+		return nil, nil, err
+	}
+
+	sink := dst
+	if cfg.Metrics.LocalAggregation {
+		sink = metrics.NewLocalSink(dst, cfg.Metrics.LocalFlushThreshold, nil, metrics.WithSeriesTTL(cfg.Metrics.LocalSeriesTTL))
+	}
+	if len(cfg.Metrics.Relabel) > 0 {
+		if sink, err = metrics.NewRelabelSink(sink, cfg.Metrics.Relabel); err != nil {
+			closeTracer()
+			dst.Close()
+			return nil, nil, fmt.Errorf("invalid metrics relabel rules: %v", err)
+		}
+	}
+
+	l := logging.New(cfg.Log.SyslogLevel, cfg.Log.Level, cfg.Log.Path, cfg.Log.Format)
+	if err := setNamedLogLevels(l, cfg.Log.NamedLevels); err != nil {
+		closeTracer()
+		dst.Close()
+		return nil, nil, fmt.Errorf("invalid log named_levels: %v", err)
+	}
+	fr, closer := initFR(ctx, cfg.ServiceName, l, tracer, sampler, sink, cfg.Metrics.TagCardinalityLimit)
+	if len(cfg.Tags) > 0 {
+		fr = fr.ScopeTags(cfg.Tags)
+	}
+
+	done := make(chan struct{})
+	if cfg.Metrics.FlushInterval > 0 {
+		go flushPeriodically(sink, cfg.Metrics.FlushInterval, done)
+	}
+
+	return fr, func() {
+		close(done)
+		closeTracer()
+		closer()
+		if cfg.Metrics.LocalAggregation {
+			// closing the local sink flushes it into dst, but leaves dst open
+			dst.Close()
+		}
+	}, nil
+}
+
+func newConfigSink(ctx context.Context, serviceName string, cfg MetricsConfig) (metrics.Sink, error) {
+	switch strings.ToLower(cfg.Sink) {
+	case "statsd":
+		var overflow metrics.OverflowPolicy
+		switch strings.ToLower(cfg.StatsdOverflow) {
+		case "", "drop_newest":
+			overflow = metrics.OverflowDropNewest
+		case "drop_oldest":
+			overflow = metrics.OverflowDropOldest
+		case "block":
+			overflow = metrics.OverflowBlock
+		default:
+			return nil, fmt.Errorf("unknown statsd overflow policy: %s", cfg.StatsdOverflow)
+		}
+		opts := []metrics.StatsdOption{metrics.WithOverflowPolicy(overflow)}
+		if cfg.StatsdAggregation {
+			opts = append(opts, metrics.WithAggregation())
+		}
+		if cfg.StrictSanitization {
+			opts = append(opts, metrics.WithStrictSanitization())
+		}
+		sink, err := metrics.NewStatsdSink(cfg.Address, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("error initializing metrics: %v", err)
+		}
+		return sink, nil
+	case "wavefront":
+		if len(cfg.WavefrontHosts) == 0 {
+			return nil, fmt.Errorf("wavefront metrics sink requires wavefront_hosts")
+		}
+		origin, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("error looking up hostname for wavefront: %v", err)
+		}
+		var opts []metrics.WavefrontOption
+		if cfg.StrictSanitization {
+			opts = append(opts, metrics.WithWavefrontStrictSanitization())
+		}
+		return metrics.NewWavefrontSink(origin, nil, cfg.WavefrontHosts, opts...), nil
+	case "otlp":
+		return metrics.NewOTLPSink(ctx, metrics.OTLPOptions{
+			Endpoint:    cfg.Address,
+			HTTP:        cfg.OTLPHTTP,
+			Insecure:    cfg.OTLPInsecure,
+			ServiceName: serviceName,
+			Interval:    cfg.FlushInterval,
+		})
+	case "influx":
+		sink, err := metrics.NewInfluxSink(cfg.Address)
+		if err != nil {
+			return nil, fmt.Errorf("error initializing metrics: %v", err)
+		}
+		return sink, nil
+	case "multi":
+		return newConfigMultiSink(ctx, serviceName, cfg)
+	case "", "none":
+		return metrics.NullSink, nil
+	default:
+		return nil, fmt.Errorf("unknown metrics sink: %s", cfg.Sink)
+	}
+}
+
+func newConfigMultiSink(ctx context.Context, serviceName string, cfg MetricsConfig) (metrics.Sink, error) {
+	if len(cfg.Destinations) == 0 {
+		return nil, fmt.Errorf("multi metrics sink requires destinations")
+	}
+	var destinations []metrics.MultiSinkDestination
+	closeDestinations := func() {
+		for _, d := range destinations {
+			d.Sink.Close()
+		}
+	}
+	for _, d := range cfg.Destinations {
+		if strings.EqualFold(d.Sink, "multi") {
+			closeDestinations()
+			return nil, fmt.Errorf("multi metrics sink destinations can't be multi sinks")
+		}
+		destCfg := d.MetricsConfig
+		destCfg.FlushInterval = cfg.FlushInterval
+		sink, err := newConfigSink(ctx, serviceName, destCfg)
+		if err != nil {
+			closeDestinations()
+			return nil, err
+		}
+		destinations = append(destinations, metrics.MultiSinkDestination{
+			Sink:         sink,
+			Filter:       d.Filter,
+			QueueSize:    d.QueueSize,
+			FlushTimeout: d.FlushTimeout,
+		})
+	}
+	sink, err := metrics.NewMultiSink(destinations...)
+	if err != nil {
+		closeDestinations()
+		return nil, fmt.Errorf("invalid multi metrics sink: %v", err)
+	}
+	return sink, nil
+}
+
+func newConfigTracer(ctx context.Context, serviceName string, cfg TraceConfig) (opentracing.Tracer, *tracing.Sampler, func(), error) {
+	opts := newObsOptions()
+	SampleRate(cfg.SampleOneInN)(&opts)
+	switch strings.ToLower(cfg.Exporter) {
+	case "cloudtrace":
+		tracer, closeTracer := tracing.New(opts.tracerOpts)
+		return tracer, opts.sampler, closeTracer, nil
+	case "otlp":
+		tracer, closeTracer, err := tracing.NewOTLP(ctx, opts.tracerOpts, tracing.OTLPOptions{
+			Endpoint:    cfg.Endpoint,
+			HTTP:        cfg.OTLPHTTP,
+			Insecure:    cfg.OTLPInsecure,
+			ServiceName: serviceName,
+		})
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return tracer, opts.sampler, closeTracer, nil
+	case "", "none":
+		return opentracing.NoopTracer{}, nil, func() {}, nil
+	default:
+		return nil, nil, nil, fmt.Errorf("unknown trace exporter: %s", cfg.Exporter)
+	}
+}
+
+func flushPeriodically(sink metrics.Sink, interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			sink.Flush()
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package obs
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mixpanel/obs/metrics"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeConfig(t *testing.T, name, contents string) (string, func()) {
+	dir, err := ioutil.TempDir("", "obs-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func setenv(vars map[string]string) func() {
+	for k, v := range vars {
+		os.Setenv(k, v)
+	}
+	return func() {
+		for k := range vars {
+			os.Unsetenv(k)
+		}
+	}
+}
+
+func TestLoadConfigYAML(t *testing.T) {
+	path, cleanup := writeConfig(t, "obs.yaml", `
+service_name: query
+tags:
+  cluster: us-central
+metrics:
+  sink: wavefront
+  wavefront_hosts: [wf1:2878, wf2:2878]
+  local_aggregation: true
+  flush_interval: 30s
+  relabel:
+    - action: drop_tag
+      pattern: user_.*
+    - action: hash_tag
+      tag: project_id
+      buckets: 16
+log:
+  level: DEBUG
+  format: text
+  named_levels:
+    query.planner: WARN
+trace:
+  exporter: none
+`)
+	defer cleanup()
+
+	cfg, err := LoadConfig(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "query", cfg.ServiceName)
+	assert.Equal(t, map[string]string{"cluster": "us-central"}, cfg.Tags)
+	assert.Equal(t, "wavefront", cfg.Metrics.Sink)
+	assert.Equal(t, []string{"wf1:2878", "wf2:2878"}, cfg.Metrics.WavefrontHosts)
+	assert.True(t, cfg.Metrics.LocalAggregation)
+	assert.Equal(t, 30*time.Second, cfg.Metrics.FlushInterval)
+	assert.Equal(t, []metrics.RelabelRule{
+		{Action: metrics.RelabelDropTag, Pattern: "user_.*"},
+		{Action: metrics.RelabelHashTag, Tag: "project_id", Buckets: 16},
+	}, cfg.Metrics.Relabel)
+	assert.Equal(t, "DEBUG", cfg.Log.Level)
+	assert.Equal(t, "text", cfg.Log.Format)
+	assert.Equal(t, map[string]string{"query.planner": "WARN"}, cfg.Log.NamedLevels)
+	assert.Equal(t, "none", cfg.Trace.Exporter)
+
+	// unset fields keep their defaults
+	assert.Equal(t, "NEVER", cfg.Log.SyslogLevel)
+	assert.Equal(t, uint64(100), cfg.Trace.SampleOneInN)
+}
+
+func TestLoadConfigMultiSink(t *testing.T) {
+	path, cleanup := writeConfig(t, "obs.yaml", `
+service_name: query
+metrics:
+  sink: multi
+  destinations:
+    - sink: statsd
+      address: 127.0.0.1:8125
+      statsd_aggregation: true
+    - sink: none
+      filter:
+        include_prefixes: [query.]
+        types: [counter]
+      queue_size: 16
+      flush_timeout: 1s
+log:
+  level: NEVER
+trace:
+  exporter: none
+`)
+	defer cleanup()
+
+	cfg, err := LoadConfig(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	if assert.Len(t, cfg.Metrics.Destinations, 2) {
+		assert.Equal(t, "statsd", cfg.Metrics.Destinations[0].Sink)
+		assert.True(t, cfg.Metrics.Destinations[0].StatsdAggregation)
+		assert.Equal(t, MetricsDestinationConfig{
+			MetricsConfig: MetricsConfig{Sink: "none"},
+			Filter:        metrics.SinkFilter{IncludePrefixes: []string{"query."}, Types: []string{"counter"}},
+			QueueSize:     16,
+			FlushTimeout:  time.Second,
+		}, cfg.Metrics.Destinations[1])
+	}
+
+	fr, closer, err := InitFromConfig(context.Background(), cfg)
+	if assert.NoError(t, err) {
+		fs, _, done := fr.WithNewSpan(context.Background(), "op")
+		fs.Incr("test")
+		done()
+		closer()
+	}
+}
+
+func TestLoadConfigJSON(t *testing.T) {
+	path, cleanup := writeConfig(t, "obs.json", `{"service_name": "query", "trace": {"sample_one_in_n": 10}}`)
+	defer cleanup()
+
+	cfg, err := LoadConfig(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "query", cfg.ServiceName)
+	assert.Equal(t, uint64(10), cfg.Trace.SampleOneInN)
+	assert.Equal(t, "statsd", cfg.Metrics.Sink)
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	path, cleanup := writeConfig(t, "obs.yaml", "unknown_field: 1")
+	defer cleanup()
+	_, err := LoadConfig(path)
+	assert.Error(t, err)
+
+	_, err = LoadConfig("/does/not/exist.yaml")
+	assert.Error(t, err)
+}
+
+func TestConfigApplyEnv(t *testing.T) {
+	defer setenv(map[string]string{
+		"OBS_SERVICE_NAME":                  "env-service",
+		"OBS_TAGS":                          "a=b,c=d",
+		"OBS_METRICS_SINK":                  "none",
+		"OBS_METRICS_LOCAL_AGGREGATION":     "true",
+		"OBS_METRICS_LOCAL_SERIES_TTL":      "1h",
+		"OBS_METRICS_TAG_CARDINALITY_LIMIT": "100",
+		"OBS_LOG_LEVEL":                     "WARN",
+		"OBS_LOG_NAMED_LEVELS":              "service.query=debug",
+		"OBS_TRACE_EXPORTER":                "otlp",
+		"OBS_TRACE_ENDPOINT":                "collector:4318",
+		"OBS_TRACE_OTLP_HTTP":               "true",
+		"OBS_TRACE_SAMPLE_ONE_IN_N":         "5",
+	})()
+
+	cfg := DefaultConfig("service")
+	assert.NoError(t, cfg.ApplyEnv())
+	assert.Equal(t, "env-service", cfg.ServiceName)
+	assert.Equal(t, map[string]string{"a": "b", "c": "d"}, cfg.Tags)
+	assert.Equal(t, "none", cfg.Metrics.Sink)
+	assert.True(t, cfg.Metrics.LocalAggregation)
+	assert.Equal(t, time.Hour, cfg.Metrics.LocalSeriesTTL)
+	assert.Equal(t, 100, cfg.Metrics.TagCardinalityLimit)
+	assert.Equal(t, "WARN", cfg.Log.Level)
+	assert.Equal(t, map[string]string{"service.query": "DEBUG"}, cfg.Log.NamedLevels)
+	assert.Equal(t, "otlp", cfg.Trace.Exporter)
+	assert.Equal(t, "collector:4318", cfg.Trace.Endpoint)
+	assert.True(t, cfg.Trace.OTLPHTTP)
+	assert.False(t, cfg.Trace.OTLPInsecure)
+	assert.Equal(t, uint64(5), cfg.Trace.SampleOneInN)
+
+	os.Setenv("OBS_TRACE_SAMPLE_ONE_IN_N", "often")
+	assert.Error(t, cfg.ApplyEnv())
+}
+
+func TestInitFromConfig(t *testing.T) {
+	cfg := DefaultConfig("service")
+	cfg.Tags = map[string]string{"a": "b"}
+	cfg.Metrics.Sink = "none"
+	cfg.Metrics.LocalAggregation = true
+	cfg.Trace.Exporter = "none"
+	cfg.Log.Level = "NEVER"
+
+	cfg.Log.NamedLevels = map[string]string{"service.query": "DEBUG"}
+
+	fr, closer, err := InitFromConfig(context.Background(), cfg)
+	if assert.NoError(t, err) {
+		fs, _, done := fr.WithNewSpan(context.Background(), "op")
+		fs.Incr("test")
+		done()
+		assert.True(t, fr.ScopeName("query").ScopeName("planner").(*flightRecorder).l.IsDebug())
+		assert.False(t, fr.ScopeName("grpc").(*flightRecorder).l.IsDebug())
+		closer()
+	}
+
+	cfg.Log.NamedLevels = map[string]string{"service.query": "LOUD"}
+	_, _, err = InitFromConfig(context.Background(), cfg)
+	assert.Error(t, err)
+	cfg.Log.NamedLevels = nil
+
+	cfg.Metrics.Relabel = []metrics.RelabelRule{{Action: "replace"}}
+	_, _, err = InitFromConfig(context.Background(), cfg)
+	assert.Error(t, err)
+	cfg.Metrics.Relabel = nil
+
+	cfg.Metrics.Sink = "graphite"
+	_, _, err = InitFromConfig(context.Background(), cfg)
+	assert.Error(t, err)
+
+	cfg.Metrics.Sink = "multi"
+	_, _, err = InitFromConfig(context.Background(), cfg)
+	assert.Error(t, err, "multi requires destinations")
+	cfg.Metrics.Destinations = []MetricsDestinationConfig{{MetricsConfig: MetricsConfig{Sink: "graphite"}}}
+	_, _, err = InitFromConfig(context.Background(), cfg)
+	assert.Error(t, err)
+	cfg.Metrics.Destinations = []MetricsDestinationConfig{{MetricsConfig: MetricsConfig{Sink: "multi"}}}
+	_, _, err = InitFromConfig(context.Background(), cfg)
+	assert.Error(t, err)
+	cfg.Metrics.Destinations = []MetricsDestinationConfig{
+		{MetricsConfig: MetricsConfig{Sink: "none"}, Filter: metrics.SinkFilter{Types: []string{"histogram"}}},
+	}
+	_, _, err = InitFromConfig(context.Background(), cfg)
+	assert.Error(t, err)
+	cfg.Metrics.Destinations = nil
+
+	cfg.Metrics.Sink = "wavefront"
+	_, _, err = InitFromConfig(context.Background(), cfg)
+	assert.Error(t, err, "wavefront requires hosts")
+
+	cfg.Metrics.Sink = "influx"
+	_, _, err = InitFromConfig(context.Background(), cfg)
+	assert.Error(t, err, "influx requires a URL")
+
+	cfg.Metrics.Sink = "statsd"
+	cfg.Metrics.StatsdOverflow = "spill"
+	_, _, err = InitFromConfig(context.Background(), cfg)
+	assert.Error(t, err)
+
+	cfg.Metrics.Sink = "none"
+	cfg.Trace.Exporter = "jaeger"
+	_, _, err = InitFromConfig(context.Background(), cfg)
+	assert.Error(t, err)
+}
@@ -2,6 +2,9 @@ package obs
 
 import (
 	"fmt"
+	"log"
+	"os"
+	"strings"
 	"syscall"
 	"time"
 
@@ -17,7 +20,10 @@ import (
 )
 
 type Options struct {
-	LogLevel string `long:"obs.log-level" description:"NEVER, DEBUG, INFO, WARN, ERROR or CRITICAL" default:"INFO"`
+	LogLevel  string `long:"obs.log-level" description:"NEVER, DEBUG, INFO, WARN, ERROR or CRITICAL" default:"INFO"`
+	LogLevels string `long:"obs.log-levels" description:"Levels for specific loggers, for example myservice.query=DEBUG,myservice.grpc=WARN"`
+	// MetricsAddress is the statsd address, either host:port for UDP or a udp://, tcp://, unix:// or unixgram:// URL.
+	MetricsAddress string `long:"obs.metrics-address" description:"statsd address: host:port, tcp://host:port, unix:///path or unixgram:///path" default:"127.0.0.1:8125"`
 }
 
 type Closer func()
@@ -27,16 +33,64 @@ type Option func(*obsOptions)
 // SampleRate takes in an int n, and sets the sampling rate of traces to be 1 / n
 func SampleRate(n uint64) Option {
 	return func(o *obsOptions) {
-		o.tracerOpts.ShouldSample = func(traceID uint64) bool { return traceID%n == 0 }
+		o.sampler.SetOneInN(n)
 	}
 }
 
 var NoTraces Option = func(o *obsOptions) {
-	o.tracerOpts.ShouldSample = func(traceID uint64) bool { return false }
+	o.sampler.SetOneInN(0)
+}
+
+// LogLevels sets the levels of specific loggers, in the form "myservice.query=DEBUG,myservice.grpc=WARN". Logger names
+// are the dotted names of scoped FlightRecorders, and the most specific prefix wins.
+func LogLevels(spec string) Option {
+	return func(o *obsOptions) {
+		o.logLevels = spec
+	}
+}
+
+// MetricsAddress sets the address of the statsd daemon, either host:port for UDP or a udp://, tcp://, unix:// or
+// unixgram:// URL.
+func MetricsAddress(addr string) Option {
+	return func(o *obsOptions) {
+		o.metricsAddress = addr
+	}
+}
+
+// MetricsSink sets the sink metrics are reported to instead of statsd, for example one returned by
+// metrics.NewMultiSink to report to several destinations.
+func MetricsSink(sink metrics.Sink) Option {
+	return func(o *obsOptions) {
+		o.metricsSink = sink
+	}
+}
+
+// TagCardinalityLimit limits how many distinct values each tag key can take under each metric prefix. Values past the
+// limit are reported as metrics.OtherTagValue. There's no limit by default.
+func TagCardinalityLimit(limit int) Option {
+	return func(o *obsOptions) {
+		o.tagCardinalityLimit = limit
+	}
 }
 
 type obsOptions struct {
-	tracerOpts basictracer.Options
+	tracerOpts          basictracer.Options
+	sampler             *tracing.Sampler
+	logLevels           string
+	metricsAddress      string
+	metricsSink         metrics.Sink
+	tagCardinalityLimit int
+}
+
+// newObsOptions returns the default options, which sample 1 in 100 traces.
+func newObsOptions() obsOptions {
+	o := obsOptions{
+		tracerOpts:     basictracer.DefaultOptions(),
+		sampler:        tracing.NewSampler(100),
+		metricsAddress: DefaultConfig("").Metrics.Address,
+	}
+	o.tracerOpts.ShouldSample = o.sampler.ShouldSample
+	return o
 }
 
 // TODO(shimin): InitGCP should be able to set default tags (project, cluster, host) from metadata service.
@@ -45,14 +99,28 @@ func InitGCP(ctx context.Context, serviceName, logLevel string, opts ...Option)
 	sig := closesig.Client(closesig.DefaultPort)
 	l := logging.New("NEVER", logLevel, "", "json")
 
-	obsOpts := obsOptions{tracerOpts: basictracer.DefaultOptions()}
-	SampleRate(100)(&obsOpts)
+	obsOpts := newObsOptions()
 	for _, o := range opts {
 		o(&obsOpts)
 	}
 
+	if named, err := logging.ParseNamedLevels(obsOpts.logLevels); err != nil {
+		l.Error("invalid log levels", logging.Fields{}.WithError(err))
+	} else if err := setNamedLogLevels(l, named); err != nil {
+		l.Error("error setting log levels", logging.Fields{}.WithError(err))
+	}
+
+	sink := obsOpts.metricsSink
+	if sink == nil {
+		var err error
+		if sink, err = metrics.NewStatsdSink(obsOpts.metricsAddress); err != nil {
+			l.Critical("error initializing metrics", logging.Fields{}.WithError(err))
+			panic(fmt.Errorf("error initializing metrics: %v", err))
+		}
+	}
+
 	tracer, closeTracer := tracing.New(obsOpts.tracerOpts)
-	fr, closer := initFR(ctx, serviceName, l, tracer)
+	fr, closer := initFR(ctx, serviceName, l, tracer, obsOpts.sampler, sink, obsOpts.tagCardinalityLimit)
 	return fr, func() {
 		closeTracer()
 		closer()
@@ -66,14 +134,8 @@ func InitCli(ctx context.Context, name, logLevel string) (FlightRecorder, Closer
 	return fr, func() {}
 }
 
-func initFR(ctx context.Context, serviceName string, l logging.Logger, tr opentracing.Tracer) (FlightRecorder, Closer) {
-	sink, err := metrics.NewStatsdSink("127.0.0.1:8125")
-	if err != nil {
-		l.Critical("error initializing metrics", logging.Fields{}.WithError(err))
-		panic(fmt.Errorf("error initializing metrics: %v", err))
-	}
-
-	mr := metrics.NewReceiver(sink).ScopePrefix(serviceName)
+func initFR(ctx context.Context, serviceName string, l logging.Logger, tr opentracing.Tracer, sampler *tracing.Sampler, sink metrics.Sink, tagCardinalityLimit int) (FlightRecorder, Closer) {
+	mr := metrics.NewReceiver(sink, metrics.WithTagCardinalityLimit(tagCardinalityLimit)).ScopePrefix(serviceName)
 	l = l.Named(serviceName)
 	Metrics = mr
 	Log = l
@@ -81,14 +143,35 @@ func initFR(ctx context.Context, serviceName string, l logging.Logger, tr opentr
 	done := make(chan struct{})
 	reportStandardMetrics(mr, done)
 
-	fr := NewFlightRecorder(serviceName, mr, l, tr)
-	// TODO: make this work. currently obs.logging uses SetOutput on the global logging which makes this a circlular dependency
-	// log.SetOutput(stderrAdapter{fr.WithSpan(ctx)})
+	fr := newFlightRecorder(serviceName, mr, l, tr)
+	fr.sampler = sampler
+
+	// route the standard library logger, used by dependencies and by the metrics sinks, into the FlightRecorder
+	log.SetFlags(0)
+	log.SetOutput(stderrAdapter{fr.WithSpan(ctx).(*flightSpan)})
 
 	return fr, func() {
 		close(done)
 		sink.Close()
+		log.SetOutput(os.Stderr)
+		log.SetFlags(log.LstdFlags)
+	}
+}
+
+func setNamedLogLevels(l logging.Logger, named map[string]string) error {
+	if len(named) == 0 {
+		return nil
+	}
+	ls, ok := l.(logging.LevelSetter)
+	if !ok {
+		return fmt.Errorf("log levels can't be set for this logger")
+	}
+	for name, level := range named {
+		if err := ls.SetNamedLevel(name, level); err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
 func reportStandardMetrics(mr metrics.Receiver, done <-chan struct{}) {
@@ -154,11 +237,18 @@ func reportRusage(done <-chan struct{}, receiver metrics.Receiver) {
 	}()
 }
 
+// stderrAdapter logs the lines of the standard library logger at Warn, since they're mostly failures of the metrics
+// sinks and panics recovered by net/http, which used to always reach stderr and mustn't be filtered out by the usual
+// WARN level. They're logged without FlightSpan.Warn's metric, which could fail to send and be logged again.
 type stderrAdapter struct {
-	fs FlightSpan
+	fs *flightSpan
 }
 
 func (sa stderrAdapter) Write(bs []byte) (int, error) {
-	sa.fs.Info(string(bs), Vals(getCallerContext(1)))
+	// skip Write, log.(*Logger).output and log.Printf to report the caller of log.Printf
+	message := strings.TrimSuffix(string(bs), "\n")
+	fields := sa.fs.logFields(Vals(getCallerContext(4)))
+	sa.fs.l.Warn(message, fields)
+	sa.fs.logTrace(message, fields)
 	return len(bs), nil
 }
@@ -0,0 +1,37 @@
+package obs
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/mixpanel/obs/logging"
+	"github.com/mixpanel/obs/metrics"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStderrAdapter(t *testing.T) {
+	buf := &bytes.Buffer{}
+	// standard library log lines are logged at Warn, so they're kept at the WARN level most services use
+	l, err := logging.NewWithOutputs("WARN", logging.Output{Writer: buf, Format: "text"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	fr := NewFlightRecorder("test", metrics.Null, l, opentracing.NoopTracer{})
+
+	log.SetFlags(0)
+	log.SetOutput(stderrAdapter{fr.WithSpan(context.Background()).(*flightSpan)})
+	defer func() {
+		log.SetOutput(os.Stderr)
+		log.SetFlags(log.LstdFlags)
+	}()
+
+	log.Printf("hello from %s", "log")
+	assert.Contains(t, buf.String(), "[WARN]: hello from log |")
+	assert.Contains(t, buf.String(), "defaults_test.go")
+	assert.Equal(t, 1, bytes.Count(buf.Bytes(), []byte("\n")))
+}
@@ -14,6 +14,9 @@ var Log logging.Logger = logging.Null
 var Sink metrics.Sink = metrics.NullSink
 var Metrics metrics.Receiver = metrics.Null
 
+// ObsOptions configures the global Log and Metrics from command line flags.
+//
+// Deprecated: use LoadConfig and InitFromConfig, which configure a FlightRecorder from a file or the environment.
 type ObsOptions struct {
 	SyslogLevel     string `long:"syslog.level" default:"NEVER" description:"One of CRIT, ERR, WARN, INFO, DEBUG, NEVER"`
 	LogLevel        string `long:"log.level" default:"INFO" description:"One of CRIT, ERR, WARN, INFO, DEBUG, NEVER"`
@@ -2,12 +2,14 @@ package obs
 
 import (
 	"fmt"
+	"net/http"
 	"runtime"
 	"sync"
 	"time"
 
 	"github.com/mixpanel/obs/logging"
 	"github.com/mixpanel/obs/metrics"
+	"github.com/mixpanel/obs/tracing"
 
 	"google.golang.org/grpc"
 
@@ -20,6 +22,10 @@ import (
 
 // NewFlightRecorder constructs a new FlightRecorder with the underlying metrics, logger, and tracer.
 func NewFlightRecorder(name string, metrics metrics.Receiver, logger logging.Logger, tracer opentracing.Tracer) FlightRecorder {
+	return newFlightRecorder(name, metrics, logger, tracer)
+}
+
+func newFlightRecorder(name string, metrics metrics.Receiver, logger logging.Logger, tracer opentracing.Tracer) *flightRecorder {
 	return &flightRecorder{
 		serviceName: name,
 		name:        name,
@@ -164,6 +170,14 @@ type FlightRecorder interface {
 	// streaming RPCs with that particular server. Make sure to also include GRPServer.
 	GRPCStreamServer() grpc.ServerOption
 
+	// HTTPHandler wraps an http.Handler so that this FlightRecorder instruments every request it serves under the
+	// provided name, continuing any trace context found in the request headers.
+	HTTPHandler(name string, handler http.Handler) http.Handler
+
+	// HTTPRoundTripper wraps an http.RoundTripper so that this FlightRecorder instruments every request sent through
+	// it, propagating the trace context in the request headers. If rt is nil, http.DefaultTransport is used.
+	HTTPRoundTripper(rt http.RoundTripper) http.RoundTripper
+
 	// WithNewSpanContext is like WithNewSpan but allows you to specify the parent SpanContext instead of deriving it
 	// from the context.Context. This is usually only useful for libraries that derive tracing contexts from out-of-process
 	// origins, such as as GRPC request where the tracing context is embeded in GRPC Metadata.
@@ -172,6 +186,25 @@ type FlightRecorder interface {
 	// WithRootSpan is like WithNewSpan but allows you to force a root span and set its sample rate.
 	WithRootSpan(ctx context.Context, opName string, sampleOneInN int) (FlightSpan, context.Context, DoneFunc)
 
+	// AdminHandler returns an http.Handler to inspect and change telemetry settings at runtime, typically mounted
+	// under a debug path such as /debug/obs/. It serves:
+	//     GET    .../log_level                                     the global and per-name log levels
+	//     POST   .../log_level?level=DEBUG[&name=n][&duration=10m] set the level, optionally for one logger or for a while
+	//     DELETE .../log_level?name=n                              remove the level set for one logger
+	//     GET    .../sampling                                      the trace sample rate
+	//     POST   .../sampling?one_in_n=10                          sample 1 in 10 traces, or none if 0
+	//     POST   .../flush                                         flush metrics and traces
+	AdminHandler() http.Handler
+
+	// Recover reports a panic in the calling goroutine: it logs a Critical with the stack trace, increments
+	// <name>.panic, marks the span in ctx as errored and flushes metrics and traces. It must be deferred directly:
+	//     defer fr.Recover(ctx, "worker")
+	// The panic is swallowed unless the Repanic option is provided.
+	Recover(ctx context.Context, name string, opts ...RecoverOption)
+
+	// Go runs f in a new goroutine inside a new span called name, reporting any panic like Recover.
+	Go(ctx context.Context, name string, f func(ctx context.Context), opts ...RecoverOption)
+
 	GetReceiver() metrics.Receiver
 }
 
@@ -207,6 +240,9 @@ type flightRecorder struct {
 	l  logging.Logger
 	tr opentracing.Tracer
 
+	// sampler is nil unless the trace sample rate can be changed at runtime
+	sampler *tracing.Sampler
+
 	mu     sync.Mutex
 	scoped map[string]*flightRecorder
 }
@@ -247,6 +283,21 @@ func (fr *flightRecorder) GRPCStreamServer() grpc.ServerOption {
 	return grpc.StreamInterceptor(tracingStreamServerInterceptor(fr, fr.tr))
 }
 
+func (fr *flightRecorder) HTTPHandler(name string, handler http.Handler) http.Handler {
+	return tracingHTTPHandler(fr, fr.tr, name, handler)
+}
+
+func (fr *flightRecorder) HTTPRoundTripper(rt http.RoundTripper) http.RoundTripper {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	return &tracingRoundTripper{fr: fr, tracer: fr.tr, rt: rt}
+}
+
+func (fr *flightRecorder) AdminHandler() http.Handler {
+	return &adminHandler{fr: fr}
+}
+
 func (fr *flightRecorder) mkScoped(name string, tags Tags) *flightRecorder {
 	newName := joinNames(fr.name, name)
 
@@ -268,6 +319,8 @@ func (fr *flightRecorder) mkScoped(name string, tags Tags) *flightRecorder {
 		l:  fr.l.Named(newName),
 		tr: fr.tr,
 
+		sampler: fr.sampler,
+
 		scoped: make(map[string]*flightRecorder),
 	}
 }
@@ -309,27 +362,34 @@ func (fs *flightSpan) TraceSpan() opentracing.Span {
 }
 
 func (fr *flightRecorder) WithNewSpan(ctx context.Context, opName string) (FlightSpan, context.Context, DoneFunc) {
-	var spanCtx opentracing.SpanContext
+	return fr.WithNewSpanContext(ctx, opName, fr.parentSpanContext(ctx))
+}
+
+// parentSpanContext returns the context of the span in ctx, if any, for new spans to be children of.
+func (fr *flightRecorder) parentSpanContext(ctx context.Context) opentracing.SpanContext {
 	if parentSpan := opentracing.SpanFromContext(ctx); parentSpan != nil {
-		spanCtx = parentSpan.Context()
+		return parentSpan.Context()
 	}
-	return fr.WithNewSpanContext(ctx, opName, spanCtx)
+	return otelParentContext(ctx, fr.tr)
 }
 
 func (fr *flightRecorder) WithNewSpanContext(ctx context.Context, opName string, spanCtx opentracing.SpanContext) (FlightSpan, context.Context, DoneFunc) {
-	var span opentracing.Span
+	return fr.startSpan(ctx, opName, spanCtx)
+}
+
+func (fr *flightRecorder) startSpan(ctx context.Context, opName string, spanCtx opentracing.SpanContext, opts ...opentracing.StartSpanOption) (FlightSpan, context.Context, DoneFunc) {
 	fullOpName := joinNames(fr.name, opName)
 	if spanCtx != nil {
-		span = fr.tr.StartSpan(fullOpName, opentracing.ChildOf(spanCtx))
-	} else {
-		span = fr.tr.StartSpan(fullOpName)
+		opts = append(opts, opentracing.ChildOf(spanCtx))
 	}
+	span := fr.tr.StartSpan(fullOpName, opts...)
 
 	for k, v := range fr.tags {
 		span = span.SetTag(k, v)
 	}
 
 	ctx = opentracing.ContextWithSpan(ctx, span)
+	ctx = otelContextWithSpan(ctx, span)
 	fs := &flightSpan{
 		span:           span,
 		ctx:            ctx,
@@ -342,8 +402,18 @@ func (fr *flightRecorder) WithNewSpanContext(ctx context.Context, opName string,
 	}
 }
 
+// rootSampler is implemented by tracers that make their sampling decision when a span starts, and so need to be
+// told the sample rate of a root span up front.
+type rootSampler interface {
+	RootSpanOption(sampleOneInN int) opentracing.StartSpanOption
+}
+
 func (fr *flightRecorder) WithRootSpan(ctx context.Context, opName string, sampleOneInN int) (FlightSpan, context.Context, DoneFunc) {
-	fs, ctx, done := fr.WithNewSpanContext(ctx, opName, nil)
+	var opts []opentracing.StartSpanOption
+	if rs, ok := fr.tr.(rootSampler); ok {
+		opts = append(opts, rs.RootSpanOption(sampleOneInN))
+	}
+	fs, ctx, done := fr.startSpan(ctx, opName, nil, opts...)
 
 	if sc, ok := fs.TraceSpan().Context().(basictracer.SpanContext); ok {
 		if sc.TraceID%uint64(sampleOneInN) == 0 {
@@ -364,8 +434,13 @@ func (fs *flightSpan) TraceID() (string, bool) {
 	if fs.span == nil {
 		return "", false
 	}
-	if id, ok := fs.span.Context().(basictracer.SpanContext); ok {
+	switch id := fs.span.Context().(type) {
+	case basictracer.SpanContext:
 		return fmt.Sprintf("%032x", id.TraceID), true
+	case tracing.OTelSpanContext:
+		if id.HasTraceID() {
+			return id.TraceID().String(), true
+		}
 	}
 	return "", false
 }
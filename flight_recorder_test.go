@@ -1,6 +1,23 @@
 package obs
 
-import "testing"
+import (
+	"testing"
+
+	"github.com/mixpanel/obs/logging"
+	"github.com/mixpanel/obs/metrics"
+
+	basictracer "github.com/opentracing/basictracer-go"
+)
+
+// newTestFlightRecorder returns a flight recorder named "test" along with the sink and span recorder it reports to.
+func newTestFlightRecorder() (FlightRecorder, *metrics.MockSink, *basictracer.InMemorySpanRecorder) {
+	sink := metrics.NewMockSink()
+	recorder := basictracer.NewInMemoryRecorder()
+	opts := basictracer.DefaultOptions()
+	opts.Recorder = recorder
+	fr := NewFlightRecorder("test", metrics.NewReceiver(sink), logging.Null, basictracer.NewWithOptions(opts))
+	return fr, sink, recorder
+}
 
 func BenchmarkGetCallerContext(b *testing.B) {
 	for i := 0; i < b.N; i++ {
@@ -0,0 +1,153 @@
+package metrics
+
+// SeriesID identifies a metric by its name and labels. It's a hash, so callers
+// compute it once per update and the registry compares names and labels only
+// to tell apart series whose IDs collide.
+type SeriesID uint64
+
+const (
+	offset64 = 14695981039346656037
+	prime64  = 1099511628211
+)
+
+// NewSeriesID returns the ID of the series with the given name and labels. The
+// labels are hashed in any order, so they needn't be sorted or formatted.
+func NewSeriesID(name string, labels map[string]string) SeriesID {
+	id := hashString(offset64, name)
+	var sum uint64
+	for k, v := range labels {
+		// 0xff never appears in UTF-8, so it separates the key from the value
+		h := hashString(offset64, k)
+		h = (h ^ 0xff) * prime64
+		sum += hashString(h, v)
+	}
+	return SeriesID((id ^ sum) * prime64)
+}
+
+// hashString continues the FNV-1a hash h with the bytes of s.
+func hashString(h uint64, s string) uint64 {
+	for i := 0; i < len(s); i++ {
+		h ^= uint64(s[i])
+		h *= prime64
+	}
+	return h
+}
+
+// LabeledSeries is a metric registered under a name and labels.
+type LabeledSeries struct {
+	ID     SeriesID
+	Name   string
+	Labels map[string]string
+	Metric interface{}
+}
+
+// Create a new series. The labels are copied, so the caller can reuse them.
+func NewLabeledSeries(id SeriesID, name string, labels map[string]string, metric interface{}) *LabeledSeries {
+	copied := make(map[string]string, len(labels))
+	for k, v := range labels {
+		copied[k] = v
+	}
+	return &LabeledSeries{ID: id, Name: name, Labels: copied, Metric: metric}
+}
+
+func (s *LabeledSeries) matches(name string, labels map[string]string) bool {
+	if s.Name != name || len(s.Labels) != len(labels) {
+		return false
+	}
+	for k, v := range labels {
+		if l, ok := s.Labels[k]; !ok || l != v {
+			return false
+		}
+	}
+	return true
+}
+
+// A LabeledRegistry holds references to a set of metrics by name and labels,
+// looked up by their SeriesID.
+type LabeledRegistry interface {
+
+	// Call the given function for each registered series.
+	Each(func(*LabeledSeries))
+
+	// Get the series with the given ID, name and labels or nil if none is
+	// registered.
+	Get(SeriesID, string, map[string]string) *LabeledSeries
+
+	// Register the given series.
+	Register(*LabeledSeries) error
+
+	// Unregister the given series.
+	Unregister(*LabeledSeries)
+
+	// Unregister all series.
+	UnregisterAll()
+}
+
+// The standard implementation of a LabeledRegistry is a map of IDs to the
+// series that have them, which is almost always just one. It isn't safe for
+// concurrent use, since its callers already serialize their updates to the
+// series they look up.
+type StandardLabeledRegistry struct {
+	series map[SeriesID][]*LabeledSeries
+}
+
+// Create a new labeled registry.
+func NewLabeledRegistry() LabeledRegistry {
+	return &StandardLabeledRegistry{series: make(map[SeriesID][]*LabeledSeries)}
+}
+
+// Call the given function for each registered series.
+func (r *StandardLabeledRegistry) Each(f func(*LabeledSeries)) {
+	for _, series := range r.series {
+		for _, s := range series {
+			f(s)
+		}
+	}
+}
+
+// Get the series with the given ID, name and labels or nil if none is
+// registered.
+func (r *StandardLabeledRegistry) Get(id SeriesID, name string, labels map[string]string) *LabeledSeries {
+	for _, s := range r.series[id] {
+		if s.matches(name, labels) {
+			return s
+		}
+	}
+	return nil
+}
+
+// Register the given series. Returns a DuplicateMetric if a series with the
+// same name and labels is already registered.
+func (r *StandardLabeledRegistry) Register(s *LabeledSeries) error {
+	for _, existing := range r.series[s.ID] {
+		if existing.matches(s.Name, s.Labels) {
+			return DuplicateMetric(s.Name)
+		}
+	}
+	switch s.Metric.(type) {
+	case Counter, Gauge, GaugeFloat64, Healthcheck, Histogram, Meter, Timer:
+		r.series[s.ID] = append(r.series[s.ID], s)
+	}
+	return nil
+}
+
+// Unregister the given series.
+func (r *StandardLabeledRegistry) Unregister(s *LabeledSeries) {
+	series := r.series[s.ID]
+	for i, existing := range series {
+		if existing == s {
+			series = append(series[:i:i], series[i+1:]...)
+			break
+		}
+	}
+	if len(series) == 0 {
+		delete(r.series, s.ID)
+	} else {
+		r.series[s.ID] = series
+	}
+}
+
+// Unregister all series.
+func (r *StandardLabeledRegistry) UnregisterAll() {
+	r.series = make(map[SeriesID][]*LabeledSeries)
+}
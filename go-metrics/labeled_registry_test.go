@@ -0,0 +1,85 @@
+package metrics
+
+import "testing"
+
+func BenchmarkNewSeriesID(b *testing.B) {
+	labels := map[string]string{"host": "a", "method": "GET", "status": "200"}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		NewSeriesID("requests", labels)
+	}
+}
+
+func TestNewSeriesID(t *testing.T) {
+	id := NewSeriesID("foo", map[string]string{"a": "b", "c": "d"})
+	if id != NewSeriesID("foo", map[string]string{"c": "d", "a": "b"}) {
+		t.Fatal("IDs depend on the order of labels")
+	}
+	for _, other := range []SeriesID{
+		NewSeriesID("bar", map[string]string{"a": "b", "c": "d"}),
+		NewSeriesID("foo", map[string]string{"a": "bc", "": "d"}),
+		NewSeriesID("foo", map[string]string{"ab": "", "c": "d"}),
+		NewSeriesID("foo", nil),
+	} {
+		if id == other {
+			t.Fatal(other)
+		}
+	}
+}
+
+func TestLabeledRegistry(t *testing.T) {
+	r := NewLabeledRegistry()
+	labels := map[string]string{"a": "b"}
+	id := NewSeriesID("foo", labels)
+	series := NewLabeledSeries(id, "foo", labels, NewCounter())
+	if err := r.Register(series); nil != err {
+		t.Fatal(err)
+	}
+	if err := r.Register(NewLabeledSeries(id, "foo", labels, NewGauge())); nil == err {
+		t.Fatal(err)
+	}
+	// the labels are copied
+	labels["a"] = "c"
+	if s := r.Get(id, "foo", map[string]string{"a": "b"}); s != series {
+		t.Fatal(s)
+	}
+	if s := r.Get(id, "foo", nil); s != nil {
+		t.Fatal(s)
+	}
+	i := 0
+	r.Each(func(s *LabeledSeries) {
+		i++
+		if _, ok := s.Metric.(Counter); !ok {
+			t.Fatal(s.Metric)
+		}
+	})
+	if 1 != i {
+		t.Fatal(i)
+	}
+	r.Unregister(series)
+	if s := r.Get(id, "foo", map[string]string{"a": "b"}); s != nil {
+		t.Fatal(s)
+	}
+}
+
+func TestLabeledRegistryCollision(t *testing.T) {
+	r := NewLabeledRegistry()
+	// series whose IDs collide are told apart by their names and labels
+	foo := NewLabeledSeries(1, "foo", nil, NewCounter())
+	bar := NewLabeledSeries(1, "bar", map[string]string{"a": "b"}, NewCounter())
+	r.Register(foo)
+	r.Register(bar)
+	if s := r.Get(1, "foo", nil); s != foo {
+		t.Fatal(s)
+	}
+	if s := r.Get(1, "bar", map[string]string{"a": "b"}); s != bar {
+		t.Fatal(s)
+	}
+	r.Unregister(foo)
+	if s := r.Get(1, "foo", nil); s != nil {
+		t.Fatal(s)
+	}
+	if s := r.Get(1, "bar", map[string]string{"a": "b"}); s != bar {
+		t.Fatal(s)
+	}
+}
@@ -13,9 +13,10 @@ const (
 )
 
 type bucket struct {
-	earliest      time.Time
-	values, count int64
-	digest        *tdigest.MergingDigest
+	earliest time.Time
+	values   float64
+	count    int64
+	digest   *tdigest.MergingDigest
 }
 
 func (b *bucket) merge(other *bucket) {
@@ -66,6 +67,11 @@ func (sample *TDigestSample) drop() {
 }
 
 func (sample *TDigestSample) Update(value int64) {
+	sample.UpdateFloat64(float64(value))
+}
+
+// UpdateFloat64 adds a value to the sample without truncating it to an integer.
+func (sample *TDigestSample) UpdateFloat64(value float64) {
 	sample.mutex.Lock()
 	defer sample.mutex.Unlock()
 
@@ -79,7 +85,7 @@ func (sample *TDigestSample) Update(value int64) {
 
 	sample.cur.values += value
 	sample.cur.count++
-	sample.cur.digest.Add(float64(value), 1.0)
+	sample.cur.digest.Add(value, 1.0)
 }
 
 func (sample *TDigestSample) Clear() {
@@ -142,7 +148,7 @@ func (sample *TDigestSample) Mean() float64 {
 	if merged.count == 0 {
 		return 0.0
 	}
-	return float64(merged.values) / float64(merged.count)
+	return merged.values / float64(merged.count)
 }
 
 func (sample *TDigestSample) Min() int64 {
@@ -179,6 +185,15 @@ func (sample *TDigestSample) Percentiles(percentiles []float64) []float64 {
 	return ret
 }
 
+// Centroids returns the centroids of the digest of the values in the time window, so that the distribution itself can
+// be reported rather than percentiles computed from it.
+func (sample *TDigestSample) Centroids() []tdigest.Centroid {
+	sample.mutex.RLock()
+	defer sample.mutex.RUnlock()
+
+	return sample.merged().digest.Centroids()
+}
+
 func (sample *TDigestSample) Snapshot() Sample {
 	sample.mutex.RLock()
 	defer sample.mutex.RUnlock()
@@ -206,7 +221,7 @@ func (sample *TDigestSample) Sum() int64 {
 	sample.mutex.RLock()
 	defer sample.mutex.RUnlock()
 
-	return sample.merged().values
+	return int64(sample.merged().values)
 }
 
 func (sample *TDigestSample) Variance() float64 {
@@ -157,3 +157,27 @@ func BenchmarkTDigestSamplePercentile(b *testing.B) {
 		}
 	}
 }
+
+func TestTDigestSampleCentroids(t *testing.T) {
+	sample := NewTDigestSample(5*time.Minute, clockwork.NewFakeClock())
+	for i := int64(1); i <= 1000; i++ {
+		sample.Update(i)
+	}
+
+	var weight, sum float64
+	for _, c := range sample.Centroids() {
+		weight += c.Weight
+		sum += c.Mean * c.Weight
+	}
+	assert.Equal(t, 1000.0, weight)
+	assertEqualWithinBound(t, 0.0001, 500500, sum)
+}
+
+func TestTDigestSampleUpdateFloat64(t *testing.T) {
+	sample := NewTDigestSample(5*time.Minute, clockwork.NewFakeClock())
+	for _, v := range []float64{0.25, 0.5, 0.75} {
+		sample.UpdateFloat64(v)
+	}
+	assert.Equal(t, 0.5, sample.Mean())
+	assertEqualWithinBound(t, 0.0001, 0.25, sample.Percentile(0))
+}
@@ -0,0 +1,197 @@
+package obs
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/mixpanel/obs/tracing"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+)
+
+func tracingHTTPHandler(fr FlightRecorder, tracer opentracing.Tracer, name string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		spanCtx, err := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(r.Header))
+
+		fs, ctx, done := fr.WithNewSpanContext(r.Context(), name, spanCtx)
+		defer done()
+		span := fs.TraceSpan()
+		ext.SpanKind.Set(span, ext.SpanKindRPCServerEnum)
+		span.SetTag("http.hostname", traceHostname)
+		span.SetTag(tracing.Label.HTTPMethod, r.Method)
+		span.SetTag(tracing.Label.HTTPRequestURL, r.URL.String())
+
+		if err != nil && err != opentracing.ErrSpanContextNotFound {
+			fs.Warn("tracer_extract", "error extracting trace headers", Vals{}.WithError(err))
+		}
+
+		rw := &responseWriter{ResponseWriter: w}
+		handler.ServeHTTP(rw, r.WithContext(ctx))
+
+		status := rw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		fs.Incr(fmt.Sprintf("http_server.%s.%s", name, statusClass(status)))
+		fs.AddStat(fmt.Sprintf("http_server.%s.response_bytes", name), float64(rw.written))
+
+		span.SetTag(tracing.Label.HTTPStatusCode, status)
+		span.SetTag(tracing.Label.HTTPResponseSize, rw.written)
+		if status >= http.StatusInternalServerError {
+			if ctx.Err() == nil {
+				ext.Error.Set(span, true)
+				span.SetTag(tracing.Label.ErrorMessage, http.StatusText(status))
+			} else {
+				span.SetTag("canceled", true)
+			}
+		}
+	})
+}
+
+type tracingRoundTripper struct {
+	fr     FlightRecorder
+	tracer opentracing.Tracer
+	rt     http.RoundTripper
+}
+
+func (t *tracingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Hostname()
+	// the span's latency is reported next to the other http_client metrics of the host
+	fs, ctx, done := t.fr.WithNewSpan(req.Context(), "http_client."+host)
+	span := fs.TraceSpan()
+	ext.SpanKind.Set(span, ext.SpanKindRPCClientEnum)
+	span.SetTag(tracing.Label.HTTPMethod, req.Method)
+	span.SetTag(tracing.Label.HTTPRequestURL, req.URL.String())
+
+	// a RoundTripper must not modify the caller's request
+	req = req.Clone(ctx)
+	if err := t.tracer.Inject(span.Context(), opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(req.Header)); err != nil {
+		fs.Warn("tracer_inject", "error injecting trace headers", Vals{}.WithError(err))
+	}
+
+	resp, err := t.rt.RoundTrip(req)
+	if err != nil {
+		fs.Incr(fmt.Sprintf("http_client.%s.error", host))
+		if ctx.Err() == nil {
+			fs.Trace(fmt.Sprintf("error in HTTP %s %s", req.Method, req.URL), Vals{}.WithError(err))
+			ext.Error.Set(span, true)
+			span.SetTag(tracing.Label.ErrorMessage, fmt.Sprintf("%v", err))
+		} else {
+			span.SetTag("canceled", true)
+		}
+		done()
+		return resp, err
+	}
+
+	fs.Incr(fmt.Sprintf("http_client.%s.%s", host, statusClass(resp.StatusCode)))
+	span.SetTag(tracing.Label.HTTPStatusCode, resp.StatusCode)
+	if resp.StatusCode >= http.StatusInternalServerError {
+		ext.Error.Set(span, true)
+	}
+	if resp.Body == nil {
+		done()
+		return resp, nil
+	}
+	// the span covers the whole request, so it ends once the caller is done with the body
+	resp.Body = &tracingBody{ReadCloser: resp.Body, fs: fs, host: host, done: done}
+	return resp, nil
+}
+
+// tracingBody finishes the span of an HTTP client request once its response body has been read or closed.
+type tracingBody struct {
+	io.ReadCloser
+	fs   FlightSpan
+	host string
+	done DoneFunc
+	once sync.Once
+	read int64
+}
+
+func (b *tracingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	atomic.AddInt64(&b.read, int64(n))
+	if err == io.EOF {
+		b.finish(nil)
+	}
+	return n, err
+}
+
+func (b *tracingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.finish(err)
+	return err
+}
+
+// finish reports the bytes read and ends the span, the first time it's called.
+func (b *tracingBody) finish(closeErr error) {
+	b.once.Do(func() {
+		read := atomic.LoadInt64(&b.read)
+		b.fs.IncrBy(fmt.Sprintf("http_client.%s.bytes_read", b.host), float64(read))
+		span := b.fs.TraceSpan()
+		span.SetTag("total_read", read)
+		if closeErr != nil {
+			span.SetTag("close_error", closeErr)
+		}
+		b.done()
+	})
+}
+
+// statusClass turns an HTTP status code into its class, for example 404 -> 4xx.
+func statusClass(status int) string {
+	return fmt.Sprintf("%dxx", status/100)
+}
+
+// responseWriter records the status code and number of bytes written by an http.Handler.
+type responseWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (rw *responseWriter) WriteHeader(status int) {
+	if rw.status == 0 {
+		rw.status = status
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *responseWriter) Write(p []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	n, err := rw.ResponseWriter.Write(p)
+	rw.written += int64(n)
+	return n, err
+}
+
+func (rw *responseWriter) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack lets handlers such as websocket servers take over the connection, if the underlying http.ResponseWriter
+// allows it. A hijacked response is reported with status 101 unless the handler wrote a status first.
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := rw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	conn, buf, err := h.Hijack()
+	if err == nil && rw.status == 0 {
+		rw.status = http.StatusSwitchingProtocols
+	}
+	return conn, buf, err
+}
+
+// Unwrap allows http.ResponseController to reach the underlying http.ResponseWriter.
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
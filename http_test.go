@@ -0,0 +1,178 @@
+package obs
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/mixpanel/obs/tracing"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPHandler(t *testing.T) {
+	fr, sink, recorder := newTestFlightRecorder()
+	handler := fr.HTTPHandler("route", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.NotNil(t, opentracing.SpanFromContext(r.Context()))
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("not found"))
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/path?q=1", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	assert.Equal(t, 1, sink.Invocations["http_server.route.4xx, map[], 1, ct\n"])
+	assert.Equal(t, 1, sink.Invocations["http_server.route.response_bytes, map[], 9, h\n"])
+
+	spans := recorder.GetSpans()
+	if assert.Len(t, spans, 1) {
+		tags := spans[0].Tags
+		assert.Equal(t, "test.route", spans[0].Operation)
+		assert.Equal(t, "GET", tags[tracing.Label.HTTPMethod])
+		assert.Equal(t, "/path?q=1", tags[tracing.Label.HTTPRequestURL])
+		assert.Equal(t, http.StatusNotFound, tags[tracing.Label.HTTPStatusCode])
+		assert.Equal(t, int64(9), tags[tracing.Label.HTTPResponseSize])
+		assert.Nil(t, tags["error"])
+	}
+}
+
+func TestHTTPHandlerServerError(t *testing.T) {
+	fr, sink, recorder := newTestFlightRecorder()
+	handler := fr.HTTPHandler("route", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "oops", http.StatusInternalServerError)
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/", nil))
+
+	assert.Equal(t, 1, sink.Invocations["http_server.route.5xx, map[], 1, ct\n"])
+	if spans := recorder.GetSpans(); assert.Len(t, spans, 1) {
+		assert.Equal(t, true, spans[0].Tags["error"])
+	}
+}
+
+func TestHTTPHandlerImplicitOK(t *testing.T) {
+	fr, sink, _ := newTestFlightRecorder()
+	handler := fr.HTTPHandler("route", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, 1, sink.Invocations["http_server.route.2xx, map[], 1, ct\n"])
+}
+
+func TestHTTPHandlerHijack(t *testing.T) {
+	fr, sink, _ := newTestFlightRecorder()
+	handler := fr.HTTPHandler("route", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: test\r\nConnection: Upgrade\r\n\r\nhello")
+		buf.Flush()
+	}))
+	served := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(served)
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, "hello", string(body))
+	<-served
+	assert.Equal(t, 1, sink.Invocations["http_server.route.1xx, map[], 1, ct\n"])
+
+	// writers that can't be hijacked say so, rather than failing the type assertion
+	handler = fr.HTTPHandler("route", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _, err := w.(http.Hijacker).Hijack()
+		assert.Equal(t, http.ErrNotSupported, err)
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+}
+
+func TestHTTPHandlerExtractsTraceContext(t *testing.T) {
+	fr, _, recorder := newTestFlightRecorder()
+	handler := fr.HTTPHandler("route", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	client, _, done := fr.WithNewSpan(httptest.NewRequest("GET", "/", nil).Context(), "client")
+	req := httptest.NewRequest("GET", "/", nil)
+	span := client.TraceSpan()
+	assert.NoError(t, span.Tracer().Inject(span.Context(), opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(req.Header)))
+
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	done()
+
+	spans := recorder.GetSpans()
+	if assert.Len(t, spans, 2) {
+		assert.Equal(t, spans[1].Context.TraceID, spans[0].Context.TraceID)
+		assert.Equal(t, spans[1].Context.SpanID, spans[0].ParentSpanID)
+	}
+}
+
+func TestHTTPRoundTripper(t *testing.T) {
+	fr, sink, recorder := newTestFlightRecorder()
+	var traceHeaders http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceHeaders = r.Header
+		w.Write([]byte("hello"))
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: fr.HTTPRoundTripper(nil)}
+	req, err := http.NewRequest("GET", server.URL+"/path", nil)
+	assert.NoError(t, err)
+	resp, err := client.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Empty(t, recorder.GetSpans(), "the span ends once the body is read")
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.NoError(t, resp.Body.Close())
+	assert.Equal(t, "hello", string(body))
+	assert.Empty(t, req.Header, "the caller's request should not be modified")
+
+	assert.Equal(t, 1, sink.Invocations["http_client.127.0.0.1.2xx, map[], 1, ct\n"])
+	assert.Equal(t, 1, sink.Invocations["http_client.127.0.0.1.bytes_read, map[], 5, ct\n"])
+	var latencies int
+	for invocation := range sink.Invocations {
+		if strings.HasPrefix(invocation, "http_client.127.0.0.1.latency_us, map[], ") {
+			latencies++
+		}
+	}
+	assert.Equal(t, 1, latencies)
+
+	spans := recorder.GetSpans()
+	if assert.Len(t, spans, 1) {
+		client := spans[0]
+		assert.Equal(t, "test.http_client.127.0.0.1", client.Operation)
+		assert.Equal(t, "client", string(client.Tags["span.kind"].(ext.SpanKindEnum)))
+		assert.Equal(t, http.StatusOK, client.Tags[tracing.Label.HTTPStatusCode])
+		assert.Equal(t, int64(5), client.Tags["total_read"])
+
+		assert.Equal(t, strconv.FormatUint(client.Context.TraceID, 16), traceHeaders.Get("Ot-Tracer-Traceid"))
+	}
+}
+
+func TestHTTPRoundTripperError(t *testing.T) {
+	fr, sink, recorder := newTestFlightRecorder()
+	client := &http.Client{Transport: fr.HTTPRoundTripper(nil)}
+
+	_, err := client.Get("http://127.0.0.1:1/")
+	assert.Error(t, err)
+	assert.Equal(t, 1, sink.Invocations["http_client.127.0.0.1.error, map[], 1, ct\n"])
+	if spans := recorder.GetSpans(); assert.Len(t, spans, 1) {
+		assert.Equal(t, true, spans[0].Tags["error"])
+	}
+}
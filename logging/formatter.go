@@ -89,6 +89,8 @@ func levelToString(lvl level) string {
 		return "ERROR"
 	case levelCritical:
 		return "CRITICAL"
+	case levelNever:
+		return "NEVER"
 	default:
 		return "UNKNOWN"
 	}
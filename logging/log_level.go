@@ -3,6 +3,8 @@ package logging
 import (
 	"fmt"
 	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 type level int
@@ -17,21 +19,168 @@ var (
 )
 
 func levelStringToLevel(str string) level {
+	lvl, err := parseLevel(str)
+	if err != nil {
+		initError(fmt.Sprintf("Invalid log level %v.", str))
+		return levelWarn
+	}
+	return lvl
+}
+
+func parseLevel(str string) (level, error) {
 	switch strings.ToUpper(str) {
 	case "NEVER":
-		return levelNever
+		return levelNever, nil
 	case "DEBUG":
-		return levelDebug
+		return levelDebug, nil
 	case "INFO":
-		return levelInfo
+		return levelInfo, nil
 	case "WARN":
-		return levelWarn
+		return levelWarn, nil
 	case "ERROR":
-		return levelError
+		return levelError, nil
 	case "CRITICAL":
-		return levelCritical
+		return levelCritical, nil
 	default:
-		initError(fmt.Sprintf("Invalid log level %v.", str))
-		return levelWarn
+		return levelNever, fmt.Errorf("invalid log level %v", str)
+	}
+}
+
+// ParseNamedLevels parses levels for logger names in the form "query.planner=DEBUG,grpc=WARN".
+func ParseNamedLevels(spec string) (map[string]string, error) {
+	named := make(map[string]string)
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("expected name=LEVEL, got %q", pair)
+		}
+		if _, err := parseLevel(kv[1]); err != nil {
+			return nil, err
+		}
+		named[kv[0]] = strings.ToUpper(kv[1])
+	}
+	return named, nil
+}
+
+// LevelSetter is implemented by loggers whose level can be changed at runtime. Changes apply to the logger returned by
+// New and to every logger Named from it.
+type LevelSetter interface {
+	// Level returns the level of loggers without a named level.
+	Level() string
+	SetLevel(level string) error
+
+	// NamedLevels returns the levels set for specific logger names.
+	NamedLevels() map[string]string
+	// SetNamedLevel sets the level of the logger with the provided dotted name and of every logger named below it,
+	// overriding Level. The most specific name wins: with query=WARN and query.planner=DEBUG, query.planner.cost logs
+	// at DEBUG and query.executor at WARN.
+	SetNamedLevel(name, level string) error
+	// ClearNamedLevel removes the level set for name, so that it logs at Level again.
+	ClearNamedLevel(name string)
+}
+
+// levels holds the output levels shared by a logger and every logger Named from it.
+type levels struct {
+	// generation is bumped by every change to the levels, so that loggers know when to resolve theirs again
+	generation uint64
+
+	mutex  sync.RWMutex // protects everything below
+	output level
+	named  map[string]level
+}
+
+// resolvedLevel is the level a logger resolved for its name, and the generation of the levels it was resolved at.
+type resolvedLevel struct {
+	generation uint64
+	level      level
+}
+
+func newLevels(output level) *levels {
+	return &levels{
+		output: output,
+		named:  make(map[string]level),
+	}
+}
+
+// cachedForName returns the level for name like forName, but only resolves it if the levels changed since it was
+// last cached in cache.
+func (ls *levels) cachedForName(cache *atomic.Value, name string) level {
+	generation := atomic.LoadUint64(&ls.generation)
+	if resolved, ok := cache.Load().(resolvedLevel); ok && resolved.generation == generation {
+		return resolved.level
 	}
+	lvl := ls.forName(name)
+	cache.Store(resolvedLevel{generation: generation, level: lvl})
+	return lvl
+}
+
+// forName returns the level of the most specific name set for name or one of its dotted prefixes, so a level set for
+// "query" applies to "query.planner" unless "query.planner" has its own.
+func (ls *levels) forName(name string) level {
+	ls.mutex.RLock()
+	defer ls.mutex.RUnlock()
+	if len(ls.named) == 0 {
+		return ls.output
+	}
+	for {
+		if lvl, ok := ls.named[name]; ok {
+			return lvl
+		}
+		idx := strings.LastIndexByte(name, '.')
+		if idx < 0 {
+			return ls.output
+		}
+		name = name[:idx]
+	}
+}
+
+func (ls *levels) Level() string {
+	ls.mutex.RLock()
+	defer ls.mutex.RUnlock()
+	return levelToString(ls.output)
+}
+
+func (ls *levels) SetLevel(str string) error {
+	lvl, err := parseLevel(str)
+	if err != nil {
+		return err
+	}
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	ls.output = lvl
+	atomic.AddUint64(&ls.generation, 1)
+	return nil
+}
+
+func (ls *levels) NamedLevels() map[string]string {
+	ls.mutex.RLock()
+	defer ls.mutex.RUnlock()
+	res := make(map[string]string, len(ls.named))
+	for name, lvl := range ls.named {
+		res[name] = levelToString(lvl)
+	}
+	return res
+}
+
+func (ls *levels) SetNamedLevel(name, str string) error {
+	lvl, err := parseLevel(str)
+	if err != nil {
+		return err
+	}
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	ls.named[name] = lvl
+	atomic.AddUint64(&ls.generation, 1)
+	return nil
+}
+
+func (ls *levels) ClearNamedLevel(name string) {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	delete(ls.named, name)
+	atomic.AddUint64(&ls.generation, 1)
 }
@@ -1,6 +1,7 @@
 package logging
 
 import (
+	"sync/atomic"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -14,3 +15,75 @@ func TestLogLevelToString(t *testing.T) {
 	assert.Equal(t, levelError, levelStringToLevel("ERROR"))
 	assert.Equal(t, levelCritical, levelStringToLevel("CRITICAL"))
 }
+
+func TestLevelsRuntimeChanges(t *testing.T) {
+	logger, buf := testLogger(formatText)
+	named := logger.Named("query")
+	ls := logger.(LevelSetter)
+
+	assert.NoError(t, ls.SetLevel("WARN"))
+	assert.Equal(t, "WARN", ls.Level())
+	named.Info("hidden", nil)
+	assert.False(t, named.IsInfo())
+	assert.Empty(t, buf.String())
+
+	assert.NoError(t, named.(LevelSetter).SetNamedLevel("query", "debug"))
+	assert.Equal(t, map[string]string{"query": "DEBUG"}, ls.NamedLevels())
+	assert.True(t, named.IsDebug())
+	assert.False(t, logger.IsInfo())
+	named.Debug("shown", nil)
+	assert.Contains(t, buf.String(), "shown")
+
+	ls.ClearNamedLevel("query")
+	assert.False(t, named.IsDebug())
+
+	assert.Error(t, ls.SetLevel("LOUD"))
+	assert.Error(t, ls.SetNamedLevel("query", "LOUD"))
+	assert.Equal(t, "WARN", ls.Level())
+}
+
+func TestLevelsHierarchy(t *testing.T) {
+	ls := newLevels(levelInfo)
+	assert.NoError(t, ls.SetNamedLevel("query", "WARN"))
+	assert.NoError(t, ls.SetNamedLevel("query.planner", "DEBUG"))
+
+	assert.Equal(t, levelInfo, ls.forName(""))
+	assert.Equal(t, levelInfo, ls.forName("grpc"))
+	assert.Equal(t, levelInfo, ls.forName("queryx"))
+	assert.Equal(t, levelWarn, ls.forName("query"))
+	assert.Equal(t, levelWarn, ls.forName("query.executor"))
+	assert.Equal(t, levelDebug, ls.forName("query.planner"))
+	assert.Equal(t, levelDebug, ls.forName("query.planner.cost"))
+}
+
+func TestLevelsCachedForName(t *testing.T) {
+	ls := newLevels(levelInfo)
+	var cache atomic.Value
+	assert.Equal(t, levelInfo, ls.cachedForName(&cache, "query.planner"))
+
+	// the cached level is used until the levels change
+	ls.named["query"] = levelDebug
+	assert.Equal(t, levelInfo, ls.cachedForName(&cache, "query.planner"))
+
+	assert.NoError(t, ls.SetNamedLevel("query", "WARN"))
+	assert.Equal(t, levelWarn, ls.cachedForName(&cache, "query.planner"))
+	ls.ClearNamedLevel("query")
+	assert.Equal(t, levelInfo, ls.cachedForName(&cache, "query.planner"))
+	assert.NoError(t, ls.SetLevel("ERROR"))
+	assert.Equal(t, levelError, ls.cachedForName(&cache, "query.planner"))
+}
+
+func TestParseNamedLevels(t *testing.T) {
+	named, err := ParseNamedLevels("query.planner=debug, grpc=WARN")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"query.planner": "DEBUG", "grpc": "WARN"}, named)
+
+	named, err = ParseNamedLevels("")
+	assert.NoError(t, err)
+	assert.Empty(t, named)
+
+	_, err = ParseNamedLevels("query")
+	assert.Error(t, err)
+	_, err = ParseNamedLevels("query=LOUD")
+	assert.Error(t, err)
+}
@@ -3,10 +3,10 @@ package logging
 import (
 	"fmt"
 	"io"
-	"io/ioutil"
-	golog "log"
 	"log/syslog"
 	"os"
+	"sync"
+	"sync/atomic"
 )
 
 // Logger is the interface to logging
@@ -29,70 +29,166 @@ type Logger interface {
 	Named(name string) Logger
 }
 
-type logger struct {
-	name          string
-	syslog        io.Writer
-	syslogLevel   level
-	gologgerLevel level
-	format        format
+// Output is a destination for log lines. A logger can write to several outputs at once, each with its own level and
+// format.
+type Output struct {
+	Writer io.Writer
+	// Format is json or text.
+	Format string
+	// Level is the lowest level written to this output. If it's empty, the output follows the logger's level, which
+	// can be changed at runtime and for specific logger names through LevelSetter.
+	Level string
+	// Prefix is written at the start of every line.
+	Prefix string
+}
 
-	minLevel level
+// StderrOutput returns an Output that writes to stderr and follows the logger's level.
+func StderrOutput(format string) Output {
+	return Output{Writer: os.Stderr, Format: format}
 }
 
-func newLogger(syslogLevel level, filepath string, fileLevel level, format format) *logger {
-	minLevel := syslogLevel
-	if fileLevel < minLevel {
-		minLevel = fileLevel
+// FileOutput returns an Output that appends to the file at path and follows the logger's level.
+func FileOutput(path, format string) (Output, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return Output{}, err
+	}
+	return Output{Writer: file, Format: format}, nil
+}
+
+// SyslogOutput returns an Output that writes json to the local syslog at the provided level.
+func SyslogOutput(level string) (Output, error) {
+	syslogger, err := syslog.New(syslog.LOG_USER|syslog.LOG_NOTICE, "")
+	if err != nil {
+		return Output{}, err
+	}
+	return Output{Writer: syslogger, Format: "json", Level: level, Prefix: "mixpanel "}, nil
+}
+
+// NewWithOutputs creates a logger at level that writes to every one of outputs.
+func NewWithOutputs(level string, outputs ...Output) (Logger, error) {
+	lvl, err := parseLevel(level)
+	if err != nil {
+		return nil, err
+	}
+	l := &logger{levels: newLevels(lvl)}
+	for _, o := range outputs {
+		out, err := newOutput(o)
+		if err != nil {
+			return nil, err
+		}
+		l.outputs = append(l.outputs, out)
+	}
+	return l, nil
+}
+
+type output struct {
+	mutex  sync.Mutex // serializes writes so that lines don't interleave
+	writer io.Writer
+	format format
+	prefix string
+
+	// level is used unless follow is set, in which case the logger's level is used instead
+	level  level
+	follow bool
+}
+
+func newOutput(o Output) (*output, error) {
+	if o.Writer == nil {
+		return nil, fmt.Errorf("log output has no writer")
+	}
+	out := &output{writer: o.Writer, prefix: o.Prefix, follow: o.Level == ""}
+	switch o.Format {
+	case "json":
+		out.format = formatJSON
+	case "text":
+		out.format = formatText
+	default:
+		return nil, fmt.Errorf("unknown log format: %s", o.Format)
+	}
+	if !out.follow {
+		lvl, err := parseLevel(o.Level)
+		if err != nil {
+			return nil, err
+		}
+		out.level = lvl
+	}
+	return out, nil
+}
+
+func (o *output) write(lvl level, name, message string, fields Fields) {
+	var line string
+	switch o.format {
+	case formatJSON:
+		line = jsonFormatter(lvl, name, message, fields)
+	case formatText:
+		line = textFormatter(lvl, name, message, fields)
 	}
 
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	io.WriteString(o.writer, o.prefix+line+"\n")
+}
+
+type logger struct {
+	name    string
+	outputs []*output
+
+	// levels is shared with every logger Named from this one
+	*levels
+	// resolved caches the level resolved for name from levels
+	resolved atomic.Value
+}
+
+func newLogger(syslogLevel level, filepath string, fileLevel level, format format) *logger {
 	log := &logger{
-		name:          "",
-		minLevel:      minLevel,
-		syslogLevel:   syslogLevel,
-		gologgerLevel: fileLevel,
-		format:        format,
+		name:   "",
+		levels: newLevels(fileLevel),
 	}
 
 	if syslogLevel != levelNever {
-		syslogger, err := syslog.New(syslog.LOG_USER|syslog.LOG_NOTICE, "")
-		if err != nil {
+		if o, err := SyslogOutput(levelToString(syslogLevel)); err != nil {
 			initError(fmt.Sprintf("Unable to open syslog: %v.", err))
-			log.syslogLevel = levelNever
 		} else {
-			log.syslog = syslogger
+			log.outputs = append(log.outputs, &output{writer: o.Writer, format: formatJSON, prefix: o.Prefix, level: syslogLevel})
 		}
 	}
 
-	if fileLevel == levelNever {
-		golog.SetOutput(ioutil.Discard)
-	} else if len(filepath) > 0 {
-		file, err := os.OpenFile(filepath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
-		if err != nil {
+	out := &output{writer: os.Stderr, format: format, follow: true}
+	if fileLevel != levelNever && len(filepath) > 0 {
+		if o, err := FileOutput(filepath, ""); err != nil {
 			initError(fmt.Sprintf("Unable to open file for logging: %v.", err))
-			golog.SetOutput(os.Stderr)
 		} else {
-			golog.SetOutput(file)
+			out.writer = o.Writer
 		}
-	} else {
-		golog.SetOutput(os.Stderr)
-	}
-
-	if format == formatJSON {
-		golog.SetFlags(0)
 	}
+	log.outputs = append(log.outputs, out)
 
 	return log
 }
 
 func (l *logger) Named(name string) Logger {
 	return &logger{
-		name:          name,
-		syslog:        l.syslog,
-		syslogLevel:   l.syslogLevel,
-		gologgerLevel: l.gologgerLevel,
-		minLevel:      l.minLevel,
-		format:        l.format,
+		name:    name,
+		outputs: l.outputs,
+		levels:  l.levels,
+	}
+}
+
+// minLevel is the lowest level that this logger writes to any output.
+func (l *logger) minLevel() level {
+	named := l.levels.cachedForName(&l.resolved, l.name)
+	min := levelNever
+	for _, o := range l.outputs {
+		lvl := o.level
+		if o.follow {
+			lvl = named
+		}
+		if lvl < min {
+			min = lvl
+		}
 	}
+	return min
 }
 
 func (l *logger) Debug(message string, fields Fields) {
@@ -116,40 +212,34 @@ func (l *logger) Critical(message string, fields Fields) {
 }
 
 func (l *logger) IsDebug() bool {
-	return l.minLevel <= levelDebug
+	return l.minLevel() <= levelDebug
 }
 
 func (l *logger) IsInfo() bool {
-	return l.minLevel <= levelInfo
+	return l.minLevel() <= levelInfo
 }
 
 func (l *logger) IsWarn() bool {
-	return l.minLevel <= levelWarn
+	return l.minLevel() <= levelWarn
 }
 
 func (l *logger) IsError() bool {
-	return l.minLevel <= levelError
+	return l.minLevel() <= levelError
 }
 
 func (l *logger) IsCritical() bool {
-	return l.minLevel <= levelCritical
+	return l.minLevel() <= levelCritical
 }
 
 func (l *logger) logAtLevel(lvl level, message string, fields Fields) {
-	if l.minLevel > lvl {
-		return
-	}
-
-	if l.gologgerLevel <= lvl {
-		switch l.format {
-		case formatJSON:
-			golog.Println(jsonFormatter(lvl, l.name, message, fields))
-		case formatText:
-			golog.Println(textFormatter(lvl, l.name, message, fields))
+	named := l.levels.cachedForName(&l.resolved, l.name)
+	for _, o := range l.outputs {
+		threshold := o.level
+		if o.follow {
+			threshold = named
+		}
+		if threshold <= lvl {
+			o.write(lvl, l.name, message, fields)
 		}
-	}
-
-	if l.syslogLevel <= lvl {
-		io.WriteString(l.syslog, "mixpanel "+jsonFormatter(lvl, l.name, message, fields))
 	}
 }
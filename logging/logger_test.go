@@ -3,8 +3,9 @@ package logging
 import (
 	"bytes"
 	"encoding/json"
-	"log"
+	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -24,10 +25,9 @@ func TestLoggerNamed(t *testing.T) {
 }
 
 func TestSyslog(t *testing.T) {
-	logger := newLogger(levelDebug, "", levelNever, formatText)
+	logger := newLogger(levelNever, "", levelNever, formatText)
 	buf := &bytes.Buffer{}
-	logger.syslog = buf
-	logger.syslogLevel = levelInfo
+	logger.outputs = append(logger.outputs, &output{writer: buf, format: formatJSON, prefix: "mixpanel ", level: levelInfo})
 
 	logger.Info("test", Fields{"key": "value"})
 	if assert.Equal(t, "mixpanel ", buf.String()[:9]) {
@@ -44,6 +44,58 @@ func TestSyslog(t *testing.T) {
 	}
 }
 
+func TestMultipleOutputs(t *testing.T) {
+	text, json, errors := &bytes.Buffer{}, &bytes.Buffer{}, &bytes.Buffer{}
+	logger, err := NewWithOutputs("INFO",
+		Output{Writer: text, Format: "text"},
+		Output{Writer: json, Format: "json"},
+		Output{Writer: errors, Format: "text", Level: "ERROR"},
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	logger.Debug("debug", nil)
+	logger.Info("info", nil)
+	logger.Error("error", nil)
+	assert.Equal(t, 2, strings.Count(text.String(), "\n"))
+	assert.Equal(t, 2, strings.Count(json.String(), "\n"))
+	assert.Equal(t, 1, strings.Count(errors.String(), "\n"))
+	assert.Contains(t, errors.String(), "[ERROR]")
+
+	// outputs without a level follow the logger's level, the others keep theirs
+	assert.NoError(t, logger.(LevelSetter).SetLevel("DEBUG"))
+	logger.Named("sub").Debug("debug", nil)
+	assert.Contains(t, text.String(), "[DEBUG] sub: debug")
+	assert.NotContains(t, errors.String(), "DEBUG")
+	assert.True(t, logger.IsDebug())
+
+	_, err = NewWithOutputs("LOUD", Output{Writer: text, Format: "text"})
+	assert.Error(t, err)
+	_, err = NewWithOutputs("INFO", Output{Writer: text, Format: "xml"})
+	assert.Error(t, err)
+	_, err = NewWithOutputs("INFO", Output{Writer: text, Format: "text", Level: "LOUD"})
+	assert.Error(t, err)
+	_, err = NewWithOutputs("INFO", Output{Format: "text"})
+	assert.Error(t, err)
+}
+
+func TestFileOutput(t *testing.T) {
+	file, err := ioutil.TempFile("", "obs-log")
+	if !assert.NoError(t, err) {
+		return
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+
+	logger := New("NEVER", "INFO", file.Name(), "text")
+	logger.Info("to the file", nil)
+
+	contents, err := ioutil.ReadFile(file.Name())
+	assert.NoError(t, err)
+	assert.Contains(t, string(contents), "to the file")
+}
+
 func TestLoggerJSON(t *testing.T) {
 	logger, buf := testLogger(formatJSON)
 	logger.Info("test", Fields{"key": "value"})
@@ -58,10 +110,6 @@ func TestLoggerJSON(t *testing.T) {
 func testLogger(format format) (Logger, *bytes.Buffer) {
 	buf := &bytes.Buffer{}
 	logger := newLogger(levelNever, "", levelDebug, format)
-	log.SetOutput(buf)
+	logger.outputs[0].writer = buf
 	return logger, buf
 }
-
-func resetLogOutput() {
-	log.SetOutput(os.Stderr)
-}
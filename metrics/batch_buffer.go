@@ -0,0 +1,99 @@
+package metrics
+
+import (
+	"bytes"
+)
+
+// batchBuffer holds the lines of points that a sink sends in batches. Lines go to one of several queues, which are
+// sent separately but share a limit of maxSize bytes. Lines added while the buffer is full are dropped, and so are
+// the lines of a batch that failed to send if they no longer fit when it's requeued. Callers must serialize access.
+type batchBuffer struct {
+	maxSize int
+	queues  []*bytes.Buffer
+	// dropped counts the lines dropped, for the sink to report through itself.
+	dropped int64
+}
+
+func newBatchBuffer(maxSize, queues int) batchBuffer {
+	b := batchBuffer{maxSize: maxSize}
+	b.queues = b.newQueues(queues)
+	return b
+}
+
+func (b *batchBuffer) newQueues(n int) []*bytes.Buffer {
+	queues := make([]*bytes.Buffer, n)
+	for i := range queues {
+		queues[i] = &bytes.Buffer{}
+	}
+	return queues
+}
+
+// size returns the number of bytes buffered in every queue.
+func (b *batchBuffer) size() int {
+	size := 0
+	for _, queue := range b.queues {
+		size += queue.Len()
+	}
+	return size
+}
+
+// add moves the lines in data to the end of the queue, or drops them if they don't fit. data is left empty either way.
+func (b *batchBuffer) add(queue int, data *bytes.Buffer) {
+	if b.size()+data.Len() > b.maxSize {
+		b.drop(data)
+		return
+	}
+	_, _ = data.WriteTo(b.queues[queue])
+}
+
+// take empties the buffer and returns the batch it held, a buffer per queue.
+func (b *batchBuffer) take() []*bytes.Buffer {
+	batch := b.queues
+	b.queues = b.newQueues(len(batch))
+	return batch
+}
+
+// requeue puts the unsent lines of a batch back ahead of those added since it was taken, or drops them if they no
+// longer fit.
+func (b *batchBuffer) requeue(batch []*bytes.Buffer) {
+	size := b.size()
+	for _, queue := range batch {
+		size += queue.Len()
+	}
+	if size > b.maxSize {
+		for _, queue := range batch {
+			b.drop(queue)
+		}
+		return
+	}
+	for i, queue := range batch {
+		_, _ = b.queues[i].WriteTo(queue)
+		b.queues[i] = queue
+	}
+}
+
+// drop counts the lines in data as dropped and discards them, for lines that mustn't be requeued.
+func (b *batchBuffer) drop(data *bytes.Buffer) {
+	b.dropped += countLines(data.Bytes())
+	data.Reset()
+}
+
+func countLines(data []byte) int64 {
+	return int64(bytes.Count(data, []byte("\n")))
+}
+
+// internalCounter is a counter a sink reports through itself, as its change since it was last reported.
+type internalCounter struct {
+	metric          string
+	value, reported *int64
+}
+
+// reportInternalCounters calls write with each counter that changed since it was last reported, and its change.
+func reportInternalCounters(write func(metric string, change float64), counters ...internalCounter) {
+	for _, counter := range counters {
+		if *counter.value > *counter.reported {
+			write(counter.metric, float64(*counter.value-*counter.reported))
+			*counter.reported = *counter.value
+		}
+	}
+}
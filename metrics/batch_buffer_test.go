@@ -0,0 +1,47 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBatchBuffer(t *testing.T) {
+	b := newBatchBuffer(16, 2)
+	b.add(0, bytes.NewBufferString("a 1\n"))
+	b.add(1, bytes.NewBufferString("b 1\n"))
+	batch := b.take()
+	assert.Equal(t, 0, b.size())
+
+	// unsent lines go back ahead of newer ones
+	b.add(0, bytes.NewBufferString("a 2\n"))
+	b.requeue(batch)
+	assert.Equal(t, "a 1\na 2\n", b.queues[0].String())
+	assert.Equal(t, "b 1\n", b.queues[1].String())
+	assert.Equal(t, int64(0), b.dropped)
+
+	// lines that don't fit are dropped and counted
+	b.add(1, bytes.NewBufferString("b 2\nb 3\n"))
+	assert.Equal(t, int64(2), b.dropped)
+	batch = b.take()
+	b.add(0, bytes.NewBufferString("a 3\na 4\na 5\n"))
+	b.requeue(batch)
+	assert.Equal(t, "a 3\na 4\na 5\n", b.queues[0].String())
+	assert.Equal(t, int64(5), b.dropped)
+}
+
+func TestReportInternalCounters(t *testing.T) {
+	var value, reported int64 = 3, 1
+	var unchanged, reportedUnchanged int64 = 2, 2
+	changes := map[string]float64{}
+	write := func(metric string, change float64) {
+		changes[metric] = change
+	}
+	reportInternalCounters(write,
+		internalCounter{"changed", &value, &reported},
+		internalCounter{"unchanged", &unchanged, &reportedUnchanged},
+	)
+	assert.Equal(t, map[string]float64{"changed": 2}, changes)
+	assert.Equal(t, int64(3), reported)
+}
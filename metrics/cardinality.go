@@ -0,0 +1,85 @@
+package metrics
+
+import (
+	"log"
+	"sync"
+)
+
+const (
+	// DefaultTagCardinalityLimit is a reasonable number of distinct values for a tag key to take under a prefix, for
+	// WithTagCardinalityLimit.
+	DefaultTagCardinalityLimit = 1000
+	// OtherTagValue replaces the values of a tag key once it has taken too many distinct values.
+	OtherTagValue = "__other__"
+)
+
+// cardinalityGuard limits the number of distinct values each tag key takes under each prefix, since every
+// combination of tags is a scope that's cached forever and a series that sinks keep track of.
+type cardinalityGuard struct {
+	sink  Sink
+	limit int
+
+	mutex  sync.Mutex // protects values and logged
+	values map[string]map[string]struct{}
+	logged map[string]bool
+}
+
+func newCardinalityGuard(sink Sink, limit int) *cardinalityGuard {
+	return &cardinalityGuard{
+		sink:   sink,
+		limit:  limit,
+		values: make(map[string]map[string]struct{}),
+		logged: make(map[string]bool),
+	}
+}
+
+// check records the values of tags under prefix. If any of them is past its key's limit, it returns a copy of tags
+// with those values replaced by OtherTagValue, and counts them in obs.cardinality_exceeded. Otherwise it returns nil.
+func (g *cardinalityGuard) check(prefix string, tags Tags) Tags {
+	guarded, exceeded := g.record(prefix, tags)
+	// the sink may block, so it's only called once the mutex is released
+	for _, k := range exceeded {
+		if err := g.sink.Handle("obs.cardinality_exceeded", Tags{"prefix": prefix, "tag": k}, 1, metricTypeCounter); err != nil {
+			log.Printf("error while handling metric type: %s. Error: %v", metricTypeCounter, err)
+		}
+	}
+	return guarded
+}
+
+// record does the bookkeeping of check, returning the guarded tags and the keys whose values are past the limit.
+func (g *cardinalityGuard) record(prefix string, tags Tags) (guarded Tags, exceeded []string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	for k, v := range tags {
+		key := prefix + "|" + k
+		values, ok := g.values[key]
+		if !ok {
+			values = make(map[string]struct{})
+			g.values[key] = values
+		}
+		if _, ok := values[v]; ok || v == OtherTagValue {
+			continue
+		}
+		if len(values) < g.limit {
+			values[v] = struct{}{}
+			continue
+		}
+
+		if guarded == nil {
+			guarded = make(Tags, len(tags))
+			for k, v := range tags {
+				guarded[k] = v
+			}
+		}
+		guarded[k] = OtherTagValue
+		exceeded = append(exceeded, k)
+
+		if !g.logged[key] {
+			g.logged[key] = true
+			log.Printf("tag %s of metrics prefixed %q has more than %d distinct values, reporting new values as %s",
+				k, prefix, g.limit, OtherTagValue)
+		}
+	}
+	return guarded, exceeded
+}
@@ -0,0 +1,81 @@
+package metrics
+
+import (
+	"time"
+)
+
+// Event is a DogStatsD event, reported with Receiver.Event. Sinks that don't support events count them instead, in
+// a counter named "events" tagged with the alert type.
+type Event struct {
+	Title string
+	Text  string
+	// AlertType is one of info, warning, error or success. Empty means info.
+	AlertType string
+	// Priority is one of normal or low. Empty means normal.
+	Priority string
+	// AggregationKey groups related events together.
+	AggregationKey string
+	// SourceType is the source of the event, for example the name of an integration.
+	SourceType string
+	// Timestamp is when the event happened. Zero means when it's received.
+	Timestamp time.Time
+}
+
+// ServiceCheckStatus is the status of a service check reported with Receiver.ServiceCheck. Sinks that don't support
+// service checks report it as a gauge named after the check instead.
+type ServiceCheckStatus int
+
+const (
+	ServiceCheckOK       = ServiceCheckStatus(0)
+	ServiceCheckWarning  = ServiceCheckStatus(1)
+	ServiceCheckCritical = ServiceCheckStatus(2)
+	ServiceCheckUnknown  = ServiceCheckStatus(3)
+)
+
+// The following are implemented by Sinks that support the matching DogStatsD extension natively. Receivers fall
+// back to Handle for Sinks that don't.
+
+type sampledSink interface {
+	// HandleSampled is like Handle, for a value that was only reported with probability sampleRate.
+	HandleSampled(metric string, tags Tags, value float64, metricType metricType, sampleRate float64) error
+}
+
+type setSink interface {
+	// HandleSet adds value to the set called metric, so that its number of distinct values can be counted.
+	HandleSet(metric string, tags Tags, value string) error
+}
+
+type eventSink interface {
+	HandleEvent(event Event, tags Tags) error
+}
+
+type serviceCheckSink interface {
+	HandleServiceCheck(name string, tags Tags, status ServiceCheckStatus, message string) error
+}
+
+// handleEvent reports event to sink, or if sink doesn't support events, counts it in a counter called name tagged
+// with the alert type.
+func handleEvent(sink Sink, name string, event Event, tags Tags) error {
+	if events, ok := sink.(eventSink); ok {
+		return events.HandleEvent(event, tags)
+	}
+	alertType := event.AlertType
+	if alertType == "" {
+		alertType = "info"
+	}
+	eventTags := make(Tags, len(tags)+1)
+	for k, v := range tags {
+		eventTags[k] = v
+	}
+	eventTags["alert_type"] = alertType
+	return sink.Handle(name, eventTags, 1, metricTypeCounter)
+}
+
+// handleServiceCheck reports a service check to sink, or if sink doesn't support service checks, sets a gauge
+// called name to its status.
+func handleServiceCheck(sink Sink, name string, tags Tags, status ServiceCheckStatus, message string) error {
+	if checks, ok := sink.(serviceCheckSink); ok {
+		return checks.HandleServiceCheck(name, tags, status, message)
+	}
+	return sink.Handle(name, tags, float64(status), metricTypeGauge)
+}
@@ -0,0 +1,331 @@
+package metrics
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mixpanel/obs/util"
+)
+
+const (
+	defaultInfluxFlushInterval = 5 * time.Second
+	defaultInfluxMaxBufferSize = 8 << 20
+	influxTimeout              = 10 * time.Second
+)
+
+// InfluxOption configures NewInfluxSink.
+type InfluxOption func(*influxSink)
+
+// WithInfluxFlushInterval sets how often points are sent to influx in the background, 5 seconds by default. Zero
+// disables background flushing, leaving it to callers of Flush.
+func WithInfluxFlushInterval(interval time.Duration) InfluxOption {
+	return func(sink *influxSink) {
+		sink.flushInterval = interval
+	}
+}
+
+// WithInfluxMaxBufferSize sets how many bytes of points are buffered until they're sent, 8MiB by default. Points
+// reported while the buffer is full are dropped.
+func WithInfluxMaxBufferSize(size int) InfluxOption {
+	return func(sink *influxSink) {
+		sink.batch.maxSize = size
+	}
+}
+
+// WithInfluxHeaders sets headers sent with every HTTP write, for example Authorization for an influx token.
+func WithInfluxHeaders(headers map[string]string) InfluxOption {
+	return func(sink *influxSink) {
+		sink.headers = headers
+	}
+}
+
+// influxWriter writes a batch of lines to influx.
+type influxWriter interface {
+	// write returns an influxRejectedError if influx rejected the batch, so that sending it again is pointless.
+	write(data []byte) error
+	close()
+}
+
+type influxSink struct {
+	writer        influxWriter
+	headers       map[string]string
+	flushInterval time.Duration
+	mutex         sync.Mutex // protects batch, closed and the counters
+	batch         batchBuffer
+	closed        bool
+
+	// failedFlushes is reported through the sink itself as obs.influx.failed_flushes on every flush, along with the
+	// points dropped by the batch buffer as obs.influx.dropped_points.
+	failedFlushes                     int64
+	reportedFailures, reportedDropped int64
+
+	sendMutex sync.Mutex // serializes flushes
+	done      chan struct{}
+	wg        sync.WaitGroup
+}
+
+var (
+	// influxMeasurementEscaper escapes measurements, which can't contain unescaped commas or spaces. Backslashes are
+	// escaped too, so that one at the end of a measurement doesn't escape the separator after it.
+	influxMeasurementEscaper = strings.NewReplacer("\\", "\\\\", ",", "\\,", " ", "\\ ", "\n", "\\n")
+	// influxKeyEscaper escapes tag keys, tag values and field keys, which can't contain unescaped commas, equals
+	// signs or spaces either, and backslashes for the same reason.
+	influxKeyEscaper = strings.NewReplacer("\\", "\\\\", ",", "\\,", "=", "\\=", " ", "\\ ", "\n", "\\n")
+)
+
+// influxField returns the name of the field a metric's value is written to, so that values of different types
+// never share a field.
+func influxField(metricType metricType) string {
+	switch metricType {
+	case metricTypeCounter:
+		return "count"
+	case metricTypeGauge:
+		return "gauge"
+	default:
+		return "value"
+	}
+}
+
+func (sink *influxSink) Handle(metric string, tags Tags, value float64, metricType metricType) error {
+	if len(metric) == 0 {
+		return errors.New("cannot handle empty metric")
+	}
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		// influx can't parse these, and would reject the whole batch
+		return fmt.Errorf("cannot write %g to influx for %s", value, metric)
+	}
+
+	buf := util.SharedBufferPool.Get()
+	defer util.SharedBufferPool.Put(buf)
+	writeInfluxLine(buf, metric, tags, influxField(metricType), value, time.Now())
+
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+
+	if sink.closed {
+		return errors.New("sink is closed")
+	}
+	sink.batch.add(0, buf)
+	return nil
+}
+
+// influxRejectedError is returned by an influxWriter when influx rejects a batch, for example because of a line it
+// can't parse. The batch is dropped instead of being sent again.
+type influxRejectedError struct {
+	error
+}
+
+func writeInfluxLine(buf *bytes.Buffer, metric string, tags Tags, field string, value float64, timestamp time.Time) {
+	// influx line protocol: <measurement>[,<tag1>=<value1>,...] <field>=<value> <timestampInEpochNanoseconds>
+	_, _ = buf.WriteString(influxMeasurementEscaper.Replace(metric))
+
+	// influx recommends sorting tags by key, and doesn't allow empty tag values
+	keys := make([]string, 0, len(tags))
+	for k, v := range tags {
+		if len(k) > 0 && len(v) > 0 {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		_, _ = buf.WriteString(",")
+		_, _ = buf.WriteString(influxKeyEscaper.Replace(k))
+		_, _ = buf.WriteString("=")
+		_, _ = buf.WriteString(influxKeyEscaper.Replace(tags[k]))
+	}
+
+	_, _ = buf.WriteString(" ")
+	_, _ = buf.WriteString(field)
+	_, _ = buf.WriteString("=")
+	_, _ = buf.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	_, _ = buf.WriteString(" ")
+	_, _ = buf.WriteString(strconv.FormatInt(timestamp.UnixNano(), 10))
+	_, _ = buf.WriteString("\n")
+}
+
+// writeInternalMetrics writes the changes to the internal counters since they were last reported.
+func (sink *influxSink) writeInternalMetrics() {
+	now := time.Now()
+	reportInternalCounters(func(metric string, change float64) {
+		writeInfluxLine(sink.batch.queues[0], metric, nil, "count", change, now)
+	},
+		internalCounter{"obs.influx.failed_flushes", &sink.failedFlushes, &sink.reportedFailures},
+		internalCounter{"obs.influx.dropped_points", &sink.batch.dropped, &sink.reportedDropped},
+	)
+}
+
+// Flush sends every buffered point to influx. If influx can't be reached, the points are kept to be sent by the next
+// flush, unless the buffer has filled up in the meantime. If influx rejects them, they're dropped.
+func (sink *influxSink) Flush() error {
+	sink.sendMutex.Lock()
+	defer sink.sendMutex.Unlock()
+
+	sink.mutex.Lock()
+	sink.writeInternalMetrics()
+	batch := sink.batch.take()
+	sink.mutex.Unlock()
+
+	if batch[0].Len() == 0 {
+		return nil
+	}
+
+	err := sink.writer.write(batch[0].Bytes())
+	if err == nil {
+		return nil
+	}
+	log.Print(err)
+
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	sink.failedFlushes++
+	if _, ok := err.(influxRejectedError); ok {
+		sink.batch.drop(batch[0])
+		return err
+	}
+	sink.batch.requeue(batch)
+	return err
+}
+
+func (sink *influxSink) flusher() {
+	defer sink.wg.Done()
+
+	ticker := time.NewTicker(sink.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-sink.done:
+			return
+		case <-ticker.C:
+			sink.Flush()
+		}
+	}
+}
+
+func (sink *influxSink) Close() {
+	sink.mutex.Lock()
+	if sink.closed {
+		sink.mutex.Unlock()
+		return
+	}
+	sink.closed = true
+	sink.mutex.Unlock()
+
+	close(sink.done)
+	sink.wg.Wait()
+	sink.Flush()
+	sink.writer.close()
+}
+
+// influxUDPWriter writes batches over UDP, packing whole lines into packets of up to maxPayloadSize bytes.
+type influxUDPWriter struct {
+	conn           net.Conn
+	maxPayloadSize int
+}
+
+func (w *influxUDPWriter) write(data []byte) error {
+	for len(data) > 0 {
+		end := len(data)
+		if end > w.maxPayloadSize {
+			// split after the last newline that fits, or after the first line if even that doesn't fit
+			if end = bytes.LastIndexByte(data[:w.maxPayloadSize], '\n') + 1; end == 0 {
+				end = bytes.IndexByte(data, '\n') + 1
+			}
+		}
+		if _, err := w.conn.Write(data[:end]); err != nil {
+			return fmt.Errorf("error while writing to influx: %v", err)
+		}
+		data = data[end:]
+	}
+	return nil
+}
+
+func (w *influxUDPWriter) close() {
+	if err := w.conn.Close(); err != nil {
+		log.Printf("error while closing connection to influx: %v", err)
+	}
+}
+
+// influxHTTPWriter writes batches to the influx HTTP write API.
+type influxHTTPWriter struct {
+	client  *http.Client
+	url     string
+	headers map[string]string
+}
+
+func (w *influxHTTPWriter) write(data []byte) error {
+	req, err := http.NewRequest("POST", w.url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	for k, v := range w.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error while writing to influx: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	if resp.StatusCode/100 != 2 {
+		err := fmt.Errorf("error while writing to influx: %s: %s", resp.Status, bytes.TrimSpace(body))
+		// client errors won't go away by retrying, except for rate limiting
+		if resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusTooManyRequests {
+			return influxRejectedError{err}
+		}
+		return err
+	}
+	return nil
+}
+
+func (w *influxHTTPWriter) close() {}
+
+// NewInfluxSink returns a sink that writes InfluxDB line protocol, with the metric as the measurement, its tags as
+// tags, and its value in a count, gauge or value field depending on its type. addr is either udp://host:port, or the
+// URL of the HTTP write API such as http://host:8086/write?db=metrics. Points are buffered and sent in the background
+// like NewWavefrontSink's.
+func NewInfluxSink(addr string, opts ...InfluxOption) (Sink, error) {
+	sink := &influxSink{
+		flushInterval: defaultInfluxFlushInterval,
+		batch:         newBatchBuffer(defaultInfluxMaxBufferSize, 1),
+		done:          make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(sink)
+	}
+
+	switch {
+	case strings.HasPrefix(addr, "udp://"):
+		conn, err := net.Dial("udp", strings.TrimPrefix(addr, "udp://"))
+		if err != nil {
+			return nil, fmt.Errorf("error while connecting to influx at %s: %v", addr, err)
+		}
+		sink.writer = &influxUDPWriter{conn: conn, maxPayloadSize: DefaultMaxPayloadSize}
+	case strings.HasPrefix(addr, "http://"), strings.HasPrefix(addr, "https://"):
+		sink.writer = &influxHTTPWriter{
+			client:  &http.Client{Timeout: influxTimeout},
+			url:     addr,
+			headers: sink.headers,
+		}
+	default:
+		return nil, fmt.Errorf("influx address must be a udp://, http:// or https:// URL: %q", addr)
+	}
+
+	if sink.flushInterval > 0 {
+		sink.wg.Add(1)
+		go sink.flusher()
+	}
+	return sink, nil
+}
@@ -0,0 +1,157 @@
+package metrics
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteInfluxLine(t *testing.T) {
+	buf := &bytes.Buffer{}
+	tags := Tags{"b": "x y", "a": "1,2=3", "empty": ""}
+	writeInfluxLine(buf, "test metric,1", tags, "count", 1.5, time.Unix(1500000000, 5))
+	assert.Equal(t, "test\\ metric\\,1,a=1\\,2\\=3,b=x\\ y count=1.5 1500000000000000005\n", buf.String())
+
+	// a trailing backslash doesn't escape the separator after it
+	buf.Reset()
+	writeInfluxLine(buf, "test\\", Tags{"a\\": "b\\"}, "count", 1, time.Unix(0, 0))
+	assert.Equal(t, "test\\\\,a\\\\=b\\\\ count=1 0\n", buf.String())
+}
+
+func TestInfluxSinkUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	sink, err := NewInfluxSink("udp://"+conn.LocalAddr().String(), WithInfluxFlushInterval(0))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer sink.Close()
+	// every line is longer than 32 bytes, so they're sent a line at a time
+	sink.(*influxSink).writer.(*influxUDPWriter).maxPayloadSize = 32
+
+	sink.Handle("test.counter", Tags{"a": "b"}, 2, metricTypeCounter)
+	sink.Handle("test.gauge", nil, 3, metricTypeGauge)
+	sink.Handle("test.stat", nil, 4, metricTypeStat)
+	assert.NoError(t, sink.Flush())
+
+	packets := readPackets(conn)
+	if assert.Len(t, packets, 3) {
+		assert.True(t, strings.HasPrefix(packets[0], "test.counter,a=b count=2 "))
+		assert.True(t, strings.HasPrefix(packets[1], "test.gauge gauge=3 "))
+		assert.True(t, strings.HasPrefix(packets[2], "test.stat value=4 "))
+	}
+}
+
+func TestInfluxSinkHTTP(t *testing.T) {
+	var mutex sync.Mutex
+	var received []string
+	fail := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		assert.Equal(t, "/write", r.URL.Path)
+		assert.Equal(t, "metrics", r.URL.Query().Get("db"))
+		assert.Equal(t, "Token secret", r.Header.Get("Authorization"))
+		if fail {
+			fail = false
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		received = append(received, strings.Split(strings.TrimSpace(string(body)), "\n")...)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	sink, err := NewInfluxSink(server.URL+"/write?db=metrics",
+		WithInfluxFlushInterval(0), WithInfluxHeaders(map[string]string{"Authorization": "Token secret"}))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer sink.Close()
+
+	sink.Handle("test.counter", nil, 1, metricTypeCounter)
+	assert.Error(t, sink.Flush())
+	// the point that failed is sent by the next flush
+	sink.Handle("test.counter", nil, 2, metricTypeCounter)
+	assert.NoError(t, sink.Flush())
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if assert.Len(t, received, 3) {
+		assert.True(t, strings.HasPrefix(received[0], "test.counter count=1 "))
+		assert.True(t, strings.HasPrefix(received[1], "test.counter count=2 "))
+		assert.True(t, strings.HasPrefix(received[2], "obs.influx.failed_flushes count=1 "))
+	}
+}
+
+func TestInfluxSinkHTTPRejected(t *testing.T) {
+	var mutex sync.Mutex
+	var received []string
+	reject := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if reject {
+			reject = false
+			http.Error(w, "unable to parse", http.StatusBadRequest)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		received = append(received, strings.Split(strings.TrimSpace(string(body)), "\n")...)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	sink, err := NewInfluxSink(server.URL+"/write?db=metrics", WithInfluxFlushInterval(0))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer sink.Close()
+
+	assert.Error(t, sink.Handle("test.gauge", nil, math.NaN(), metricTypeGauge))
+	assert.Error(t, sink.Handle("test.gauge", nil, math.Inf(-1), metricTypeGauge))
+	sink.Handle("test.counter", nil, 1, metricTypeCounter)
+	sink.Handle("test.counter", nil, 2, metricTypeCounter)
+	assert.Error(t, sink.Flush())
+	// the rejected batch is dropped rather than sent again
+	sink.Handle("test.counter", nil, 3, metricTypeCounter)
+	assert.NoError(t, sink.Flush())
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if assert.Len(t, received, 3) {
+		assert.True(t, strings.HasPrefix(received[0], "test.counter count=3 "))
+		assert.True(t, strings.HasPrefix(received[1], "obs.influx.failed_flushes count=1 "))
+		assert.True(t, strings.HasPrefix(received[2], "obs.influx.dropped_points count=2 "))
+	}
+}
+
+func TestInfluxSinkBufferLimit(t *testing.T) {
+	sink, err := NewInfluxSink("http://127.0.0.1:1/write", WithInfluxFlushInterval(0), WithInfluxMaxBufferSize(100))
+	if !assert.NoError(t, err) {
+		return
+	}
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, sink.Handle("test.counter", nil, 1, metricTypeCounter))
+	}
+	assert.Equal(t, int64(3), sink.(*influxSink).batch.dropped)
+}
+
+func TestNewInfluxSinkInvalidAddress(t *testing.T) {
+	_, err := NewInfluxSink("influx:8086")
+	assert.Error(t, err)
+}
@@ -3,7 +3,6 @@ package metrics
 import (
 	"errors"
 	"fmt"
-	"log"
 	"strings"
 	"sync"
 	"time"
@@ -11,11 +10,6 @@ import (
 	_metrics "github.com/mixpanel/obs/go-metrics"
 )
 
-type metricKey struct {
-	metricType metricType
-	name       string
-}
-
 // PerMetricCumulativeHistogramBounds is used to specify for which metrics cumulative histogram
 // counters should be reported, and what bucket boundaries to use. For example, if it contains an entry
 // {"foo", {1, 10, 100}}, for any metricTypeStat metric named *foo, four additional counters will be
@@ -27,20 +21,51 @@ type PerMetricCumulativeHistogramBounds []struct {
 	Bounds []int64
 }
 
+// LocalOption configures NewLocalSink.
+type LocalOption func(*localSink)
+
+// WithSeriesTTL unregisters series that haven't been updated for ttl, so that tags whose values churn don't grow the
+// sink without bound. Series are checked on every flush, and a series that's updated again after being evicted
+// starts afresh, so counters restart from zero. Evictions are counted as obs.local.evicted_series. By default series
+// are never evicted.
+func WithSeriesTTL(ttl time.Duration) LocalOption {
+	return func(sink *localSink) {
+		sink.seriesTTL = ttl
+	}
+}
+
+// seriesTouch records when a series was last updated, as the generation and the time that generation started.
+type seriesTouch struct {
+	gen int64
+	at  time.Time
+}
+
 type localSink struct {
-	counters _metrics.Registry
-	gauges   _metrics.Registry
-	stats    _metrics.Registry
+	counters _metrics.LabeledRegistry
+	gauges   _metrics.LabeledRegistry
+	stats    _metrics.LabeledRegistry
 	dst      Sink
 
 	// See the documentation for NewLocalSink for how perMetricCumulativeHistogramBounds is used.
 	perMetricCumulativeHistogramBounds PerMetricCumulativeHistogramBounds
+	// inclusiveBounds makes the .less_than.<bound> counters also count observations equal to their bound, like the
+	// buckets of Prometheus histograms.
+	inclusiveBounds bool
 
 	flushThreshold int64
+	seriesTTL      time.Duration
 
-	registerLock sync.Mutex
+	registerLock sync.Mutex // protects the registries and everything below
 	currentGen   int64
-	touched      map[metricKey]int64
+	genStart     time.Time
+	touched      map[*_metrics.LabeledSeries]seriesTouch
+	// statSums holds the running sum of every stat, since histogram samples only keep a time window.
+	statSums map[*_metrics.LabeledSeries]float64
+	// sets holds the distinct values of every set since the last flush, by the series of the gauge it's reported as.
+	sets map[*_metrics.LabeledSeries]map[string]struct{}
+	// evicted counts the series evicted after seriesTTL. It's reported to dst as obs.local.evicted_series on every
+	// flush.
+	evicted, reportedEvicted int64
 
 	flushLock sync.Mutex
 }
@@ -53,41 +78,71 @@ func (sink *localSink) Handle(metric string, tags Tags, value float64, metricTyp
 	sink.registerLock.Lock()
 	defer sink.registerLock.Unlock()
 
-	return sink.handleLocked(metric, tags, value, metricType)
+	_, err := sink.handleLocked(_metrics.NewSeriesID(metric, tags), metric, tags, value, metricType)
+	return err
 }
 
-func (sink *localSink) handleLocked(metric string, tags Tags, value float64, metricType metricType) error {
-	formatted := metric + "|" + FormatTags(tags)
+// HandleSet reports the number of distinct values added to a set since the last flush as a gauge.
+func (sink *localSink) HandleSet(metric string, tags Tags, value string) error {
+	if len(metric) == 0 {
+		return errors.New("cannot handle empty metric")
+	}
+
+	sink.registerLock.Lock()
+	defer sink.registerLock.Unlock()
 
-	key := metricKey{metricType: metricType, name: formatted}
+	id := _metrics.NewSeriesID(metric, tags)
+	var set map[string]struct{}
+	if series := sink.gauges.Get(id, metric, tags); series != nil {
+		set = sink.sets[series]
+	}
+	if set == nil {
+		set = make(map[string]struct{})
+	}
+	set[value] = struct{}{}
+	series, err := sink.handleLocked(id, metric, tags, float64(len(set)), metricTypeGauge)
+	if err != nil {
+		return err
+	}
+	sink.sets[series] = set
+	return nil
+}
 
-	sink.touched[key] = sink.currentGen
+// handleLocked updates the series of a metric, whose ID the caller computes, registering it if it's new, and returns
+// it.
+func (sink *localSink) handleLocked(id _metrics.SeriesID, metric string, tags Tags, value float64, metricType metricType) (*_metrics.LabeledSeries, error) {
+	if metricType == metricTypeDistribution {
+		// distributions can't be merged across hosts locally, so they're aggregated like any other stat
+		metricType = metricTypeStat
+	}
 
+	var series *_metrics.LabeledSeries
 	switch metricType {
 	case metricTypeCounter:
-		counter := sink.counters.Get(formatted)
-		if counter == nil {
-			counter = _metrics.NewCounter()
-			defer sink.counters.Register(formatted, counter)
+		series = sink.counters.Get(id, metric, tags)
+		if series == nil {
+			series = _metrics.NewLabeledSeries(id, metric, tags, _metrics.NewCounter())
+			defer sink.counters.Register(series)
 		}
-		counter.(_metrics.Counter).Inc(int64(value))
+		series.Metric.(_metrics.Counter).Inc(int64(value))
 	case metricTypeGauge:
-		gauge := sink.gauges.Get(formatted)
-		if gauge == nil {
-			gauge = _metrics.NewGaugeFloat64()
+		series = sink.gauges.Get(id, metric, tags)
+		if series == nil {
+			series = _metrics.NewLabeledSeries(id, metric, tags, _metrics.NewGaugeFloat64())
 			// N.B. defer so that we only register after we've set the value.
-			defer sink.gauges.Register(formatted, gauge)
+			defer sink.gauges.Register(series)
 		}
-		gauge.(_metrics.GaugeFloat64).Update(value)
+		series.Metric.(_metrics.GaugeFloat64).Update(value)
 	case metricTypeStat:
-		stat := sink.stats.Get(formatted)
-		if stat == nil {
+		series = sink.stats.Get(id, metric, tags)
+		if series == nil {
 			sample := _metrics.NewTimeWindowSample(4096, 8192, 300*time.Second)
-			stat = _metrics.NewHistogram(sample)
+			series = _metrics.NewLabeledSeries(id, metric, tags, _metrics.NewHistogram(sample))
 			// N.B. defer so that we only register after we've set the value.
-			defer sink.stats.Register(formatted, stat)
+			defer sink.stats.Register(series)
 		}
-		stat.(_metrics.Histogram).Update(int64(value))
+		series.Metric.(_metrics.Histogram).Update(int64(value))
+		sink.statSums[series] += value
 		for _, pair := range sink.perMetricCumulativeHistogramBounds {
 			if !strings.HasSuffix(metric, pair.Suffix) {
 				continue
@@ -95,96 +150,102 @@ func (sink *localSink) handleLocked(metric string, tags Tags, value float64, met
 			for idx := len(pair.Bounds) - 1; idx >= 0; idx-- {
 				bound := pair.Bounds[idx]
 				counterName := fmt.Sprintf("%s.less_than.%d", metric, bound)
-				if value < float64(bound) {
-					sink.handleLocked(counterName, tags, 1, metricTypeCounter)
+				if value < float64(bound) || (sink.inclusiveBounds && value == float64(bound)) {
+					sink.handleLocked(_metrics.NewSeriesID(counterName, tags), counterName, tags, 1, metricTypeCounter)
 				} else {
 					break
 				}
 			}
-			sink.handleLocked(metric+".less_than.inf", tags, 1, metricTypeCounter)
+			infName := metric + ".less_than.inf"
+			sink.handleLocked(_metrics.NewSeriesID(infName, tags), infName, tags, 1, metricTypeCounter)
 			break
 		}
 	default:
-		return fmt.Errorf("unknown metric type: %s", metricType)
+		return nil, fmt.Errorf("unknown metric type: %s", metricType)
 	}
-	return nil
+	sink.touched[series] = seriesTouch{gen: sink.currentGen, at: sink.genStart}
+	return series, nil
 }
 
 func (sink *localSink) Flush() error {
 	sink.registerLock.Lock()
-	toFlush := make(map[metricKey]int64, len(sink.touched))
+	now := time.Now()
+	toFlush := make(map[*_metrics.LabeledSeries]int64, len(sink.touched))
 	gen := sink.currentGen
 	cutoff := gen - sink.flushThreshold
 	for k, v := range sink.touched {
-		if v > cutoff {
-			toFlush[k] = v
-		} else {
+		switch {
+		case v.gen > cutoff:
+			toFlush[k] = v.gen
+		case sink.seriesTTL <= 0:
+			// the series stays registered, but isn't reported until it's updated again
 			delete(sink.touched, k)
+		case now.Sub(v.at) >= sink.seriesTTL:
+			sink.evictLocked(k)
 		}
 	}
 	sink.currentGen++
+	sink.genStart = now
+	sink.sets = make(map[*_metrics.LabeledSeries]map[string]struct{})
+	evicted := sink.evicted - sink.reportedEvicted
+	sink.reportedEvicted = sink.evicted
 	sink.registerLock.Unlock()
 
-	shouldFlush := func(mt metricType, name string) bool {
-		_, ok := toFlush[metricKey{mt, name}]
-		return ok
-	}
 	sink.flushLock.Lock()
 	defer sink.flushLock.Unlock()
 
-	flush := func(name string, i interface{}) {
-		split := strings.Split(name, "|")
-		if len(split) != 2 {
-			log.Printf("unparseable metric: %s", name)
-			return
-		}
-
-		metricName := strings.TrimSpace(split[0])
-
-		tags, err := ParseTags(strings.TrimSpace(split[1]))
-		if err != nil {
-			log.Printf("could not parse tags: %s", split[1])
-			return
-		}
+	for series := range toFlush {
+		metricName, tags := series.Name, Tags(series.Labels)
 
-		switch metric := i.(type) {
+		switch metric := series.Metric.(type) {
 		case _metrics.Counter:
-			if shouldFlush(metricTypeCounter, name) {
-				sink.dst.Handle(metricName, tags, float64(metric.Count()), metricTypeGauge)
-			}
+			sink.dst.Handle(metricName, tags, float64(metric.Count()), metricTypeGauge)
 		case _metrics.GaugeFloat64:
-			if shouldFlush(metricTypeGauge, name) {
-				sink.dst.Handle(metricName, tags, float64(metric.Value()), metricTypeGauge)
-			}
+			sink.dst.Handle(metricName, tags, float64(metric.Value()), metricTypeGauge)
 		case _metrics.Histogram:
 			h := metric.Snapshot()
 			p := h.Percentiles([]float64{0.5000, 0.9000, 0.9900})
-			if shouldFlush(metricTypeStat, name) {
-				sink.dst.Handle(metricName+".count", tags, float64(h.Count()), metricTypeGauge)
-				sink.dst.Handle(metricName+".max", tags, float64(h.Max()), metricTypeGauge)
-				sink.dst.Handle(metricName+".min", tags, float64(h.Min()), metricTypeGauge)
-				sink.dst.Handle(metricName+".median", tags, p[0], metricTypeGauge)
-				sink.dst.Handle(metricName+".avg", tags, h.Mean(), metricTypeGauge)
-				sink.dst.Handle(metricName+".90percentile", tags, p[1], metricTypeGauge)
-				sink.dst.Handle(metricName+".99percentile", tags, p[2], metricTypeGauge)
-				// TODO: Add back
-				//sink.dst.Handle(metricName+"._dropped", tags, float64(h.Dropped()), metricTypeGauge)
-			}
+			sink.dst.Handle(metricName+".count", tags, float64(h.Count()), metricTypeGauge)
+			sink.dst.Handle(metricName+".max", tags, float64(h.Max()), metricTypeGauge)
+			sink.dst.Handle(metricName+".min", tags, float64(h.Min()), metricTypeGauge)
+			sink.dst.Handle(metricName+".median", tags, p[0], metricTypeGauge)
+			sink.dst.Handle(metricName+".avg", tags, h.Mean(), metricTypeGauge)
+			sink.dst.Handle(metricName+".90percentile", tags, p[1], metricTypeGauge)
+			sink.dst.Handle(metricName+".99percentile", tags, p[2], metricTypeGauge)
+			// TODO: Add back
+			//sink.dst.Handle(metricName+"._dropped", tags, float64(h.Dropped()), metricTypeGauge)
 		default:
 			// Ignore all other metrics
 		}
 	}
-
-	sink.counters.Each(flush)
-	sink.gauges.Each(flush)
-	sink.stats.Each(flush)
+	if evicted > 0 {
+		sink.dst.Handle("obs.local.evicted_series", nil, float64(evicted), metricTypeCounter)
+	}
 
 	sink.dst.Flush()
 	return nil
 }
 
+// evictLocked unregisters a series, so that it and its samples can be garbage collected.
+func (sink *localSink) evictLocked(series *_metrics.LabeledSeries) {
+	switch series.Metric.(type) {
+	case _metrics.Counter:
+		sink.counters.Unregister(series)
+	case _metrics.GaugeFloat64:
+		sink.gauges.Unregister(series)
+	case _metrics.Histogram:
+		sink.stats.Unregister(series)
+	}
+	delete(sink.touched, series)
+	delete(sink.statSums, series)
+	delete(sink.sets, series)
+	sink.evicted++
+}
+
 func (sink *localSink) Close() {
 	sink.Flush()
+	sink.registerLock.Lock()
+	defer sink.registerLock.Unlock()
 	sink.counters.UnregisterAll()
 	sink.gauges.UnregisterAll()
 	sink.stats.UnregisterAll()
@@ -193,17 +254,28 @@ func (sink *localSink) Close() {
 // NewLocalSink returns an implementation of sink. Pass in the destination
 // sink like statsd, and perMetricCumulativeHistogramBounds to add histogram
 // metrics
-func NewLocalSink(dst Sink, flushThreshold int, perMetricCumulativeHistogramBounds PerMetricCumulativeHistogramBounds) Sink {
+func NewLocalSink(dst Sink, flushThreshold int, perMetricCumulativeHistogramBounds PerMetricCumulativeHistogramBounds, opts ...LocalOption) Sink {
+	sink := newLocalSink(dst, flushThreshold, perMetricCumulativeHistogramBounds)
+	for _, opt := range opts {
+		opt(sink)
+	}
+	return sink
+}
+
+func newLocalSink(dst Sink, flushThreshold int, perMetricCumulativeHistogramBounds PerMetricCumulativeHistogramBounds) *localSink {
 	return &localSink{
-		counters: _metrics.NewRegistry(),
-		gauges:   _metrics.NewRegistry(),
-		stats:    _metrics.NewRegistry(),
+		counters: _metrics.NewLabeledRegistry(),
+		gauges:   _metrics.NewLabeledRegistry(),
+		stats:    _metrics.NewLabeledRegistry(),
 		dst:      dst,
 
 		perMetricCumulativeHistogramBounds: perMetricCumulativeHistogramBounds,
 
 		flushThreshold: int64(flushThreshold),
 
-		touched: make(map[metricKey]int64),
+		genStart: time.Now(),
+		touched:  make(map[*_metrics.LabeledSeries]seriesTouch),
+		statSums: make(map[*_metrics.LabeledSeries]float64),
+		sets:     make(map[*_metrics.LabeledSeries]map[string]struct{}),
 	}
 }
@@ -6,6 +6,9 @@ import (
 	"math/rand"
 	"strings"
 	"testing"
+	"time"
+
+	_metrics "github.com/mixpanel/obs/go-metrics"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -276,3 +279,77 @@ func (sink *testSink) Handle(metric string, tags Tags, value float64, metricType
 
 func (sink *testSink) Flush() error { return nil }
 func (sink *testSink) Close()       {}
+
+func TestLocalSinkSet(t *testing.T) {
+	local, test := newLocalTestSink()
+	r := NewReceiver(local)
+	r.AddToSet("test", "a")
+	r.AddToSet("test", "b")
+	r.AddToSet("test", "a")
+	local.Flush()
+
+	assert.Equal(t, []string{formatMetric("test", nil, 2, metricTypeGauge)}, test.stats)
+
+	// sets are reset on every flush
+	test.stats = nil
+	r.AddToSet("test", "c")
+	local.Flush()
+	assert.Equal(t, []string{formatMetric("test", nil, 1, metricTypeGauge)}, test.stats)
+}
+
+func TestLocalSinkSpecialCharacters(t *testing.T) {
+	local, test := newLocalTestSink()
+	tags := Tags{"url": "http://example.com/a,b", "key:with|separators": "%2C"}
+	local.Handle("test|metric", tags, 1, metricTypeCounter)
+	local.Flush()
+
+	assert.Equal(t, []string{formatMetric("test|metric", tags, 1, metricTypeGauge)}, test.stats)
+}
+
+func TestLocalSinkSeriesTTL(t *testing.T) {
+	test := &testSink{}
+	local := NewLocalSink(test, 1, nil, WithSeriesTTL(time.Nanosecond))
+	local.Handle("test", Tags{"pod": "a"}, 2, metricTypeCounter)
+	local.Handle("test.stat", nil, 1, metricTypeStat)
+	local.Flush()
+	assert.Contains(t, test.stats, formatMetric("test", Tags{"pod": "a"}, 2, metricTypeGauge))
+
+	// once a series is no longer reported, it's evicted after the TTL
+	test.stats = nil
+	local.Flush()
+	assert.Equal(t, []string{formatMetric("obs.local.evicted_series", nil, 2, metricTypeCounter)}, test.stats)
+	sink := local.(*localSink)
+	assert.Empty(t, sink.touched)
+	assert.Empty(t, sink.statSums)
+	sink.counters.Each(func(series *_metrics.LabeledSeries) { t.Errorf("%s wasn't evicted", series.Name) })
+	sink.stats.Each(func(series *_metrics.LabeledSeries) { t.Errorf("%s wasn't evicted", series.Name) })
+
+	// an evicted counter starts afresh
+	test.stats = nil
+	local.Handle("test", Tags{"pod": "a"}, 1, metricTypeCounter)
+	local.Flush()
+	assert.Equal(t, []string{formatMetric("test", Tags{"pod": "a"}, 1, metricTypeGauge)}, test.stats)
+}
+
+func TestLocalSinkSeriesTTLNotExpired(t *testing.T) {
+	test := &testSink{}
+	local := NewLocalSink(test, 1, nil, WithSeriesTTL(time.Hour))
+	local.Handle("test", nil, 2, metricTypeCounter)
+	local.Flush()
+	local.Flush()
+
+	// the series is no longer reported, but keeps counting when it's updated again
+	test.stats = nil
+	local.Handle("test", nil, 1, metricTypeCounter)
+	local.Flush()
+	assert.Equal(t, []string{formatMetric("test", nil, 3, metricTypeGauge)}, test.stats)
+}
+
+func TestLocalSinkDistribution(t *testing.T) {
+	local, test := newLocalTestSink()
+	NewReceiver(local).AddDistribution("test", 3)
+	local.Flush()
+
+	assert.Contains(t, test.stats, formatMetric("test.count", nil, 1, metricTypeGauge))
+	assert.Contains(t, test.stats, formatMetric("test.max", nil, 3, metricTypeGauge))
+}
@@ -24,6 +24,16 @@ func (sink *MockSink) Handle(metric string, tags Tags, value float64, metricType
 	return nil
 }
 
+// HandleSet simulates adding a value to a set, recording it like Handle with an "s" metric type
+func (sink *MockSink) HandleSet(metric string, tags Tags, value string) error {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+
+	formatted := fmt.Sprintf("%v, %v, %v, s\n", metric, tags, value)
+	sink.Invocations[formatted]++
+	return nil
+}
+
 // Flush simulates the flush of the buffered
 // metrics
 func (sink *MockSink) Flush() error {
@@ -0,0 +1,308 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultMultiSinkQueueSize    = 1024
+	defaultMultiSinkFlushTimeout = 10 * time.Second
+)
+
+// SinkFilter selects the metrics a multi sink sends to one of its destinations. A metric is sent if it matches every
+// non-empty include list, and none of the exclude lists.
+type SinkFilter struct {
+	// IncludePrefixes are the metric name prefixes to send.
+	IncludePrefixes []string `yaml:"include_prefixes"`
+	// ExcludePrefixes are the metric name prefixes not to send.
+	ExcludePrefixes []string `yaml:"exclude_prefixes"`
+	// IncludeTags are tag keys, one of which a metric must have to be sent.
+	IncludeTags []string `yaml:"include_tags"`
+	// ExcludeTags are tag keys that stop a metric being sent.
+	ExcludeTags []string `yaml:"exclude_tags"`
+	// Types are the metric types to send: counter, gauge, stat, distribution, set, event or service_check. Events
+	// are filtered by the name "events".
+	Types []string `yaml:"types"`
+}
+
+// multiSinkTypes maps the type names used by SinkFilter to the types of metrics, sets, events and service checks.
+var multiSinkTypes = map[string]metricType{
+	"counter":       metricTypeCounter,
+	"gauge":         metricTypeGauge,
+	"stat":          metricTypeStat,
+	"distribution":  metricTypeDistribution,
+	"set":           "s",
+	"event":         "_e",
+	"service_check": "_sc",
+}
+
+func (f *SinkFilter) matches(metric string, tags Tags, metricType metricType, types map[metricType]bool) bool {
+	if len(types) > 0 && !types[metricType] {
+		return false
+	}
+	if len(f.IncludePrefixes) > 0 && !hasAnyPrefix(metric, f.IncludePrefixes) {
+		return false
+	}
+	if hasAnyPrefix(metric, f.ExcludePrefixes) {
+		return false
+	}
+	if len(f.IncludeTags) > 0 && !hasAnyTag(tags, f.IncludeTags) {
+		return false
+	}
+	return !hasAnyTag(tags, f.ExcludeTags)
+}
+
+func hasAnyPrefix(metric string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(metric, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasAnyTag(tags Tags, keys []string) bool {
+	for _, key := range keys {
+		if _, ok := tags[key]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// MultiSinkDestination is one of the sinks a multi sink sends metrics to.
+type MultiSinkDestination struct {
+	Sink   Sink
+	Filter SinkFilter
+	// QueueSize is how many metrics can wait to be handled by Sink, 1024 if it's zero. Metrics are dropped while the
+	// queue is full, so that a slow sink doesn't hold up the others.
+	QueueSize int
+	// FlushTimeout is how long Flush waits for Sink to handle its queue and flush, 10 seconds if it's zero.
+	FlushTimeout time.Duration
+}
+
+// multiSinkOp is either a metric to handle, or a request to flush.
+type multiSinkOp struct {
+	handle  func(Sink) error
+	flushed chan error
+}
+
+type multiSinkDestination struct {
+	sink         Sink
+	filter       SinkFilter
+	types        map[metricType]bool
+	ops          chan multiSinkOp
+	flushTimeout time.Duration
+
+	// dropped counts the metrics dropped while the queue was full. It's reported to the sink as
+	// obs.multi_sink.dropped before every flush.
+	dropped, reportedDropped int64
+}
+
+type multiSink struct {
+	destinations []*multiSinkDestination
+	mutex        sync.RWMutex // protects closed, so that nothing is queued once the queues are closed
+	closed       bool
+	wg           sync.WaitGroup
+}
+
+// run handles the metrics queued for the destination until its queue is closed.
+func (d *multiSinkDestination) run(wg *sync.WaitGroup) {
+	defer wg.Done()
+	for op := range d.ops {
+		if op.flushed != nil {
+			if dropped := atomic.LoadInt64(&d.dropped); dropped > d.reportedDropped {
+				d.call(func(sink Sink) error {
+					return sink.Handle("obs.multi_sink.dropped", nil, float64(dropped-d.reportedDropped), metricTypeCounter)
+				})
+				d.reportedDropped = dropped
+			}
+			op.flushed <- d.call(Sink.Flush)
+			continue
+		}
+		if err := d.call(op.handle); err != nil {
+			log.Printf("error while handling metric in multi sink: %v", err)
+		}
+	}
+}
+
+// flush queues a flush behind the metrics already queued and waits for it, for at most the destination's flush
+// timeout.
+func (d *multiSinkDestination) flush() error {
+	timer := time.NewTimer(d.flushTimeout)
+	defer timer.Stop()
+
+	// flushed is buffered so that run doesn't block on it once flush has given up
+	flushed := make(chan error, 1)
+	select {
+	case d.ops <- multiSinkOp{flushed: flushed}:
+	case <-timer.C:
+		return fmt.Errorf("timed out after %v queueing flush of %T", d.flushTimeout, d.sink)
+	}
+	select {
+	case err := <-flushed:
+		return err
+	case <-timer.C:
+		return fmt.Errorf("timed out after %v flushing %T", d.flushTimeout, d.sink)
+	}
+}
+
+// call calls f with the destination's sink, turning a panic into an error so that it doesn't take down the others.
+func (d *multiSinkDestination) call(f func(Sink) error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic in %T: %v", d.sink, r)
+		}
+	}()
+	return f(d.sink)
+}
+
+// dispatch queues f for every destination whose filter matches.
+func (sink *multiSink) dispatch(metric string, tags Tags, metricType metricType, f func(Sink) error) error {
+	sink.mutex.RLock()
+	defer sink.mutex.RUnlock()
+
+	if sink.closed {
+		return errors.New("sink is closed")
+	}
+	for _, d := range sink.destinations {
+		if !d.filter.matches(metric, tags, metricType, d.types) {
+			continue
+		}
+		select {
+		case d.ops <- multiSinkOp{handle: f}:
+		default:
+			atomic.AddInt64(&d.dropped, 1)
+		}
+	}
+	return nil
+}
+
+func (sink *multiSink) Handle(metric string, tags Tags, value float64, metricType metricType) error {
+	return sink.dispatch(metric, tags, metricType, func(s Sink) error {
+		return s.Handle(metric, tags, value, metricType)
+	})
+}
+
+// HandleSet adds value to the set on destinations that support sets, and ignores it on the others.
+func (sink *multiSink) HandleSet(metric string, tags Tags, value string) error {
+	return sink.dispatch(metric, tags, multiSinkTypes["set"], func(s Sink) error {
+		if set, ok := s.(setSink); ok {
+			return set.HandleSet(metric, tags, value)
+		}
+		return nil
+	})
+}
+
+// HandleEvent sends the event to destinations that support events, and counts it on the others like a Receiver
+// does.
+func (sink *multiSink) HandleEvent(event Event, tags Tags) error {
+	return sink.dispatch("events", tags, multiSinkTypes["event"], func(s Sink) error {
+		return handleEvent(s, "events", event, tags)
+	})
+}
+
+// HandleServiceCheck sends the check to destinations that support service checks, and reports it as a gauge on
+// the others like a Receiver does.
+func (sink *multiSink) HandleServiceCheck(name string, tags Tags, status ServiceCheckStatus, message string) error {
+	return sink.dispatch(name, tags, multiSinkTypes["service_check"], func(s Sink) error {
+		return handleServiceCheck(s, name, tags, status, message)
+	})
+}
+
+// Flush flushes every destination once it has handled the metrics queued before it, and returns the first error.
+// Destinations are flushed concurrently, so a slow one only delays the return of Flush, by at most its flush
+// timeout, after which Flush returns a timeout error.
+func (sink *multiSink) Flush() error {
+	sink.mutex.RLock()
+	defer sink.mutex.RUnlock()
+
+	if sink.closed {
+		return nil
+	}
+	results := make([]chan error, len(sink.destinations))
+	for i, d := range sink.destinations {
+		results[i] = make(chan error, 1)
+		go func(d *multiSinkDestination, result chan error) {
+			result <- d.flush()
+		}(d, results[i])
+	}
+	var err error
+	for _, flushed := range results {
+		if e := <-flushed; e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Close handles every queued metric, then flushes and closes every destination.
+func (sink *multiSink) Close() {
+	sink.Flush()
+
+	sink.mutex.Lock()
+	if sink.closed {
+		sink.mutex.Unlock()
+		return
+	}
+	sink.closed = true
+	for _, d := range sink.destinations {
+		close(d.ops)
+	}
+	sink.mutex.Unlock()
+
+	sink.wg.Wait()
+	for _, d := range sink.destinations {
+		d.call(func(s Sink) error {
+			s.Close()
+			return nil
+		})
+	}
+}
+
+// NewMultiSink returns a sink that sends every metric to each of destinations whose filter matches it. Every
+// destination has its own queue and goroutine, so that one that is slow or failing doesn't affect the others.
+// Sampling isn't passed on, since not every destination may support it.
+func NewMultiSink(destinations ...MultiSinkDestination) (Sink, error) {
+	sink := &multiSink{}
+	for _, dest := range destinations {
+		if dest.Sink == nil {
+			return nil, errors.New("multi sink destination has no sink")
+		}
+		types := make(map[metricType]bool, len(dest.Filter.Types))
+		for _, name := range dest.Filter.Types {
+			t, ok := multiSinkTypes[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown metric type in multi sink filter: %s", name)
+			}
+			types[t] = true
+		}
+		queueSize := dest.QueueSize
+		if queueSize <= 0 {
+			queueSize = defaultMultiSinkQueueSize
+		}
+		flushTimeout := dest.FlushTimeout
+		if flushTimeout <= 0 {
+			flushTimeout = defaultMultiSinkFlushTimeout
+		}
+		sink.destinations = append(sink.destinations, &multiSinkDestination{
+			sink:         dest.Sink,
+			filter:       dest.Filter,
+			types:        types,
+			ops:          make(chan multiSinkOp, queueSize),
+			flushTimeout: flushTimeout,
+		})
+	}
+
+	for _, d := range sink.destinations {
+		sink.wg.Add(1)
+		go d.run(&sink.wg)
+	}
+	return sink, nil
+}
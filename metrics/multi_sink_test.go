@@ -0,0 +1,153 @@
+package metrics
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMultiSinkFilters(t *testing.T) {
+	all, prefixed, counters := NewMockSink(), NewMockSink(), NewMockSink()
+	sink, err := NewMultiSink(
+		MultiSinkDestination{Sink: all},
+		MultiSinkDestination{Sink: prefixed, Filter: SinkFilter{
+			IncludePrefixes: []string{"a."},
+			ExcludePrefixes: []string{"a.private."},
+		}},
+		MultiSinkDestination{Sink: counters, Filter: SinkFilter{
+			ExcludeTags: []string{"secret"},
+			Types:       []string{"counter", "set"},
+		}},
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer sink.Close()
+
+	sink.Handle("a.count", nil, 1, metricTypeCounter)
+	sink.Handle("a.private.count", nil, 1, metricTypeCounter)
+	sink.Handle("b.count", Tags{"secret": "x"}, 1, metricTypeCounter)
+	sink.Handle("b.gauge", nil, 1, metricTypeGauge)
+	sink.(setSink).HandleSet("b.set", nil, "x")
+	assert.NoError(t, sink.Flush())
+
+	assert.Equal(t, map[string]int{
+		"a.count, map[], 1, ct\n":         1,
+		"a.private.count, map[], 1, ct\n": 1,
+		"b.count, map[secret:x], 1, ct\n": 1,
+		"b.gauge, map[], 1, g\n":          1,
+		"b.set, map[], x, s\n":            1,
+	}, all.Invocations)
+	assert.Equal(t, map[string]int{"a.count, map[], 1, ct\n": 1}, prefixed.Invocations)
+	assert.Equal(t, map[string]int{
+		"a.count, map[], 1, ct\n":         1,
+		"a.private.count, map[], 1, ct\n": 1,
+		"b.set, map[], x, s\n":            1,
+	}, counters.Invocations)
+}
+
+func TestMultiSinkFallbacks(t *testing.T) {
+	mock := NewMockSink()
+	sink, err := NewMultiSink(MultiSinkDestination{Sink: mock})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer sink.Close()
+
+	r := NewReceiver(sink)
+	r.Event(Event{Title: "deploy", AlertType: "success"})
+	r.ServiceCheck("check", ServiceCheckCritical, "down")
+	assert.NoError(t, sink.Flush())
+
+	assert.Equal(t, 1, mock.Invocations["events, map[alert_type:success], 1, ct\n"])
+	assert.Equal(t, 1, mock.Invocations["check, map[], 2, g\n"])
+}
+
+// blockingSink blocks in Handle until it's unblocked.
+type blockingSink struct {
+	*MockSink
+	unblock chan struct{}
+}
+
+func (sink *blockingSink) Handle(metric string, tags Tags, value float64, metricType metricType) error {
+	<-sink.unblock
+	return sink.MockSink.Handle(metric, tags, value, metricType)
+}
+
+// panickingSink panics in Handle.
+type panickingSink struct {
+	*MockSink
+}
+
+func (sink *panickingSink) Handle(metric string, tags Tags, value float64, metricType metricType) error {
+	panic("oops")
+}
+
+func TestMultiSinkIsolatesDestinations(t *testing.T) {
+	healthy := NewMockSink()
+	slow := &blockingSink{MockSink: NewMockSink(), unblock: make(chan struct{})}
+	sink, err := NewMultiSink(
+		MultiSinkDestination{Sink: slow, QueueSize: 1},
+		MultiSinkDestination{Sink: &panickingSink{NewMockSink()}},
+		MultiSinkDestination{Sink: healthy},
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer sink.Close()
+
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, sink.Handle("count", nil, 1, metricTypeCounter))
+	}
+	d := sink.(*multiSink).destinations
+	dropped := atomic.LoadInt64(&d[0].dropped)
+	assert.True(t, dropped >= 8, "the slow sink's queue fills up")
+	assert.Equal(t, int64(0), atomic.LoadInt64(&d[2].dropped))
+
+	close(slow.unblock)
+	assert.NoError(t, sink.Flush())
+	assert.Equal(t, 10, healthy.Invocations["count, map[], 1, ct\n"])
+	assert.Equal(t, 10-int(dropped), slow.Invocations["count, map[], 1, ct\n"])
+	assert.Equal(t, 1, slow.Invocations[fmtInvocation("obs.multi_sink.dropped", float64(dropped))])
+}
+
+func TestMultiSinkFlushTimeout(t *testing.T) {
+	healthy := NewMockSink()
+	slow := &blockingSink{MockSink: NewMockSink(), unblock: make(chan struct{})}
+	sink, err := NewMultiSink(
+		MultiSinkDestination{Sink: slow, FlushTimeout: 10 * time.Millisecond},
+		MultiSinkDestination{Sink: healthy},
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer sink.Close()
+
+	assert.NoError(t, sink.Handle("count", nil, 1, metricTypeCounter))
+	err = sink.Flush()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "timed out")
+	}
+	assert.Equal(t, 1, healthy.Invocations["count, map[], 1, ct\n"])
+
+	// the flush that timed out still happens once the slow sink catches up
+	close(slow.unblock)
+	assert.NoError(t, sink.Flush())
+	assert.Equal(t, 1, slow.Invocations["count, map[], 1, ct\n"])
+}
+
+func fmtInvocation(metric string, value float64) string {
+	sink := NewMockSink()
+	sink.Handle(metric, nil, value, metricTypeCounter)
+	for k := range sink.Invocations {
+		return k
+	}
+	return ""
+}
+
+func TestNewMultiSinkUnknownType(t *testing.T) {
+	_, err := NewMultiSink(MultiSinkDestination{Sink: NewMockSink(), Filter: SinkFilter{Types: []string{"histogram"}}})
+	assert.Error(t, err)
+}
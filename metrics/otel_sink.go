@@ -0,0 +1,171 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// otelFlushTimeout bounds how long Flush waits for the MeterProvider to export, since it's called before crashing.
+const otelFlushTimeout = 5 * time.Second
+
+// otelForceFlusher is implemented by MeterProviders that can export on demand, like the SDK's.
+type otelForceFlusher interface {
+	ForceFlush(ctx context.Context) error
+}
+
+type otelSink struct {
+	meter metric.Meter
+	// provider is the MeterProvider meter came from, if it's known, so that Flush can force it to export.
+	provider metric.MeterProvider
+
+	mutex      sync.RWMutex // protects the instrument maps
+	counters   map[string]metric.Float64UpDownCounter
+	gauges     map[string]metric.Float64Gauge
+	histograms map[string]metric.Float64Histogram
+}
+
+func otelAttributes(tags Tags) metric.MeasurementOption {
+	attrs := make([]attribute.KeyValue, 0, len(tags))
+	for k, v := range tags {
+		attrs = append(attrs, attribute.String(k, v))
+	}
+	return metric.WithAttributes(attrs...)
+}
+
+func (sink *otelSink) Handle(metric string, tags Tags, value float64, metricType metricType) error {
+	if len(metric) == 0 {
+		return errors.New("cannot handle empty metric")
+	}
+
+	ctx := context.Background()
+	switch metricType {
+	case metricTypeCounter:
+		counter, err := sink.counter(metric)
+		if err != nil {
+			return err
+		}
+		counter.Add(ctx, value, otelAttributes(tags))
+	case metricTypeGauge:
+		gauge, err := sink.gauge(metric)
+		if err != nil {
+			return err
+		}
+		gauge.Record(ctx, value, otelAttributes(tags))
+	case metricTypeStat, metricTypeDistribution:
+		histogram, err := sink.histogram(metric)
+		if err != nil {
+			return err
+		}
+		histogram.Record(ctx, value, otelAttributes(tags))
+	default:
+		return fmt.Errorf("unknown metric type: %s", metricType)
+	}
+	return nil
+}
+
+func (sink *otelSink) counter(name string) (metric.Float64UpDownCounter, error) {
+	sink.mutex.RLock()
+	counter, ok := sink.counters[name]
+	sink.mutex.RUnlock()
+	if ok {
+		return counter, nil
+	}
+
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	if counter, ok := sink.counters[name]; ok {
+		return counter, nil
+	}
+	counter, err := sink.meter.Float64UpDownCounter(name)
+	if err != nil {
+		return nil, err
+	}
+	sink.counters[name] = counter
+	return counter, nil
+}
+
+func (sink *otelSink) gauge(name string) (metric.Float64Gauge, error) {
+	sink.mutex.RLock()
+	gauge, ok := sink.gauges[name]
+	sink.mutex.RUnlock()
+	if ok {
+		return gauge, nil
+	}
+
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	if gauge, ok := sink.gauges[name]; ok {
+		return gauge, nil
+	}
+	gauge, err := sink.meter.Float64Gauge(name)
+	if err != nil {
+		return nil, err
+	}
+	sink.gauges[name] = gauge
+	return gauge, nil
+}
+
+func (sink *otelSink) histogram(name string) (metric.Float64Histogram, error) {
+	sink.mutex.RLock()
+	histogram, ok := sink.histograms[name]
+	sink.mutex.RUnlock()
+	if ok {
+		return histogram, nil
+	}
+
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	if histogram, ok := sink.histograms[name]; ok {
+		return histogram, nil
+	}
+	histogram, err := sink.meter.Float64Histogram(name)
+	if err != nil {
+		return nil, err
+	}
+	sink.histograms[name] = histogram
+	return histogram, nil
+}
+
+// Flush makes the MeterProvider export everything recorded so far, if the sink was created from it and it supports
+// ForceFlush. Otherwise exporting is driven by the reader registered with the MeterProvider alone.
+func (sink *otelSink) Flush() error {
+	f, ok := sink.provider.(otelForceFlusher)
+	if !ok {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), otelFlushTimeout)
+	defer cancel()
+	return f.ForceFlush(ctx)
+}
+
+func (sink *otelSink) Close() {}
+
+// NewOTelSink returns a sink that records metrics into OpenTelemetry instruments created from meter.
+// Counters become Float64UpDownCounters, since they can be decremented, gauges Float64Gauges and stats
+// Float64Histograms. Tags are recorded as attributes.
+func NewOTelSink(meter metric.Meter) Sink {
+	return newOTelSink(meter)
+}
+
+// NewOTelSinkFromProvider returns a sink like NewOTelSink that records into a meter of mp, and whose Flush makes mp
+// export right away if it implements ForceFlush, like the SDK's MeterProvider does.
+func NewOTelSinkFromProvider(mp metric.MeterProvider) Sink {
+	sink := newOTelSink(mp.Meter("github.com/mixpanel/obs"))
+	sink.provider = mp
+	return sink
+}
+
+func newOTelSink(meter metric.Meter) *otelSink {
+	return &otelSink{
+		meter:      meter,
+		counters:   make(map[string]metric.Float64UpDownCounter),
+		gauges:     make(map[string]metric.Float64Gauge),
+		histograms: make(map[string]metric.Float64Histogram),
+	}
+}
@@ -0,0 +1,79 @@
+package metrics
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+func collectOTel(t *testing.T, reader sdkmetric.Reader) map[string]metricdata.Aggregation {
+	var rm metricdata.ResourceMetrics
+	assert.NoError(t, reader.Collect(context.Background(), &rm))
+	out := make(map[string]metricdata.Aggregation)
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			out[m.Name] = m.Data
+		}
+	}
+	return out
+}
+
+func newOTelTestReceiver() (Receiver, sdkmetric.Reader) {
+	reader := sdkmetric.NewManualReader()
+	mp := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	return NewReceiver(NewOTelSink(mp.Meter("test"))), reader
+}
+
+func TestOTelSinkCounter(t *testing.T) {
+	r, reader := newOTelTestReceiver()
+	r = r.Scope("prefix", Tags{"a": "b"})
+	r.Incr("test")
+	r.IncrBy("test", 3)
+	// counters can be decremented like with the other sinks
+	r.IncrBy("test", -1)
+
+	data := collectOTel(t, reader)
+	sum, ok := data["prefix.test"].(metricdata.Sum[float64])
+	if assert.True(t, ok) && assert.Len(t, sum.DataPoints, 1) {
+		assert.False(t, sum.IsMonotonic)
+		assert.Equal(t, 3.0, sum.DataPoints[0].Value)
+		v, _ := sum.DataPoints[0].Attributes.Value(attribute.Key("a"))
+		assert.Equal(t, "b", v.AsString())
+	}
+}
+
+func TestOTelSinkGauge(t *testing.T) {
+	r, reader := newOTelTestReceiver()
+	r.SetGauge("test", 1)
+	r.SetGauge("test", 5)
+
+	data := collectOTel(t, reader)
+	gauge, ok := data["test"].(metricdata.Gauge[float64])
+	if assert.True(t, ok) && assert.Len(t, gauge.DataPoints, 1) {
+		assert.Equal(t, 5.0, gauge.DataPoints[0].Value)
+	}
+}
+
+func TestOTelSinkStat(t *testing.T) {
+	r, reader := newOTelTestReceiver()
+	for i := 1; i <= 100; i++ {
+		r.AddStat("test", float64(i))
+	}
+
+	data := collectOTel(t, reader)
+	hist, ok := data["test"].(metricdata.Histogram[float64])
+	if assert.True(t, ok) && assert.Len(t, hist.DataPoints, 1) {
+		assert.Equal(t, uint64(100), hist.DataPoints[0].Count)
+		assert.Equal(t, 5050.0, hist.DataPoints[0].Sum)
+	}
+}
+
+func TestOTelSinkErrors(t *testing.T) {
+	sink := NewOTelSink(sdkmetric.NewMeterProvider().Meter("test"))
+	assert.Error(t, sink.Handle("", nil, 1, metricTypeCounter))
+	assert.Error(t, sink.Handle("test", nil, 1, metricType("x")))
+}
@@ -0,0 +1,86 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+)
+
+// OTLPOptions configures NewOTLPSink.
+type OTLPOptions struct {
+	// Endpoint is the host:port of the OTLP collector, localhost:4317 for gRPC or localhost:4318 for HTTP if empty.
+	Endpoint string
+	// HTTP exports OTLP/HTTP protobuf instead of OTLP/gRPC.
+	HTTP bool
+	// Insecure disables TLS.
+	Insecure bool
+	// Headers are sent with every export, for example for authentication.
+	Headers map[string]string
+	// ServiceName is reported as the service.name resource attribute.
+	ServiceName string
+	// Interval is how often batched metrics are exported, every 10 seconds if it's zero.
+	Interval time.Duration
+}
+
+type otlpSink struct {
+	*otelSink
+	provider *sdkmetric.MeterProvider
+}
+
+// Flush exports everything recorded since the last export.
+func (sink *otlpSink) Flush() error {
+	return sink.provider.ForceFlush(context.Background())
+}
+
+// Close exports everything recorded since the last export and shuts down the exporter.
+func (sink *otlpSink) Close() {
+	sink.provider.Shutdown(context.Background())
+}
+
+// NewOTLPSink returns a sink that aggregates metrics in process like NewOTelSink, and exports them to an OTLP
+// collector every opts.Interval and whenever it's flushed. It doesn't need any cloud credentials.
+func NewOTLPSink(ctx context.Context, opts OTLPOptions) (Sink, error) {
+	var exporter sdkmetric.Exporter
+	var err error
+	if opts.HTTP {
+		httpOpts := []otlpmetrichttp.Option{otlpmetrichttp.WithHeaders(opts.Headers)}
+		if opts.Endpoint != "" {
+			httpOpts = append(httpOpts, otlpmetrichttp.WithEndpoint(opts.Endpoint))
+		}
+		if opts.Insecure {
+			httpOpts = append(httpOpts, otlpmetrichttp.WithInsecure())
+		}
+		exporter, err = otlpmetrichttp.New(ctx, httpOpts...)
+	} else {
+		grpcOpts := []otlpmetricgrpc.Option{otlpmetricgrpc.WithHeaders(opts.Headers)}
+		if opts.Endpoint != "" {
+			grpcOpts = append(grpcOpts, otlpmetricgrpc.WithEndpoint(opts.Endpoint))
+		}
+		if opts.Insecure {
+			grpcOpts = append(grpcOpts, otlpmetricgrpc.WithInsecure())
+		}
+		exporter, err = otlpmetricgrpc.New(ctx, grpcOpts...)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error initializing otlp metrics exporter: %v", err)
+	}
+
+	interval := opts.Interval
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	provider := sdkmetric.NewMeterProvider(
+		sdkmetric.WithReader(sdkmetric.NewPeriodicReader(exporter, sdkmetric.WithInterval(interval))),
+		sdkmetric.WithResource(resource.NewSchemaless(attribute.String("service.name", opts.ServiceName))),
+	)
+	return &otlpSink{
+		otelSink: newOTelSink(provider.Meter("github.com/mixpanel/obs")),
+		provider: provider,
+	}, nil
+}
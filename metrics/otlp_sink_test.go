@@ -0,0 +1,109 @@
+package metrics
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	colmetricpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	metricpb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// otlpTestCollector stands in for an OTLP/HTTP collector, recording every metric it receives by name.
+type otlpTestCollector struct {
+	*httptest.Server
+
+	mutex   sync.Mutex
+	service string
+	metrics map[string]*metricpb.Metric
+}
+
+func newOTLPTestCollector(t *testing.T) *otlpTestCollector {
+	c := &otlpTestCollector{metrics: make(map[string]*metricpb.Metric)}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/metrics", r.URL.Path)
+		bs, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		var req colmetricpb.ExportMetricsServiceRequest
+		assert.NoError(t, proto.Unmarshal(bs, &req))
+
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		for _, rm := range req.ResourceMetrics {
+			for _, attr := range rm.Resource.Attributes {
+				if attr.Key == "service.name" {
+					c.service = attr.Value.GetStringValue()
+				}
+			}
+			for _, sm := range rm.ScopeMetrics {
+				for _, m := range sm.Metrics {
+					c.metrics[m.Name] = m
+				}
+			}
+		}
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		bs, _ = proto.Marshal(&colmetricpb.ExportMetricsServiceResponse{})
+		w.Write(bs)
+	}))
+	return c
+}
+
+func (c *otlpTestCollector) metric(name string) *metricpb.Metric {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.metrics[name]
+}
+
+func TestOTLPSink(t *testing.T) {
+	collector := newOTLPTestCollector(t)
+	defer collector.Close()
+
+	sink, err := NewOTLPSink(context.Background(), OTLPOptions{
+		Endpoint:    strings.TrimPrefix(collector.URL, "http://"),
+		HTTP:        true,
+		Insecure:    true,
+		ServiceName: "test-service",
+		Interval:    time.Hour,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer sink.Close()
+
+	r := NewReceiver(sink).Scope("scope", Tags{"a": "b"})
+	r.IncrBy("counter", 2)
+	r.SetGauge("gauge", 7)
+	r.AddStat("stat", 3)
+	r.AddStat("stat", 5)
+
+	assert.Nil(t, collector.metric("scope.counter"))
+	assert.NoError(t, sink.Flush())
+
+	counter := collector.metric("scope.counter")
+	if assert.NotNil(t, counter) && assert.Len(t, counter.GetSum().DataPoints, 1) {
+		assert.False(t, counter.GetSum().IsMonotonic)
+		dp := counter.GetSum().DataPoints[0]
+		assert.Equal(t, 2.0, dp.GetAsDouble())
+		if assert.Len(t, dp.Attributes, 1) {
+			assert.Equal(t, "a", dp.Attributes[0].Key)
+			assert.Equal(t, "b", dp.Attributes[0].Value.GetStringValue())
+		}
+	}
+	gauge := collector.metric("scope.gauge")
+	if assert.NotNil(t, gauge) && assert.Len(t, gauge.GetGauge().DataPoints, 1) {
+		assert.Equal(t, 7.0, gauge.GetGauge().DataPoints[0].GetAsDouble())
+	}
+	stat := collector.metric("scope.stat")
+	if assert.NotNil(t, stat) && assert.Len(t, stat.GetHistogram().DataPoints, 1) {
+		assert.Equal(t, uint64(2), stat.GetHistogram().DataPoints[0].Count)
+		assert.Equal(t, 8.0, stat.GetHistogram().DataPoints[0].GetSum())
+	}
+	assert.Equal(t, "test-service", collector.service)
+}
@@ -0,0 +1,278 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	_metrics "github.com/mixpanel/obs/go-metrics"
+)
+
+// prometheusQuantiles are reported for stats that aren't reported as histograms.
+var prometheusQuantiles = []float64{0.5, 0.9, 0.99}
+
+type prometheusSink struct {
+	*localSink
+}
+
+func (sink *prometheusSink) Handle(metric string, tags Tags, value float64, metricType metricType) error {
+	// Prometheus counters must never go down, otherwise rate() treats the decrease as a reset.
+	if metricType == metricTypeCounter && value < 0 {
+		return fmt.Errorf("cannot decrement prometheus counter %s by %g", metric, -value)
+	}
+	return sink.localSink.Handle(metric, tags, value, metricType)
+}
+
+// Flush is a no-op, since metrics are pulled from the http.Handler instead.
+func (sink *prometheusSink) Flush() error {
+	return nil
+}
+
+func (sink *prometheusSink) Close() {
+	sink.registerLock.Lock()
+	defer sink.registerLock.Unlock()
+	sink.counters.UnregisterAll()
+	sink.gauges.UnregisterAll()
+	sink.stats.UnregisterAll()
+}
+
+// NewPrometheusSink returns a Sink that aggregates metrics in process, and an http.Handler that serves them in the
+// Prometheus text exposition format. Metric names have every character that Prometheus doesn't allow replaced by
+// an underscore, so foo.bar becomes foo_bar, and tags become labels.
+//
+// Counters are reported as monotonic counters and gauges as gauges. Stats that match an entry of
+// perMetricCumulativeHistogramBounds are reported as histograms with those bounds as buckets, where each bucket
+// counts the observations less than or equal to its bound. Other stats are reported as summaries with the 50th, 90th
+// and 99th percentiles over the last 5 minutes. As is usual for Prometheus summaries, their _sum and _count cover
+// every observation since the sink was created rather than the same 5 minutes, so that rate() works on them.
+func NewPrometheusSink(perMetricCumulativeHistogramBounds PerMetricCumulativeHistogramBounds) (Sink, http.Handler) {
+	local := newLocalSink(NullSink, 0, perMetricCumulativeHistogramBounds)
+	local.inclusiveBounds = true
+	sink := &prometheusSink{local}
+	return sink, &prometheusHandler{sink: sink.localSink}
+}
+
+type prometheusHandler struct {
+	sink *localSink
+}
+
+// prometheusFamily holds every sample of one metric name, which must be written together under a single TYPE line.
+type prometheusFamily struct {
+	metricType string
+	samples    bytes.Buffer
+}
+
+func (h *prometheusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(h.render())
+}
+
+func (h *prometheusHandler) render() []byte {
+	sink := h.sink
+	sink.registerLock.Lock()
+	statSums := make(map[*_metrics.LabeledSeries]float64, len(sink.statSums))
+	for k, v := range sink.statSums {
+		statSums[k] = v
+	}
+	stats, counters, gauges := sortedSeries(sink.stats), sortedSeries(sink.counters), sortedSeries(sink.gauges)
+	// buckets holds the counters backing the buckets of every histogram, with the +Inf bucket last. They're looked up
+	// now, since the registries are only safe to read under registerLock.
+	buckets := make(map[*_metrics.LabeledSeries][]*_metrics.LabeledSeries)
+	for _, series := range stats {
+		bounds, ok := sink.boundsFor(series.Name)
+		if !ok {
+			continue
+		}
+		names := make([]string, 0, len(bounds)+1)
+		for _, bound := range bounds {
+			names = append(names, fmt.Sprintf("%s.less_than.%d", series.Name, bound))
+		}
+		names = append(names, series.Name+".less_than.inf")
+		bucketSeries := make([]*_metrics.LabeledSeries, len(names))
+		for i, name := range names {
+			bucketSeries[i] = sink.counters.Get(_metrics.NewSeriesID(name, series.Labels), name, series.Labels)
+		}
+		buckets[series] = bucketSeries
+	}
+	sink.registerLock.Unlock()
+
+	families := make(map[string]*prometheusFamily)
+	family := func(name, metricType string) *prometheusFamily {
+		f, ok := families[name]
+		if !ok {
+			f = &prometheusFamily{metricType: metricType}
+			families[name] = f
+		}
+		return f
+	}
+
+	// stats go first, so that the counters backing histogram buckets aren't also reported as counters
+	bucketCounters := make(map[*_metrics.LabeledSeries]bool)
+	bucketCounter := func(series *_metrics.LabeledSeries) int64 {
+		if series == nil {
+			return 0
+		}
+		bucketCounters[series] = true
+		return counterValue(series)
+	}
+	for _, series := range stats {
+		h, ok := series.Metric.(_metrics.Histogram)
+		if !ok {
+			continue
+		}
+		name := prometheusName(series.Name)
+		labels := prometheusLabels(series.Labels)
+
+		if bucketSeries, ok := buckets[series]; ok {
+			bounds, _ := sink.boundsFor(series.Name)
+			f := family(name, "histogram")
+			for i, bound := range bounds {
+				count := bucketCounter(bucketSeries[i])
+				writeSample(&f.samples, name+"_bucket", labels, "le", strconv.FormatInt(bound, 10), float64(count))
+			}
+			total := bucketCounter(bucketSeries[len(bounds)])
+			writeSample(&f.samples, name+"_bucket", labels, "le", "+Inf", float64(total))
+			writeSample(&f.samples, name+"_sum", labels, "", "", statSums[series])
+			writeSample(&f.samples, name+"_count", labels, "", "", float64(total))
+			continue
+		}
+
+		// the quantiles cover the sample's time window, while _sum and _count are running totals
+		f := family(name, "summary")
+		snapshot := h.Snapshot()
+		for i, p := range snapshot.Percentiles(prometheusQuantiles) {
+			writeSample(&f.samples, name, labels, "quantile", strconv.FormatFloat(prometheusQuantiles[i], 'g', -1, 64), p)
+		}
+		writeSample(&f.samples, name+"_sum", labels, "", "", statSums[series])
+		writeSample(&f.samples, name+"_count", labels, "", "", float64(snapshot.Count()))
+	}
+
+	for _, series := range counters {
+		if bucketCounters[series] {
+			continue
+		}
+		name := prometheusName(series.Name)
+		f := family(name, "counter")
+		writeSample(&f.samples, name, prometheusLabels(series.Labels), "", "", float64(counterValue(series)))
+	}
+
+	for _, series := range gauges {
+		gauge, ok := series.Metric.(_metrics.GaugeFloat64)
+		if !ok {
+			continue
+		}
+		name := prometheusName(series.Name)
+		f := family(name, "gauge")
+		writeSample(&f.samples, name, prometheusLabels(series.Labels), "", "", gauge.Value())
+	}
+
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	out := &bytes.Buffer{}
+	for _, name := range names {
+		f := families[name]
+		fmt.Fprintf(out, "# TYPE %s %s\n", name, f.metricType)
+		f.samples.WriteTo(out)
+	}
+	return out.Bytes()
+}
+
+// boundsFor returns the histogram bounds of the first entry matching a stat, like handleLocked.
+func (sink *localSink) boundsFor(metric string) ([]int64, bool) {
+	for _, pair := range sink.perMetricCumulativeHistogramBounds {
+		if strings.HasSuffix(metric, pair.Suffix) {
+			return pair.Bounds, true
+		}
+	}
+	return nil, false
+}
+
+func counterValue(series *_metrics.LabeledSeries) int64 {
+	if counter, ok := series.Metric.(_metrics.Counter); ok {
+		return counter.Count()
+	}
+	return 0
+}
+
+// sortedSeries returns the series of a localSink registry sorted by name and tags, so that the output is stable. The
+// caller must hold registerLock.
+func sortedSeries(registry _metrics.LabeledRegistry) []*_metrics.LabeledSeries {
+	var res []*_metrics.LabeledSeries
+	keys := make(map[*_metrics.LabeledSeries]string)
+	registry.Each(func(series *_metrics.LabeledSeries) {
+		res = append(res, series)
+		keys[series] = series.Name + "|" + FormatTags(series.Labels)
+	})
+	sort.Slice(res, func(i, j int) bool { return keys[res[i]] < keys[res[j]] })
+	return res
+}
+
+func writeSample(buf *bytes.Buffer, name, labels, extraName, extraValue string, value float64) {
+	buf.WriteString(name)
+	if len(labels) > 0 || len(extraName) > 0 {
+		buf.WriteString("{")
+		buf.WriteString(labels)
+		if len(extraName) > 0 {
+			if len(labels) > 0 {
+				buf.WriteString(",")
+			}
+			buf.WriteString(extraName)
+			buf.WriteString(`="`)
+			buf.WriteString(extraValue)
+			buf.WriteString(`"`)
+		}
+		buf.WriteString("}")
+	}
+	buf.WriteString(" ")
+	buf.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	buf.WriteString("\n")
+}
+
+// prometheusLabels formats tags as sorted Prometheus labels, without the surrounding braces.
+func prometheusLabels(tags Tags) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, prometheusLabelName(k)+`="`+prometheusLabelValueEscaper.Replace(tags[k])+`"`)
+	}
+	return strings.Join(pairs, ",")
+}
+
+var prometheusLabelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// prometheusName replaces every character that isn't allowed in a Prometheus metric name with an underscore.
+func prometheusName(name string) string {
+	return sanitizePrometheus(name, true)
+}
+
+// prometheusLabelName replaces every character that isn't allowed in a Prometheus label name with an underscore.
+func prometheusLabelName(name string) string {
+	return sanitizePrometheus(name, false)
+}
+
+func sanitizePrometheus(name string, allowColon bool) string {
+	bs := []byte(name)
+	for i, b := range bs {
+		valid := b == '_' || (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') ||
+			(i > 0 && b >= '0' && b <= '9') || (allowColon && b == ':')
+		if !valid {
+			bs[i] = '_'
+		}
+	}
+	if len(bs) == 0 {
+		return "_"
+	}
+	return string(bs)
+}
@@ -0,0 +1,87 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func scrapePrometheus(t *testing.T, handler http.Handler) string {
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", rec.Header().Get("Content-Type"))
+	bs, err := ioutil.ReadAll(rec.Body)
+	assert.NoError(t, err)
+	return string(bs)
+}
+
+func TestPrometheusSinkCounterAndGauge(t *testing.T) {
+	sink, handler := NewPrometheusSink(nil)
+	r := NewReceiver(sink).Scope("scope", Tags{"host": "a"})
+	r.Incr("requests")
+	r.IncrBy("requests", 2)
+	r.SetGauge("queue.depth", 4)
+	r.SetGauge("queue.depth", 7.5)
+
+	assert.Equal(t, "# TYPE scope_queue_depth gauge\n"+
+		"scope_queue_depth{host=\"a\"} 7.5\n"+
+		"# TYPE scope_requests counter\n"+
+		"scope_requests{host=\"a\"} 3\n", scrapePrometheus(t, handler))
+
+	// counters stay monotonic across scrapes and flushes
+	sink.Flush()
+	r.Incr("requests")
+	assert.Contains(t, scrapePrometheus(t, handler), "scope_requests{host=\"a\"} 4\n")
+}
+
+func TestPrometheusSinkCounterDecrement(t *testing.T) {
+	sink, handler := NewPrometheusSink(nil)
+	assert.NoError(t, sink.Handle("requests", nil, 2, metricTypeCounter))
+	assert.Error(t, sink.Handle("requests", nil, -1, metricTypeCounter))
+	assert.Contains(t, scrapePrometheus(t, handler), "requests 2\n")
+}
+
+func TestPrometheusSinkSummary(t *testing.T) {
+	sink, handler := NewPrometheusSink(nil)
+	r := NewReceiver(sink)
+	for i := 1; i <= 100; i++ {
+		r.AddStat("latency", float64(i))
+	}
+
+	assert.Equal(t, "# TYPE latency summary\n"+
+		"latency{quantile=\"0.5\"} 50.5\n"+
+		"latency{quantile=\"0.9\"} 90.9\n"+
+		"latency{quantile=\"0.99\"} 99.99\n"+
+		"latency_sum 5050\n"+
+		"latency_count 100\n", scrapePrometheus(t, handler))
+}
+
+func TestPrometheusSinkHistogram(t *testing.T) {
+	sink, handler := NewPrometheusSink(PerMetricCumulativeHistogramBounds{
+		{"latency_us", []int64{10, 100}},
+	})
+	r := NewReceiver(sink).ScopeTags(Tags{"endpoint": "query"})
+	r.AddStat("latency_us", 5)
+	r.AddStat("latency_us", 50)
+	r.AddStat("latency_us", 500)
+	// buckets are inclusive of their bound
+	r.AddStat("latency_us", 10)
+
+	assert.Equal(t, "# TYPE latency_us histogram\n"+
+		"latency_us_bucket{endpoint=\"query\",le=\"10\"} 2\n"+
+		"latency_us_bucket{endpoint=\"query\",le=\"100\"} 3\n"+
+		"latency_us_bucket{endpoint=\"query\",le=\"+Inf\"} 4\n"+
+		"latency_us_sum{endpoint=\"query\"} 565\n"+
+		"latency_us_count{endpoint=\"query\"} 4\n", scrapePrometheus(t, handler))
+}
+
+func TestPrometheusSinkSanitize(t *testing.T) {
+	sink, handler := NewPrometheusSink(nil)
+	sink.Handle("9lives.http-requests", Tags{"status-code": `a"b\c`}, 1, metricTypeCounter)
+
+	assert.Equal(t, "# TYPE _lives_http_requests counter\n"+
+		"_lives_http_requests{status_code=\"a\\\"b\\\\c\"} 1\n", scrapePrometheus(t, handler))
+}
@@ -1,7 +1,9 @@
 package metrics
 
 import (
+	"fmt"
 	"log"
+	"math/rand"
 	"sync"
 	"time"
 )
@@ -15,17 +17,37 @@ type Receiver interface {
 	IncrBy(name string, amount float64)
 	AddStat(name string, value float64)
 	SetGauge(name string, value float64)
+	// AddDistribution is like AddStat, but percentiles are computed by the server over the values from every host.
+	// Sinks that don't support distributions treat them as stats.
+	AddDistribution(name string, value float64)
+	// AddToSet adds value to the set called name, so that the number of distinct values can be counted, for example
+	// of project IDs. Sinks that can't count distinct values ignore sets.
+	AddToSet(name string, value string)
+	Event(event Event)
+	ServiceCheck(name string, status ServiceCheckStatus, message string)
 
 	ScopePrefix(prefix string) Receiver
 	ScopeTags(tags Tags) Receiver
 	Scope(prefix string, tags Tags) Receiver
+	// ScopeSampleRate returns a Receiver that only reports counters, stats and distributions with probability rate,
+	// and lets the sink scale them back up. Sinks that don't support sample rates get every value instead.
+	ScopeSampleRate(rate float64) Receiver
 
 	StartStopwatch(name string) Stopwatch
 }
 
+// Flusher is implemented by Receivers that can flush their underlying Sink, for example before the process crashes.
+type Flusher interface {
+	Flush() error
+}
+
 type receiver struct {
 	prefix string
 	tags   Tags
+	// sampleRate is the probability that a value is reported, or 0 to report every value.
+	sampleRate float64
+	// guard is shared by every scope of a receiver, or nil if tag values aren't limited.
+	guard *cardinalityGuard
 
 	// guards 'scopes'
 	lock   sync.RWMutex
@@ -41,7 +63,16 @@ var Null Receiver = &receiver{
 }
 
 func (r *receiver) handle(name string, value float64, metricType metricType) {
-	if err := r.sink.Handle(formatName(r.prefix, name), r.tags, value, metricType); err != nil {
+	var err error
+	if sampled, ok := r.sink.(sampledSink); ok && r.sampleRate > 0 && r.sampleRate < 1 && metricType != metricTypeGauge {
+		if rand.Float64() >= r.sampleRate {
+			return
+		}
+		err = sampled.HandleSampled(formatName(r.prefix, name), r.tags, value, metricType, r.sampleRate)
+	} else {
+		err = r.sink.Handle(formatName(r.prefix, name), r.tags, value, metricType)
+	}
+	if err != nil {
 		log.Printf("error while handling metric type: %s. Error: %v", metricType, err)
 	}
 }
@@ -62,6 +93,32 @@ func (r *receiver) SetGauge(name string, value float64) {
 	r.handle(name, value, metricTypeGauge)
 }
 
+func (r *receiver) AddDistribution(name string, value float64) {
+	r.handle(name, value, metricTypeDistribution)
+}
+
+func (r *receiver) AddToSet(name string, value string) {
+	sink, ok := r.sink.(setSink)
+	if !ok {
+		return
+	}
+	if err := sink.HandleSet(formatName(r.prefix, name), r.tags, value); err != nil {
+		log.Printf("error while handling set: %s. Error: %v", name, err)
+	}
+}
+
+func (r *receiver) Event(event Event) {
+	if err := handleEvent(r.sink, formatName(r.prefix, "events"), event, r.tags); err != nil {
+		log.Printf("error while handling event: %s. Error: %v", event.Title, err)
+	}
+}
+
+func (r *receiver) ServiceCheck(name string, status ServiceCheckStatus, message string) {
+	if err := handleServiceCheck(r.sink, formatName(r.prefix, name), r.tags, status, message); err != nil {
+		log.Printf("error while handling service check: %s. Error: %v", name, err)
+	}
+}
+
 func (r *receiver) ScopeTags(tags Tags) Receiver {
 	return r.Scope("", tags)
 }
@@ -88,6 +145,15 @@ func (r *receiver) Scope(prefix string, tags Tags) Receiver {
 	// key doesn't exist, update
 	r.lock.RUnlock()
 	newPrefix := formatName(r.prefix, prefix)
+	rawKey := key
+	if r.guard != nil {
+		// values over the limit are replaced, so that they share a scope rather than each adding one. The raw tags
+		// are cached too, pointing at the shared scope, so that scoping them again doesn't go through the guard.
+		if guarded := r.guard.check(newPrefix, tags); guarded != nil {
+			tags = guarded
+			key = prefix + "|" + FormatTags(tags)
+		}
+	}
 	newTags := make(map[string]string, len(tags)+len(r.tags))
 
 	for k, v := range r.tags {
@@ -102,14 +168,46 @@ func (r *receiver) Scope(prefix string, tags Tags) Receiver {
 	defer r.lock.Unlock()
 
 	if val, ok := r.scopes[key]; ok {
+		r.scopes[rawKey] = val
 		return val
 	}
 
 	scoped := &receiver{
-		prefix: newPrefix,
-		tags:   newTags,
-		scopes: make(map[string]*receiver),
-		sink:   r.sink,
+		prefix:     newPrefix,
+		tags:       newTags,
+		sampleRate: r.sampleRate,
+		guard:      r.guard,
+		scopes:     make(map[string]*receiver),
+		sink:       r.sink,
+	}
+
+	r.scopes[key] = scoped
+	r.scopes[rawKey] = scoped
+	return scoped
+}
+
+func (r *receiver) ScopeSampleRate(rate float64) Receiver {
+	if rate == r.sampleRate {
+		return r
+	}
+
+	// the keys used by Scope always contain a |, so they never collide with this one
+	key := fmt.Sprintf("@%g", rate)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if val, ok := r.scopes[key]; ok {
+		return val
+	}
+
+	scoped := &receiver{
+		prefix:     r.prefix,
+		tags:       r.tags,
+		sampleRate: rate,
+		guard:      r.guard,
+		scopes:     make(map[string]*receiver),
+		sink:       r.sink,
 	}
 
 	r.scopes[key] = scoped
@@ -124,13 +222,36 @@ func (r *receiver) StartStopwatch(name string) Stopwatch {
 	}
 }
 
+func (r *receiver) Flush() error {
+	return r.sink.Flush()
+}
+
+// ReceiverOption configures NewReceiver.
+type ReceiverOption func(*receiver)
+
+// WithTagCardinalityLimit sets how many distinct values each tag key can take under each prefix. Values past the
+// limit are reported as OtherTagValue and counted in obs.cardinality_exceeded. Zero, the default, removes the limit.
+func WithTagCardinalityLimit(limit int) ReceiverOption {
+	return func(r *receiver) {
+		if limit <= 0 {
+			r.guard = nil
+			return
+		}
+		r.guard = newCardinalityGuard(r.sink, limit)
+	}
+}
+
 // NewReceiver returns an implementation
-// of the receiver with the specified sink
-func NewReceiver(sink Sink) Receiver {
-	return &receiver{
+// of the receiver with the specified sink.
+func NewReceiver(sink Sink, opts ...ReceiverOption) Receiver {
+	r := &receiver{
 		prefix: "",
 		tags:   make(map[string]string),
 		scopes: make(map[string]*receiver),
 		sink:   sink,
 	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
 }
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"net"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
@@ -12,10 +13,6 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
-func init() {
-	batchSizeBytes = 1
-}
-
 func BenchmarkHandleStats(b *testing.B) {
 	ch := make(chan *bytes.Buffer, 16)
 
@@ -34,8 +31,9 @@ func BenchmarkHandleStats(b *testing.B) {
 	}()
 
 	sink := &statsdSink{
-		metrics: ch,
-		flushes: make(chan struct{}),
+		metrics:        ch,
+		maxPayloadSize: DefaultMaxPayloadSize,
+		flushes:        make(chan chan struct{}),
 	}
 
 	r := &receiver{
@@ -52,6 +50,24 @@ func BenchmarkHandleStats(b *testing.B) {
 	wg.Wait()
 }
 
+func BenchmarkHandleStatsAggregated(b *testing.B) {
+	sink := &statsdSink{aggregator: newStatsdAggregator()}
+
+	r := &receiver{
+		prefix: "test",
+		scopes: make(map[string]*receiver),
+		sink:   sink,
+	}
+	r = r.ScopeTags(Tags{"aKey": "aValue"}).(*receiver)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		r.handle("test_counter", 1.0, metricTypeCounter)
+	}
+}
+
 func TestCounterIncr(t *testing.T) {
 	metrics, endpoint := newTestMetrics(t)
 	metrics.Incr("test_counter")
@@ -135,17 +151,144 @@ func TestStopwatch(t *testing.T) {
 	assert.True(t, re.MatchString(emitted))
 }
 
+func TestAddDistribution(t *testing.T) {
+	metrics, endpoint := newTestMetrics(t)
+	metrics.AddDistribution("test_distribution", 1.5)
+	assert.Equal(t, "test_distribution:1.5|d", endpoint.readAll())
+}
+
+func TestAddToSet(t *testing.T) {
+	metrics, endpoint := newTestMetrics(t)
+	metrics.ScopeTags(Tags{"aKey": "aValue"}).AddToSet("test_set", "project_1")
+	assert.Equal(t, "test_set:project_1|s|#aKey:aValue", endpoint.readAll())
+}
+
+func TestSampleRate(t *testing.T) {
+	metrics, endpoint := newTestMetrics(t)
+	sampled := metrics.ScopeSampleRate(0.5)
+	assert.Equal(t, sampled, metrics.ScopeSampleRate(0.5))
+	assert.Equal(t, sampled, sampled.ScopeSampleRate(0.5))
+
+	sampled.ScopePrefix("prefix").SetGauge("test_gauge", 1)
+	assert.Equal(t, "prefix.test_gauge:1|g", endpoint.readAll())
+
+	for i := 0; i < 100; i++ {
+		sampled.Incr("test_counter")
+	}
+	lines := strings.Split(endpoint.readAll(), "\n")
+	assert.True(t, len(lines) > 0 && len(lines) < 100, "about half the counters are sampled")
+	for _, line := range lines {
+		assert.Equal(t, "test_counter:1|ct|@0.5", line)
+	}
+}
+
+func TestSampleRateUnsupported(t *testing.T) {
+	sink := NewMockSink()
+	sampled := NewReceiver(sink).ScopeSampleRate(0.5)
+	for i := 0; i < 100; i++ {
+		sampled.Incr("test_counter")
+	}
+	assert.Equal(t, 100, sink.Invocations["test_counter, map[], 1, ct\n"])
+}
+
+func TestEvent(t *testing.T) {
+	metrics, endpoint := newTestMetrics(t)
+	metrics.ScopeTags(Tags{"aKey": "aValue"}).Event(Event{
+		Title:          "deploy",
+		Text:           "line 1\nline 2",
+		AlertType:      "success",
+		AggregationKey: "deploys",
+		Timestamp:      time.Unix(1500000000, 0),
+	})
+	assert.Equal(t, "_e{6,14}:deploy|line 1\\nline 2|d:1500000000|k:deploys|t:success|#aKey:aValue", endpoint.readAll())
+}
+
+func TestEventUnsupported(t *testing.T) {
+	sink := NewMockSink()
+	NewReceiver(sink).ScopePrefix("prefix").Event(Event{Title: "deploy"})
+	assert.Equal(t, 1, sink.Invocations["prefix.events, map[alert_type:info], 1, ct\n"])
+}
+
+func TestServiceCheck(t *testing.T) {
+	metrics, endpoint := newTestMetrics(t)
+	metrics.ScopeTags(Tags{"aKey": "aValue"}).ServiceCheck("test_check", ServiceCheckCritical, "job|failed")
+	assert.Equal(t, "_sc|test_check|2|#aKey:aValue|m:job|failed", endpoint.readAll())
+
+	sink := NewMockSink()
+	NewReceiver(sink).ServiceCheck("test_check", ServiceCheckWarning, "slow")
+	assert.Equal(t, 1, sink.Invocations["test_check, map[], 1, g\n"])
+}
+
+func TestScopeTagCardinalityLimit(t *testing.T) {
+	test := &testSink{}
+	r := NewReceiver(test, WithTagCardinalityLimit(2)).ScopePrefix("requests")
+
+	for _, user := range []string{"a", "b", "c", "d", "a"} {
+		r.ScopeTags(Tags{"user": user, "method": "GET"}).Incr("count")
+	}
+	assert.Equal(t, []string{
+		formatMetric("requests.count", Tags{"user": "a", "method": "GET"}, 1, metricTypeCounter),
+		formatMetric("requests.count", Tags{"user": "b", "method": "GET"}, 1, metricTypeCounter),
+		formatMetric("obs.cardinality_exceeded", Tags{"prefix": "requests", "tag": "user"}, 1, metricTypeCounter),
+		formatMetric("requests.count", Tags{"user": OtherTagValue, "method": "GET"}, 1, metricTypeCounter),
+		formatMetric("obs.cardinality_exceeded", Tags{"prefix": "requests", "tag": "user"}, 1, metricTypeCounter),
+		formatMetric("requests.count", Tags{"user": OtherTagValue, "method": "GET"}, 1, metricTypeCounter),
+		formatMetric("requests.count", Tags{"user": "a", "method": "GET"}, 1, metricTypeCounter),
+	}, test.stats)
+	// values over the limit share a scope, which their raw tags are cached under too
+	scopes := r.(*receiver).scopes
+	assert.Len(t, scopes, 5)
+	scopeFor := func(user string) *receiver {
+		return scopes["|"+FormatTags(Tags{"user": user, "method": "GET"})]
+	}
+	if assert.NotNil(t, scopeFor(OtherTagValue)) {
+		assert.Same(t, scopeFor(OtherTagValue), scopeFor("c"))
+		assert.Same(t, scopeFor(OtherTagValue), scopeFor("d"))
+	}
+
+	// so scoping them again doesn't count them again
+	test.stats = nil
+	r.ScopeTags(Tags{"user": "c", "method": "GET"})
+	assert.Empty(t, test.stats)
+
+	// the limit applies to each prefix separately
+	test.stats = nil
+	r.ScopePrefix("other").ScopeTags(Tags{"user": "c"}).Incr("count")
+	assert.Equal(t, []string{formatMetric("requests.other.count", Tags{"user": "c"}, 1, metricTypeCounter)}, test.stats)
+}
+
+func TestScopeTagCardinalityUnlimited(t *testing.T) {
+	test := &testSink{}
+	for _, r := range []Receiver{NewReceiver(test), NewReceiver(test, WithTagCardinalityLimit(0))} {
+		for i := 0; i < DefaultTagCardinalityLimit+1; i++ {
+			r.ScopeTags(Tags{"i": strconv.Itoa(i)})
+		}
+		assert.Len(t, r.(*receiver).scopes, DefaultTagCardinalityLimit+1)
+	}
+	assert.Empty(t, test.stats)
+}
+
 type testEndpoint struct {
 	conn net.Conn
+	sink Sink
 }
 
+// readAll flushes the sink and returns the lines it wrote, leaving out its own obs.statsd metrics.
 func (endpoint *testEndpoint) readAll() string {
+	// the pipe blocks the flush until it's read
+	go endpoint.sink.Flush()
 	buf := make([]byte, 64000)
 	n, err := endpoint.conn.Read(buf)
 	if err != nil {
 		panic(err)
 	}
-	return strings.TrimSpace(string(buf[0:n]))
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSpace(string(buf[0:n])), "\n") {
+		if !strings.HasPrefix(line, "obs.statsd.") {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
 }
 
 func newTestMetrics(t *testing.T) (Receiver, *testEndpoint) {
@@ -154,7 +297,7 @@ func newTestMetrics(t *testing.T) (Receiver, *testEndpoint) {
 	sink, err := newStatsdSinkFromConn(c1)
 	assert.NoError(t, err)
 
-	return NewReceiver(sink), &testEndpoint{c2}
+	return NewReceiver(sink), &testEndpoint{conn: c2, sink: sink}
 }
 
 func parseStatsdTags(line string) Tags {
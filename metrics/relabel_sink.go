@@ -0,0 +1,230 @@
+package metrics
+
+import (
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"strconv"
+)
+
+// RelabelAction is what a RelabelRule does.
+type RelabelAction string
+
+const (
+	// RelabelRename renames metrics whose name matches Pattern to Replacement, which can refer to submatches as $1.
+	RelabelRename = RelabelAction("rename")
+	// RelabelKeep drops every metric whose name doesn't match Pattern.
+	RelabelKeep = RelabelAction("keep")
+	// RelabelDrop drops metrics whose name matches Pattern.
+	RelabelDrop = RelabelAction("drop")
+	// RelabelDropTag removes tags whose key matches Pattern.
+	RelabelDropTag = RelabelAction("drop_tag")
+	// RelabelRenameTag renames the tag Tag to Replacement.
+	RelabelRenameTag = RelabelAction("rename_tag")
+	// RelabelRewriteTag replaces the value of the tag Tag with Replacement if it matches Pattern.
+	RelabelRewriteTag = RelabelAction("rewrite_tag")
+	// RelabelHashTag replaces the value of the tag Tag with a hash of it modulo Buckets, so that it has at most
+	// Buckets values.
+	RelabelHashTag = RelabelAction("hash_tag")
+	// RelabelBucketTag replaces the numeric value of the tag Tag with the smallest of Bounds, which must be in
+	// ascending order, that it's less than or equal to, as le_<bound>, or gt_<bound> if it's greater than all of
+	// them.
+	RelabelBucketTag = RelabelAction("bucket_tag")
+	// RelabelAddTags adds Tags to metrics that don't already have them.
+	RelabelAddTags = RelabelAction("add_tags")
+)
+
+// RelabelRule is one of the rules applied in order by a relabel sink. Pattern is a regular expression that has to
+// match the whole of the metric name, tag key or tag value. Rules that match metric names see the name as renamed by
+// earlier rules.
+type RelabelRule struct {
+	Action      RelabelAction     `yaml:"action"`
+	Pattern     string            `yaml:"pattern"`
+	Tag         string            `yaml:"tag"`
+	Replacement string            `yaml:"replacement"`
+	Buckets     uint32            `yaml:"buckets"`
+	Bounds      []float64         `yaml:"bounds"`
+	Tags        map[string]string `yaml:"tags"`
+}
+
+type relabelRule struct {
+	RelabelRule
+	pattern *regexp.Regexp
+}
+
+type relabelSink struct {
+	dst   Sink
+	rules []relabelRule
+}
+
+// relabel applies the rules to a metric, and returns its new name and tags, or false if it's dropped. tags is only
+// copied if a rule changes it.
+func (sink *relabelSink) relabel(metric string, tags Tags) (string, Tags, bool) {
+	copied := false
+	copyTags := func() {
+		if copied {
+			return
+		}
+		newTags := make(Tags, len(tags)+1)
+		for k, v := range tags {
+			newTags[k] = v
+		}
+		tags, copied = newTags, true
+	}
+
+	for _, rule := range sink.rules {
+		switch rule.Action {
+		case RelabelRename:
+			if match := rule.pattern.FindStringSubmatchIndex(metric); match != nil {
+				metric = string(rule.pattern.ExpandString(nil, rule.Replacement, metric, match))
+			}
+		case RelabelKeep:
+			if !rule.pattern.MatchString(metric) {
+				return "", nil, false
+			}
+		case RelabelDrop:
+			if rule.pattern.MatchString(metric) {
+				return "", nil, false
+			}
+		case RelabelDropTag:
+			for k := range tags {
+				if rule.pattern.MatchString(k) {
+					copyTags()
+					delete(tags, k)
+				}
+			}
+		case RelabelRenameTag:
+			if v, ok := tags[rule.Tag]; ok {
+				copyTags()
+				delete(tags, rule.Tag)
+				tags[rule.Replacement] = v
+			}
+		case RelabelRewriteTag:
+			if v, ok := tags[rule.Tag]; ok {
+				if match := rule.pattern.FindStringSubmatchIndex(v); match != nil {
+					copyTags()
+					tags[rule.Tag] = string(rule.pattern.ExpandString(nil, rule.Replacement, v, match))
+				}
+			}
+		case RelabelHashTag:
+			if v, ok := tags[rule.Tag]; ok {
+				h := fnv.New32a()
+				h.Write([]byte(v))
+				copyTags()
+				tags[rule.Tag] = strconv.FormatUint(uint64(h.Sum32()%rule.Buckets), 10)
+			}
+		case RelabelBucketTag:
+			if v, ok := tags[rule.Tag]; ok {
+				copyTags()
+				tags[rule.Tag] = bucketTagValue(v, rule.Bounds)
+			}
+		case RelabelAddTags:
+			for k, v := range rule.Tags {
+				if _, ok := tags[k]; !ok {
+					copyTags()
+					tags[k] = v
+				}
+			}
+		}
+	}
+	return metric, tags, true
+}
+
+func bucketTagValue(value string, bounds []float64) string {
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return "invalid"
+	}
+	for _, bound := range bounds {
+		if f <= bound {
+			return "le_" + strconv.FormatFloat(bound, 'g', -1, 64)
+		}
+	}
+	return "gt_" + strconv.FormatFloat(bounds[len(bounds)-1], 'g', -1, 64)
+}
+
+func (sink *relabelSink) Handle(metric string, tags Tags, value float64, metricType metricType) error {
+	metric, tags, ok := sink.relabel(metric, tags)
+	if !ok {
+		return nil
+	}
+	return sink.dst.Handle(metric, tags, value, metricType)
+}
+
+func (sink *relabelSink) HandleSet(metric string, tags Tags, value string) error {
+	set, ok := sink.dst.(setSink)
+	if !ok {
+		return nil
+	}
+	metric, tags, ok = sink.relabel(metric, tags)
+	if !ok {
+		return nil
+	}
+	return set.HandleSet(metric, tags, value)
+}
+
+// HandleEvent relabels events as if they were metrics called "events".
+func (sink *relabelSink) HandleEvent(event Event, tags Tags) error {
+	name, tags, ok := sink.relabel("events", tags)
+	if !ok {
+		return nil
+	}
+	return handleEvent(sink.dst, name, event, tags)
+}
+
+func (sink *relabelSink) HandleServiceCheck(name string, tags Tags, status ServiceCheckStatus, message string) error {
+	name, tags, ok := sink.relabel(name, tags)
+	if !ok {
+		return nil
+	}
+	return handleServiceCheck(sink.dst, name, tags, status, message)
+}
+
+func (sink *relabelSink) Flush() error {
+	return sink.dst.Flush()
+}
+
+func (sink *relabelSink) Close() {
+	sink.dst.Close()
+}
+
+// NewRelabelSink returns a sink that applies rules to the name and tags of every metric, then passes it on to dst
+// unless a rule dropped it. It lets metrics emitted by shared code be renamed, and keeps the cardinality of tags in
+// check before they reach dst. Sampling isn't passed on, since dst may not support it.
+func NewRelabelSink(dst Sink, rules []RelabelRule) (Sink, error) {
+	sink := &relabelSink{dst: dst}
+	for i, rule := range rules {
+		compiled := relabelRule{RelabelRule: rule}
+		switch rule.Action {
+		case RelabelRename, RelabelKeep, RelabelDrop, RelabelDropTag, RelabelRewriteTag:
+			pattern, err := regexp.Compile("^(?:" + rule.Pattern + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern in relabel rule %d: %v", i, err)
+			}
+			compiled.pattern = pattern
+		case RelabelRenameTag:
+			if rule.Replacement == "" {
+				return nil, fmt.Errorf("relabel rule %d renames tag %s to an empty name", i, rule.Tag)
+			}
+		case RelabelHashTag:
+			if rule.Buckets == 0 {
+				return nil, fmt.Errorf("relabel rule %d hashes tag %s into zero buckets", i, rule.Tag)
+			}
+		case RelabelBucketTag:
+			if len(rule.Bounds) == 0 {
+				return nil, fmt.Errorf("relabel rule %d buckets tag %s without bounds", i, rule.Tag)
+			}
+		case RelabelAddTags:
+		default:
+			return nil, fmt.Errorf("unknown action in relabel rule %d: %s", i, rule.Action)
+		}
+		switch rule.Action {
+		case RelabelRenameTag, RelabelRewriteTag, RelabelHashTag, RelabelBucketTag:
+			if rule.Tag == "" {
+				return nil, fmt.Errorf("relabel rule %d has no tag to %s", i, rule.Action)
+			}
+		}
+		sink.rules = append(sink.rules, compiled)
+	}
+	return sink, nil
+}
@@ -0,0 +1,102 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestRelabelSink(t *testing.T, rules ...RelabelRule) (Sink, *MockSink) {
+	mock := NewMockSink()
+	sink, err := NewRelabelSink(mock, rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sink, mock
+}
+
+func TestRelabelSinkNames(t *testing.T) {
+	sink, mock := newTestRelabelSink(t,
+		RelabelRule{Action: RelabelRename, Pattern: `lib\.(.*)`, Replacement: "service.lib_$1"},
+		RelabelRule{Action: RelabelKeep, Pattern: `service\..*`},
+		RelabelRule{Action: RelabelDrop, Pattern: `.*\.debug`},
+	)
+
+	sink.Handle("lib.requests", nil, 1, metricTypeCounter)
+	sink.Handle("service.requests", nil, 1, metricTypeCounter)
+	sink.Handle("service.requests.debug", nil, 1, metricTypeCounter)
+	sink.Handle("other.requests", nil, 1, metricTypeCounter)
+
+	assert.Equal(t, map[string]int{
+		"service.lib_requests, map[], 1, ct\n": 1,
+		"service.requests, map[], 1, ct\n":     1,
+	}, mock.Invocations)
+}
+
+func TestRelabelSinkTags(t *testing.T) {
+	sink, mock := newTestRelabelSink(t,
+		RelabelRule{Action: RelabelDropTag, Pattern: `user_.*`},
+		RelabelRule{Action: RelabelRenameTag, Tag: "proj", Replacement: "project"},
+		RelabelRule{Action: RelabelRewriteTag, Tag: "host", Pattern: `(\w+)-\d+`, Replacement: "$1"},
+		RelabelRule{Action: RelabelBucketTag, Tag: "size", Bounds: []float64{10, 100}},
+		RelabelRule{Action: RelabelAddTags, Tags: map[string]string{"region": "us", "host": "unknown"}},
+	)
+
+	tags := Tags{"user_id": "1", "user_email": "a@b", "proj": "1", "host": "web-12", "size": "50"}
+	sink.Handle("metric", tags, 1, metricTypeGauge)
+	sink.Handle("metric", Tags{"size": "1000"}, 1, metricTypeGauge)
+	sink.Handle("metric", Tags{"size": "big"}, 1, metricTypeGauge)
+
+	assert.Equal(t, map[string]int{
+		"metric, map[host:web project:1 region:us size:le_100], 1, g\n": 1,
+		"metric, map[host:unknown region:us size:gt_100], 1, g\n":       1,
+		"metric, map[host:unknown region:us size:invalid], 1, g\n":      1,
+	}, mock.Invocations)
+	assert.Equal(t, Tags{"user_id": "1", "user_email": "a@b", "proj": "1", "host": "web-12", "size": "50"}, tags,
+		"the caller's tags aren't modified")
+}
+
+func TestRelabelSinkHashTag(t *testing.T) {
+	sink, mock := newTestRelabelSink(t, RelabelRule{Action: RelabelHashTag, Tag: "user", Buckets: 4})
+
+	for _, user := range []string{"a", "b", "c", "d", "e", "f", "g", "h", "a"} {
+		sink.Handle("metric", Tags{"user": user}, 1, metricTypeCounter)
+	}
+	assert.True(t, len(mock.Invocations) <= 4)
+	total := 0
+	for _, n := range mock.Invocations {
+		total += n
+	}
+	assert.Equal(t, 9, total)
+}
+
+func TestRelabelSinkEvents(t *testing.T) {
+	sink, mock := newTestRelabelSink(t,
+		RelabelRule{Action: RelabelRename, Pattern: "events", Replacement: "service.events"},
+		RelabelRule{Action: RelabelDrop, Pattern: "noisy_check"},
+	)
+
+	r := NewReceiver(sink)
+	r.Event(Event{Title: "deploy"})
+	r.ServiceCheck("noisy_check", ServiceCheckOK, "")
+	r.ServiceCheck("check", ServiceCheckWarning, "")
+
+	assert.Equal(t, map[string]int{
+		"service.events, map[alert_type:info], 1, ct\n": 1,
+		"check, map[], 1, g\n":                          1,
+	}, mock.Invocations)
+}
+
+func TestNewRelabelSinkInvalidRules(t *testing.T) {
+	for _, rule := range []RelabelRule{
+		{Action: "replace"},
+		{Action: RelabelRename, Pattern: "("},
+		{Action: RelabelHashTag, Tag: "user"},
+		{Action: RelabelBucketTag, Tag: "size"},
+		{Action: RelabelRenameTag, Tag: "a"},
+		{Action: RelabelRewriteTag, Pattern: "a"},
+	} {
+		_, err := NewRelabelSink(NewMockSink(), []RelabelRule{rule})
+		assert.Error(t, err, "%+v", rule)
+	}
+}
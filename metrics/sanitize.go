@@ -0,0 +1,102 @@
+package metrics
+
+import (
+	"strings"
+	"sync/atomic"
+)
+
+// sanitizeRules are the characters a sink can't write in metric names, tag keys and tag values without corrupting
+// its output. Each is replaced by an underscore.
+type sanitizeRules struct {
+	name, tagKey, tagValue string
+}
+
+var (
+	// statsdSanitizeRules keep names and tags from being split at the separators of the statsd line format. Tag values
+	// can contain colons, since a tag is split at its first one.
+	statsdSanitizeRules = sanitizeRules{
+		name:     ":|@# \t\r\n",
+		tagKey:   ":,|# \t\r\n",
+		tagValue: ",| \t\r\n",
+	}
+	// wavefrontSanitizeRules keep names and tag keys from being split at spaces or equals signs. Tag values are
+	// quoted, so only newlines have to go, and quotes are escaped by writeTags.
+	wavefrontSanitizeRules = sanitizeRules{
+		name:     "\" \t\r\n",
+		tagKey:   "=\" \t\r\n",
+		tagValue: "\r\n",
+	}
+)
+
+func sanitizeString(s, invalid string) string {
+	if !strings.ContainsAny(s, invalid) {
+		return s
+	}
+	return strings.Map(func(r rune) rune {
+		if strings.ContainsRune(invalid, r) {
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// sanitizer applies a sink's sanitizeRules to every metric it handles. In strict mode, metrics that break the rules
+// are dropped and counted instead.
+type sanitizer struct {
+	rules  sanitizeRules
+	strict bool
+	// invalid counts the metrics dropped in strict mode. Sinks report it through themselves on every flush.
+	invalid int64
+}
+
+// sanitize returns metric and tags with every invalid character replaced, copying tags only if they change, or false
+// if the metric is invalid and the sanitizer is strict.
+func (s *sanitizer) sanitize(metric string, tags Tags) (string, Tags, bool) {
+	name := sanitizeString(metric, s.rules.name)
+	valid := name == metric
+
+	var sanitized Tags
+	for k, v := range tags {
+		key, value := sanitizeString(k, s.rules.tagKey), sanitizeString(v, s.rules.tagValue)
+		if key == k && value == v {
+			continue
+		}
+		valid = false
+		if s.strict {
+			break
+		}
+		if sanitized == nil {
+			sanitized = make(Tags, len(tags))
+			for k, v := range tags {
+				sanitized[k] = v
+			}
+		}
+		delete(sanitized, k)
+		sanitized[key] = value
+	}
+
+	if valid {
+		return metric, tags, true
+	}
+	if s.strict {
+		atomic.AddInt64(&s.invalid, 1)
+		return "", nil, false
+	}
+	if sanitized == nil {
+		sanitized = tags
+	}
+	return name, sanitized, true
+}
+
+// sanitizeValue sanitizes a value written as text, like that of a set, with the rules for tag values.
+func (s *sanitizer) sanitizeValue(value string) (string, bool) {
+	sanitized := sanitizeString(value, s.rules.tagValue)
+	if sanitized == value {
+		return value, true
+	}
+	if s.strict {
+		atomic.AddInt64(&s.invalid, 1)
+		return "", false
+	}
+	return sanitized, true
+}
@@ -0,0 +1,38 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatTagsRoundTrip(t *testing.T) {
+	tags := Tags{"a:b": "c,d", "e|f": "g%3A", "h": ""}
+	parsed, err := ParseTags(FormatTags(tags))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string(tags), parsed)
+}
+
+func TestSanitizer(t *testing.T) {
+	s := &sanitizer{rules: statsdSanitizeRules}
+	tags := Tags{"ok": "fine"}
+	metric, sanitized, ok := s.sanitize("test.metric", tags)
+	assert.True(t, ok)
+	assert.Equal(t, "test.metric", metric)
+	assert.Equal(t, tags, sanitized)
+
+	tags = Tags{"a key": "x|y,z", "ok": "a:b"}
+	metric, sanitized, ok = s.sanitize("test:metric|1", tags)
+	assert.True(t, ok)
+	assert.Equal(t, "test_metric_1", metric)
+	assert.Equal(t, Tags{"a_key": "x_y_z", "ok": "a:b"}, sanitized)
+	// the caller's tags are left alone
+	assert.Equal(t, Tags{"a key": "x|y,z", "ok": "a:b"}, tags)
+
+	s.strict = true
+	_, _, ok = s.sanitize("test.metric", Tags{"a": "new\nline"})
+	assert.False(t, ok)
+	_, ok = s.sanitizeValue("a|b")
+	assert.False(t, ok)
+	assert.Equal(t, int64(2), s.invalid)
+}
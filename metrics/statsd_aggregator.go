@@ -0,0 +1,125 @@
+package metrics
+
+import (
+	"bytes"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// statsdAggregator aggregates metrics in process between flushes of the statsd sink, so that each series is written
+// once per flush rather than once per call: counters are summed, gauges keep their last value, and the values of stats
+// and distributions are collected to be sent as multi-value lines.
+type statsdAggregator struct {
+	mutex  sync.Mutex // protects everything below
+	series map[string]*statsdSeries
+	key    []byte
+	keys   []string
+}
+
+type statsdSeries struct {
+	metric     string
+	tags       Tags
+	metricType metricType
+	sampleRate float64
+	value      float64   // the sum of a counter or last value of a gauge
+	values     []float64 // the values of a stat or distribution
+}
+
+func newStatsdAggregator() *statsdAggregator {
+	return &statsdAggregator{series: make(map[string]*statsdSeries)}
+}
+
+func (a *statsdAggregator) add(metric string, tags Tags, value float64, metricType metricType, sampleRate float64) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	// the key is built in a reused buffer, so that updating an existing series doesn't allocate
+	a.key = append(a.key[:0], metric...)
+	a.key = append(a.key, '|')
+	a.key = append(a.key, string(metricType)...)
+	if metricType == metricTypeStat || metricType == metricTypeDistribution {
+		// stats are sent with their sample rate, so series sampled at different rates can't be merged
+		a.key = append(a.key, '@')
+		a.key = strconv.AppendFloat(a.key, sampleRate, 'g', -1, 64)
+	}
+	a.key = append(a.key, '|')
+	a.keys = a.keys[:0]
+	for k := range tags {
+		a.keys = append(a.keys, k)
+	}
+	sort.Strings(a.keys)
+	for _, k := range a.keys {
+		a.key = append(a.key, k...)
+		a.key = append(a.key, ':')
+		a.key = append(a.key, tags[k]...)
+		a.key = append(a.key, ',')
+	}
+
+	s, ok := a.series[string(a.key)]
+	if !ok {
+		s = &statsdSeries{metric: metric, tags: tags, metricType: metricType, sampleRate: 1}
+		a.series[string(a.key)] = s
+	}
+	switch metricType {
+	case metricTypeCounter:
+		// the sum is sent unsampled, so scale the sampled increments up to estimate it
+		s.value += value / sampleRate
+	case metricTypeStat, metricTypeDistribution:
+		s.values = append(s.values, value)
+		s.sampleRate = sampleRate
+	default:
+		s.value = value
+	}
+}
+
+// flush writes a line for every series aggregated since the last flush, and starts aggregating afresh. The values
+// of stats are split over as many lines as needed to keep each within maxPayloadSize. It returns the number of lines
+// dropped because they didn't fit even with a single value.
+func (a *statsdAggregator) flush(maxPayloadSize int, writeLine func([]byte)) int {
+	a.mutex.Lock()
+	series := a.series
+	a.series = make(map[string]*statsdSeries, len(series))
+	a.mutex.Unlock()
+
+	dropped := 0
+	line, suffix := &bytes.Buffer{}, &bytes.Buffer{}
+	for _, s := range series {
+		// metric:value1:value2|type|@sample_rate|#tag1:value1,tag2:value2
+		suffix.Reset()
+		_, _ = suffix.WriteString("|")
+		_, _ = suffix.WriteString(string(s.metricType))
+		if s.sampleRate < 1 {
+			_, _ = suffix.WriteString("|@")
+			_, _ = suffix.WriteString(strconv.FormatFloat(s.sampleRate, 'g', -1, 64))
+		}
+		writeStatsdTags(suffix, s.tags)
+
+		values := s.values
+		if values == nil {
+			values = []float64{s.value}
+		}
+		writeValues := func() {
+			_, _ = line.Write(suffix.Bytes())
+			if line.Len() > maxPayloadSize {
+				dropped++
+			} else {
+				writeLine(line.Bytes())
+			}
+			line.Reset()
+		}
+		for _, value := range values {
+			formatted := strconv.FormatFloat(value, 'g', -1, 64)
+			if line.Len() > 0 && line.Len()+1+len(formatted)+suffix.Len() > maxPayloadSize {
+				writeValues()
+			}
+			if line.Len() == 0 {
+				_, _ = line.WriteString(s.metric)
+			}
+			_, _ = line.WriteString(":")
+			_, _ = line.WriteString(formatted)
+		}
+		writeValues()
+	}
+	return dropped
+}
@@ -0,0 +1,130 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	minStatsdBackoff = 100 * time.Millisecond
+	maxStatsdBackoff = 10 * time.Second
+	// statsdWriteTimeout bounds how long a write to a stalled stream transport can hold up the flusher.
+	statsdWriteTimeout = time.Second
+)
+
+var errStatsdDisconnected = errors.New("not connected to statsd")
+
+// statsdConn is a connection to statsd that redials with exponential backoff after it fails. Packets written to a
+// stream transport are terminated by a newline, so that the last line of one packet isn't merged with the first line
+// of the next.
+type statsdConn struct {
+	network         string
+	address         string
+	writeBufferSize int
+	// writeTimeout is statsdWriteTimeout unless it's set.
+	writeTimeout time.Duration
+
+	conn     net.Conn
+	backoff  time.Duration
+	nextDial time.Time
+}
+
+// parseStatsdAddress splits an address like tcp://host:port or unix:///path/to/socket into a network and address
+// for net.Dial. Addresses without a scheme are UDP.
+func parseStatsdAddress(addr string) (network, address string, err error) {
+	split := strings.SplitN(addr, "://", 2)
+	if len(split) == 1 {
+		return "udp", addr, nil
+	}
+	switch split[0] {
+	case "udp", "tcp", "unix", "unixgram":
+		if split[1] == "" {
+			return "", "", fmt.Errorf("missing address in statsd address %q", addr)
+		}
+		return split[0], split[1], nil
+	default:
+		return "", "", fmt.Errorf("unknown network %q in statsd address %q", split[0], addr)
+	}
+}
+
+func (c *statsdConn) stream() bool {
+	return c.network == "tcp" || c.network == "unix"
+}
+
+func (c *statsdConn) dial() error {
+	if c.network == "" {
+		return errors.New("cannot reconnect to statsd")
+	}
+	conn, err := net.Dial(c.network, c.address)
+	if err != nil {
+		return err
+	}
+	if c.writeBufferSize > 0 {
+		if wb, ok := conn.(interface{ SetWriteBuffer(int) error }); ok {
+			if err := wb.SetWriteBuffer(c.writeBufferSize); err != nil {
+				log.Printf("error setting statsd write buffer size to %d: %v", c.writeBufferSize, err)
+			}
+		}
+	}
+	c.conn = conn
+	return nil
+}
+
+// disconnect closes the connection, and waits for the current backoff before dialing again.
+func (c *statsdConn) disconnect() {
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+	if c.backoff == 0 {
+		c.backoff = minStatsdBackoff
+	} else if c.backoff *= 2; c.backoff > maxStatsdBackoff {
+		c.backoff = maxStatsdBackoff
+	}
+	c.nextDial = time.Now().Add(c.backoff)
+}
+
+// Write writes a packet to statsd, reconnecting first if the connection previously failed and the backoff has
+// elapsed. The packet is dropped if it can't be written in time, and the connection is treated as broken, since part
+// of the packet may have been written.
+func (c *statsdConn) Write(packet []byte) error {
+	if c.conn == nil {
+		if time.Now().Before(c.nextDial) {
+			return errStatsdDisconnected
+		}
+		if err := c.dial(); err != nil {
+			c.disconnect()
+			return fmt.Errorf("error while connecting to statsd at %s://%s: %v", c.network, c.address, err)
+		}
+	}
+
+	if c.stream() {
+		packet = append(packet, '\n')
+	}
+	timeout := c.writeTimeout
+	if timeout == 0 {
+		timeout = statsdWriteTimeout
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(timeout))
+	n, err := c.conn.Write(packet)
+	if err == nil && n < len(packet) {
+		err = fmt.Errorf("wrote %d of %d bytes", n, len(packet))
+	}
+	if err != nil {
+		c.disconnect()
+		return fmt.Errorf("error while writing to statsd: %v", err)
+	}
+	c.backoff = 0
+	return nil
+}
+
+func (c *statsdConn) Close() error {
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.Close()
+}
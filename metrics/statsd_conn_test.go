@@ -0,0 +1,157 @@
+package metrics
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseStatsdAddress(t *testing.T) {
+	for addr, expected := range map[string][2]string{
+		"127.0.0.1:8125":              {"udp", "127.0.0.1:8125"},
+		"udp://127.0.0.1:8125":        {"udp", "127.0.0.1:8125"},
+		"tcp://statsd:8125":           {"tcp", "statsd:8125"},
+		"unix:///var/run/statsd.sock": {"unix", "/var/run/statsd.sock"},
+		"unixgram:///tmp/statsd.sock": {"unixgram", "/tmp/statsd.sock"},
+	} {
+		network, address, err := parseStatsdAddress(addr)
+		assert.NoError(t, err, addr)
+		assert.Equal(t, expected, [2]string{network, address}, addr)
+	}
+
+	for _, addr := range []string{"http://statsd:8125", "tcp://"} {
+		_, _, err := parseStatsdAddress(addr)
+		assert.Error(t, err, addr)
+	}
+	_, err := NewStatsdSink("quic://statsd:8125")
+	assert.Error(t, err)
+}
+
+func tempSocketPath(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "statsd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "statsd.sock"), func() { os.RemoveAll(dir) }
+}
+
+func TestStatsdSinkTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer listener.Close()
+
+	sink, err := NewStatsdSink("tcp://"+listener.Addr().String(), WithWriteBufferSize(1<<16))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer sink.Close()
+
+	conn, err := listener.Accept()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	sink.Handle("a", nil, 1, metricTypeCounter)
+	sink.Flush()
+	sink.Handle("b", nil, 2, metricTypeCounter)
+	sink.Flush()
+
+	// every packet ends with a newline, so lines from consecutive packets aren't merged
+	r := bufio.NewReader(conn)
+	var lines []string
+	for i := 0; i < 4; i++ {
+		line, err := r.ReadString('\n')
+		if !assert.NoError(t, err) {
+			return
+		}
+		lines = append(lines, line)
+	}
+	assert.Equal(t, []string{"a:1|ct\n", "obs.statsd.queued:1|ct\n", "b:2|ct\n", "obs.statsd.queued:1|ct\n"}, lines)
+}
+
+func TestStatsdSinkUnixgram(t *testing.T) {
+	path, cleanup := tempSocketPath(t)
+	defer cleanup()
+
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	sink, err := NewStatsdSink("unixgram://" + path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer sink.Close()
+
+	sink.Handle("a", nil, 1, metricTypeGauge)
+	sink.Flush()
+
+	assert.Equal(t, []string{"a:1|g\nobs.statsd.queued:1|ct"}, readPackets(conn))
+}
+
+func TestStatsdConnReconnect(t *testing.T) {
+	path, cleanup := tempSocketPath(t)
+	defer cleanup()
+
+	c := &statsdConn{network: "unix", address: path}
+	assert.Error(t, c.Write([]byte("a:1|ct")), "nothing is listening yet")
+	assert.Equal(t, minStatsdBackoff, c.backoff)
+	assert.Equal(t, errStatsdDisconnected, c.Write([]byte("a:1|ct")), "still backing off")
+
+	assert.Error(t, c.dial())
+	c.disconnect()
+	assert.Equal(t, 2*minStatsdBackoff, c.backoff)
+
+	listener, err := net.Listen("unix", path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer listener.Close()
+
+	c.nextDial = time.Now()
+	assert.NoError(t, c.Write([]byte("a:1|ct")))
+	assert.Equal(t, time.Duration(0), c.backoff)
+	defer c.Close()
+
+	conn, err := listener.Accept()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "a:1|ct\n", line)
+}
+
+func TestStatsdConnWriteTimeout(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer listener.Close()
+
+	c := &statsdConn{network: "tcp", address: listener.Addr().String(), writeTimeout: 50 * time.Millisecond}
+	defer c.Close()
+
+	// the listener never reads, so writes fail once the socket buffers are full
+	packet := make([]byte, 1<<16)
+	start := time.Now()
+	for err == nil && time.Since(start) < 10*time.Second {
+		err = c.Write(packet)
+	}
+	assert.Error(t, err)
+	assert.Nil(t, c.conn, "a timed out connection is closed")
+	assert.Equal(t, minStatsdBackoff, c.backoff)
+	assert.Equal(t, errStatsdDisconnected, c.Write(packet), "and isn't redialed until the backoff has elapsed")
+}
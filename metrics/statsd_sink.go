@@ -6,67 +6,286 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/mixpanel/obs/util"
 )
 
-var batchSizeBytes = 4096
+// DefaultMaxPayloadSize keeps statsd packets within a 1500 byte Ethernet MTU once IP and UDP headers are added,
+// leaving room for tunneling overhead.
+const DefaultMaxPayloadSize = 1432
+
+// OverflowPolicy decides what the statsd sink does with a metric when its queue is full because it can't write to
+// statsd fast enough.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock blocks the caller until there is room in the queue.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropNewest drops the metric being reported. This is the default.
+	OverflowDropNewest
+	// OverflowDropOldest drops the oldest queued metric to make room for the one being reported.
+	OverflowDropOldest
+)
+
+// StatsdOption configures NewStatsdSink.
+type StatsdOption func(*statsdSink)
+
+// WithOverflowPolicy sets what happens to metrics reported while the queue is full.
+func WithOverflowPolicy(policy OverflowPolicy) StatsdOption {
+	return func(sink *statsdSink) {
+		sink.overflow = policy
+	}
+}
+
+// WithMaxPayloadSize sets the maximum size of a packet sent to statsd, DefaultMaxPayloadSize by default. Metrics
+// are packed into packets a whole line at a time, and metrics longer than a packet are rejected.
+func WithMaxPayloadSize(size int) StatsdOption {
+	return func(sink *statsdSink) {
+		sink.maxPayloadSize = size
+	}
+}
+
+// WithWriteBufferSize sets the socket's send buffer size (SO_SNDBUF) in bytes, which lets bursts of metrics queue in
+// the kernel rather than being dropped.
+func WithWriteBufferSize(size int) StatsdOption {
+	return func(sink *statsdSink) {
+		sink.conn.writeBufferSize = size
+	}
+}
+
+// WithAggregation aggregates counters, gauges, stats and distributions in process, and writes one line per series on
+// every flush instead of one per call: counters are summed, gauges keep their last value, and stats and distributions
+// are sent as multi-value lines like name:1:2:3|h. Sets, events and service checks are still queued one at a time.
+func WithAggregation() StatsdOption {
+	return func(sink *statsdSink) {
+		sink.aggregator = newStatsdAggregator()
+	}
+}
+
+// WithStrictSanitization drops metrics whose name, tags or set value contain characters that would corrupt the
+// statsd line, and counts them as obs.statsd.invalid, instead of replacing those characters with underscores.
+func WithStrictSanitization() StatsdOption {
+	return func(sink *statsdSink) {
+		sink.sanitizer.strict = true
+	}
+}
+
+// WithQueueSize sets how many metrics can be queued for the background writer, 128 by default.
+func WithQueueSize(size int) StatsdOption {
+	return func(sink *statsdSink) {
+		sink.metrics = make(chan *bytes.Buffer, size)
+	}
+}
 
 type statsdSink struct {
-	metrics       chan *bytes.Buffer
-	flushes       chan struct{}
-	wg            *sync.WaitGroup
-	conn          net.Conn
-	flushInterval time.Duration
+	metrics        chan *bytes.Buffer
+	overflow       OverflowPolicy
+	maxPayloadSize int
+	flushes        chan chan struct{}
+	done           chan struct{}
+	wg             *sync.WaitGroup
+	conn           *statsdConn
+	flushInterval  time.Duration
+	aggregator     *statsdAggregator
+	sanitizer      sanitizer
+
+	// queued and dropped count the metrics accepted into and dropped from the queue, and dropped also counts
+	// aggregated lines that didn't fit in a packet. They're reported through the sink itself as obs.statsd.queued and
+	// obs.statsd.dropped on every flush, along with the metrics dropped by a strict sanitizer as obs.statsd.invalid.
+	queued, dropped int64
 }
 
-func (sink *statsdSink) Handle(metric string, tags Tags, value float64, metricType metricType) (err error) {
-	buf := util.SharedBufferPool.Get()
-	defer func() {
-		if err != nil {
-			util.SharedBufferPool.Put(buf)
-		}
-	}()
+func (sink *statsdSink) Handle(metric string, tags Tags, value float64, metricType metricType) error {
+	return sink.HandleSampled(metric, tags, value, metricType, 1)
+}
 
+func (sink *statsdSink) HandleSampled(metric string, tags Tags, value float64, metricType metricType, sampleRate float64) error {
 	if len(metric) == 0 {
 		return errors.New("cannot handle empty metric")
 	}
+	metric, tags, ok := sink.sanitizer.sanitize(metric, tags)
+	if !ok {
+		return nil
+	}
+
+	if sink.aggregator != nil {
+		sink.aggregator.add(metric, tags, value, metricType, sampleRate)
+		return nil
+	}
 
-	// metric:value|type|#tag1:value1,tag2:value2
+	buf := util.SharedBufferPool.Get()
+	writeStatsdMetric(buf, metric, tags, value, metricType, sampleRate)
+	return sink.enqueue(buf)
+}
+
+func writeStatsdMetric(buf *bytes.Buffer, metric string, tags Tags, value float64, metricType metricType, sampleRate float64) {
+	// metric:value|type|@sample_rate|#tag1:value1,tag2:value2
 	// we use buf.WriteString instead of Fprintf because it's faster
 	// as per documentation, WriteString never returns an error, so we ignore it here
 	_, _ = buf.WriteString(metric)
 	_, _ = buf.WriteString(":")
-	if _, err := fmt.Fprintf(buf, "%g", value); err != nil {
-		return err
-	}
+	_, _ = buf.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
 	_, _ = buf.WriteString("|")
 	_, _ = buf.WriteString(string(metricType))
+	if sampleRate < 1 {
+		_, _ = buf.WriteString("|@")
+		_, _ = buf.WriteString(strconv.FormatFloat(sampleRate, 'g', -1, 64))
+	}
+	writeStatsdTags(buf, tags)
+}
 
-	if len(tags) > 0 {
-		if _, err := buf.WriteString("|#"); err != nil {
-			return err
+// enqueue hands a formatted metric to the flusher, applying the overflow policy if the queue is full.
+func (sink *statsdSink) enqueue(buf *bytes.Buffer) error {
+	if buf.Len() > sink.maxPayloadSize {
+		err := fmt.Errorf("statsd line of %d bytes doesn't fit in a %d byte packet: %.64s...", buf.Len(), sink.maxPayloadSize, buf.Bytes())
+		util.SharedBufferPool.Put(buf)
+		return err
+	}
+
+	switch sink.overflow {
+	case OverflowDropNewest:
+		select {
+		case sink.metrics <- buf:
+		default:
+			atomic.AddInt64(&sink.dropped, 1)
+			util.SharedBufferPool.Put(buf)
+			return nil
 		}
-		numTags := len(tags)
-		for k, v := range tags {
-			_, _ = buf.WriteString(k)
-			_, _ = buf.WriteString(":")
-			_, _ = buf.WriteString(v)
-			numTags--
-			if numTags > 0 {
-				_, _ = buf.WriteString(",")
+	case OverflowDropOldest:
+		for queued := false; !queued; {
+			select {
+			case sink.metrics <- buf:
+				queued = true
+			default:
+				select {
+				case oldest := <-sink.metrics:
+					atomic.AddInt64(&sink.dropped, 1)
+					util.SharedBufferPool.Put(oldest)
+				default:
+				}
 			}
 		}
+	default:
+		sink.metrics <- buf
 	}
-
-	sink.metrics <- buf
+	atomic.AddInt64(&sink.queued, 1)
 	return nil
 }
 
+func (sink *statsdSink) HandleSet(metric string, tags Tags, value string) error {
+	if len(metric) == 0 {
+		return errors.New("cannot handle empty metric")
+	}
+	metric, tags, ok := sink.sanitizer.sanitize(metric, tags)
+	if !ok {
+		return nil
+	}
+	if value, ok = sink.sanitizer.sanitizeValue(value); !ok {
+		return nil
+	}
+
+	// metric:value|s|#tag1:value1,tag2:value2
+	buf := util.SharedBufferPool.Get()
+	_, _ = buf.WriteString(metric)
+	_, _ = buf.WriteString(":")
+	_, _ = buf.WriteString(value)
+	_, _ = buf.WriteString("|s")
+	writeStatsdTags(buf, tags)
+
+	return sink.enqueue(buf)
+}
+
+func (sink *statsdSink) HandleEvent(event Event, tags Tags) error {
+	if len(event.Title) == 0 {
+		return errors.New("cannot handle event without a title")
+	}
+	// events are named by their title, which is escaped rather than sanitized
+	_, tags, ok := sink.sanitizer.sanitize("", tags)
+	if !ok {
+		return nil
+	}
+
+	// _e{title.length,text.length}:title|text|d:timestamp|p:priority|k:aggregation_key|s:source_type|t:alert_type|#tags
+	title := statsdEscaper.Replace(event.Title)
+	text := statsdEscaper.Replace(event.Text)
+	buf := util.SharedBufferPool.Get()
+	fmt.Fprintf(buf, "_e{%d,%d}:%s|%s", len(title), len(text), title, text)
+	if !event.Timestamp.IsZero() {
+		fmt.Fprintf(buf, "|d:%d", event.Timestamp.Unix())
+	}
+	writeStatsdField(buf, "p", event.Priority)
+	writeStatsdField(buf, "k", event.AggregationKey)
+	writeStatsdField(buf, "s", event.SourceType)
+	writeStatsdField(buf, "t", event.AlertType)
+	writeStatsdTags(buf, tags)
+
+	return sink.enqueue(buf)
+}
+
+func (sink *statsdSink) HandleServiceCheck(name string, tags Tags, status ServiceCheckStatus, message string) error {
+	if len(name) == 0 {
+		return errors.New("cannot handle service check without a name")
+	}
+	name, tags, ok := sink.sanitizer.sanitize(name, tags)
+	if !ok {
+		return nil
+	}
+
+	// _sc|name|status|#tags|m:message, where the message has to come last
+	buf := util.SharedBufferPool.Get()
+	_, _ = buf.WriteString("_sc|")
+	_, _ = buf.WriteString(name)
+	_, _ = buf.WriteString("|")
+	_, _ = buf.WriteString(strconv.Itoa(int(status)))
+	writeStatsdTags(buf, tags)
+	writeStatsdField(buf, "m", statsdEscaper.Replace(message))
+
+	return sink.enqueue(buf)
+}
+
+// statsdEscaper escapes the newlines that would otherwise split an event or service check into several lines.
+var statsdEscaper = strings.NewReplacer("\r\n", "\\n", "\n", "\\n")
+
+func writeStatsdField(buf *bytes.Buffer, key, value string) {
+	if len(value) == 0 {
+		return
+	}
+	_, _ = buf.WriteString("|")
+	_, _ = buf.WriteString(key)
+	_, _ = buf.WriteString(":")
+	_, _ = buf.WriteString(value)
+}
+
+func writeStatsdTags(buf *bytes.Buffer, tags Tags) {
+	if len(tags) == 0 {
+		return
+	}
+	_, _ = buf.WriteString("|#")
+	numTags := len(tags)
+	for k, v := range tags {
+		_, _ = buf.WriteString(k)
+		_, _ = buf.WriteString(":")
+		_, _ = buf.WriteString(v)
+		numTags--
+		if numTags > 0 {
+			_, _ = buf.WriteString(",")
+		}
+	}
+}
+
+// Flush writes every metric handled so far to statsd, and waits until it's written.
 func (sink *statsdSink) Flush() error {
-	sink.flushes <- struct{}{}
+	flushed := make(chan struct{})
+	select {
+	case sink.flushes <- flushed:
+		<-flushed
+	case <-sink.done:
+	}
 	return nil
 }
 
@@ -80,86 +299,145 @@ func (sink *statsdSink) flusher() {
 
 	nextFlush := time.After(sink.flushInterval)
 
-	buffer := &bytes.Buffer{}
-	flushBuffer := func() error {
-		data := buffer.Next(buffer.Len())
-		buffer.Reset()
-		for written := 0; written < len(data); {
-			n, err := sink.conn.Write(data[written:])
-			if err != nil {
-				log.Printf("error while writing to statsd: %v", err)
-				return err
+	// lines are packed into packets of up to maxPayloadSize bytes, separated by newlines
+	packet := &bytes.Buffer{}
+	packetLines := 0
+	writePacket := func() {
+		if packet.Len() == 0 {
+			return
+		}
+		if err := sink.conn.Write(packet.Bytes()); err != nil {
+			if err != errStatsdDisconnected {
+				log.Print(err)
 			}
-			written += n
+			atomic.AddInt64(&sink.dropped, int64(packetLines))
 		}
-		return nil
+		packet.Reset()
+		packetLines = 0
+	}
+	writeLine := func(line []byte) {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > sink.maxPayloadSize {
+			writePacket()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.Write(line)
+		packetLines++
+	}
+	writeStat := func(stat *bytes.Buffer) {
+		writeLine(stat.Bytes())
+		util.SharedBufferPool.Put(stat)
+	}
+
+	// drain writes every metric queued so far, then the aggregated series and the internal metrics, and flushes them.
+	var reportedQueued, reportedDropped, reportedInvalid int64
+	internal := &bytes.Buffer{}
+	drain := func() {
+		for pending := len(sink.metrics); pending > 0; pending-- {
+			// callers dropping the oldest metric can empty the queue under us, so don't block on it
+			select {
+			case stat := <-sink.metrics:
+				writeStat(stat)
+			default:
+			}
+		}
+		if sink.aggregator != nil {
+			atomic.AddInt64(&sink.dropped, int64(sink.aggregator.flush(sink.maxPayloadSize, writeLine)))
+		}
+		queued, dropped := atomic.LoadInt64(&sink.queued), atomic.LoadInt64(&sink.dropped)
+		if queued > reportedQueued {
+			internal.Reset()
+			writeStatsdMetric(internal, "obs.statsd.queued", nil, float64(queued-reportedQueued), metricTypeCounter, 1)
+			writeLine(internal.Bytes())
+			reportedQueued = queued
+		}
+		if dropped > reportedDropped {
+			internal.Reset()
+			writeStatsdMetric(internal, "obs.statsd.dropped", nil, float64(dropped-reportedDropped), metricTypeCounter, 1)
+			writeLine(internal.Bytes())
+			reportedDropped = dropped
+		}
+		if invalid := atomic.LoadInt64(&sink.sanitizer.invalid); invalid > reportedInvalid {
+			internal.Reset()
+			writeStatsdMetric(internal, "obs.statsd.invalid", nil, float64(invalid-reportedInvalid), metricTypeCounter, 1)
+			writeLine(internal.Bytes())
+			reportedInvalid = invalid
+		}
+		writePacket()
 	}
 
 	for {
 		select {
 		case stat := <-sink.metrics:
-			writeStatToBuffer(stat, buffer)
-			if buffer.Len() >= batchSizeBytes {
-				flushBuffer()
-			}
-		case _, ok := <-sink.flushes:
-			if !ok {
-				// drain the metrics channel
-				for {
-					select {
-					case stat := <-sink.metrics:
-						writeStatToBuffer(stat, buffer)
-					default:
-						flushBuffer()
-						return
-					}
-				}
-			}
-			flushBuffer()
+			writeStat(stat)
+		case flushed := <-sink.flushes:
+			drain()
+			close(flushed)
+		case <-sink.done:
+			drain()
+			return
 		case _ = <-nextFlush:
-			flushBuffer()
+			drain()
 			nextFlush = time.After(sink.flushInterval)
 		}
 	}
 }
 
-func writeStatToBuffer(stat, buffer *bytes.Buffer) {
-	_, _ = stat.WriteTo(buffer)
-	_, _ = buffer.WriteString("\n")
-	util.SharedBufferPool.Put(stat)
-}
-
 func (sink *statsdSink) Close() {
-	close(sink.flushes)
+	close(sink.done)
 	sink.wg.Wait()
 }
 
-func newStatsdSinkFromConn(conn net.Conn) (Sink, error) {
+func newStatsdSinkFromConn(conn net.Conn, opts ...StatsdOption) (Sink, error) {
+	return newStatsdSink(&statsdConn{conn: conn}, opts...), nil
+}
+
+func newStatsdSink(conn *statsdConn, opts ...StatsdOption) *statsdSink {
 	wg := &sync.WaitGroup{}
 	sink := &statsdSink{
-		metrics:       make(chan *bytes.Buffer, 128),
-		flushes:       make(chan struct{}),
-		wg:            wg,
-		conn:          conn,
-		flushInterval: 5 * time.Second,
+		metrics:        make(chan *bytes.Buffer, 128),
+		overflow:       OverflowDropNewest,
+		maxPayloadSize: DefaultMaxPayloadSize,
+		flushes:        make(chan chan struct{}),
+		done:           make(chan struct{}),
+		wg:             wg,
+		conn:           conn,
+		flushInterval:  5 * time.Second,
+		sanitizer:      sanitizer{rules: statsdSanitizeRules},
+	}
+	for _, opt := range opts {
+		opt(sink)
+	}
+
+	if conn.conn == nil {
+		if err := conn.dial(); err != nil {
+			log.Printf("error while connecting to statsd at %s://%s, will retry: %v", conn.network, conn.address, err)
+			conn.disconnect()
+		}
 	}
 
 	wg.Add(1)
 	go sink.flusher()
 
-	return sink, nil
+	return sink
 }
 
 // NewStatsdSink returns a Sink for statsd
-// pass the address of the statsd daemon to it
-func NewStatsdSink(addr string) (Sink, error) {
+// pass the address of the statsd daemon to it, either host:port for UDP
+// or a udp://host:port, tcp://host:port, unix:///path or unixgram:///path URL.
+// Metrics are written by a background goroutine, and by default are
+// dropped rather than blocking the caller when it falls behind.
+// If statsd can't be reached, metrics are dropped while the sink
+// reconnects with exponential backoff.
+func NewStatsdSink(addr string, opts ...StatsdOption) (Sink, error) {
 	if addr == "" {
 		return &nullSink{}, nil
 	}
-	conn, err := net.Dial("udp", addr)
+	network, address, err := parseStatsdAddress(addr)
 	if err != nil {
 		return nil, err
 	}
 
-	return newStatsdSinkFromConn(conn)
+	return newStatsdSink(&statsdConn{network: network, address: address}, opts...), nil
 }
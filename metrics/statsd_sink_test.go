@@ -0,0 +1,250 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func queuedStats(sink *statsdSink) []string {
+	var stats []string
+	for len(sink.metrics) > 0 {
+		stats = append(stats, (<-sink.metrics).String())
+	}
+	return stats
+}
+
+func TestStatsdSinkOverflowDropNewest(t *testing.T) {
+	sink := &statsdSink{metrics: make(chan *bytes.Buffer, 2), overflow: OverflowDropNewest, maxPayloadSize: DefaultMaxPayloadSize}
+	sink.Handle("a", nil, 1, metricTypeCounter)
+	sink.Handle("b", nil, 1, metricTypeCounter)
+	sink.Handle("c", nil, 1, metricTypeCounter)
+
+	assert.Equal(t, []string{"a:1|ct", "b:1|ct"}, queuedStats(sink))
+	assert.Equal(t, int64(2), atomic.LoadInt64(&sink.queued))
+	assert.Equal(t, int64(1), atomic.LoadInt64(&sink.dropped))
+}
+
+func TestStatsdSinkOverflowDropOldest(t *testing.T) {
+	sink := &statsdSink{metrics: make(chan *bytes.Buffer, 2), overflow: OverflowDropOldest, maxPayloadSize: DefaultMaxPayloadSize}
+	sink.Handle("a", nil, 1, metricTypeCounter)
+	sink.Handle("b", nil, 1, metricTypeCounter)
+	sink.Handle("c", nil, 1, metricTypeCounter)
+
+	assert.Equal(t, []string{"b:1|ct", "c:1|ct"}, queuedStats(sink))
+	assert.Equal(t, int64(3), atomic.LoadInt64(&sink.queued))
+	assert.Equal(t, int64(1), atomic.LoadInt64(&sink.dropped))
+}
+
+func TestStatsdSinkOverflowBlock(t *testing.T) {
+	sink := &statsdSink{metrics: make(chan *bytes.Buffer, 1), overflow: OverflowBlock, maxPayloadSize: DefaultMaxPayloadSize}
+	sink.Handle("a", nil, 1, metricTypeCounter)
+
+	handled := make(chan struct{})
+	go func() {
+		sink.Handle("b", nil, 1, metricTypeCounter)
+		close(handled)
+	}()
+
+	select {
+	case <-handled:
+		t.Fatal("Handle should block while the queue is full")
+	case <-time.After(10 * time.Millisecond):
+	}
+	assert.Equal(t, "a:1|ct", (<-sink.metrics).String())
+	<-handled
+	assert.Equal(t, []string{"b:1|ct"}, queuedStats(sink))
+}
+
+func TestStatsdSinkFlushWaitsForWrite(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	sink, err := NewStatsdSink(conn.LocalAddr().String(), WithQueueSize(1))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer sink.Close()
+
+	sink.Handle("test", nil, 1, metricTypeCounter)
+	assert.NoError(t, sink.Flush())
+
+	// the data must already have been written, so a short deadline is enough
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	var received []string
+	buf := make([]byte, 64000)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		received = append(received, strings.Split(strings.TrimSpace(string(buf[:n])), "\n")...)
+	}
+	assert.Contains(t, received, "test:1|ct")
+	assert.Contains(t, received, "obs.statsd.queued:1|ct")
+}
+
+func newUDPTestSink(t *testing.T, opts ...StatsdOption) (Sink, net.PacketConn) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink, err := NewStatsdSink(conn.LocalAddr().String(), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sink, conn
+}
+
+func readPackets(conn net.PacketConn) []string {
+	var packets []string
+	buf := make([]byte, 64000)
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return packets
+		}
+		packets = append(packets, string(buf[:n]))
+	}
+}
+
+func TestStatsdSinkPacking(t *testing.T) {
+	sink, conn := newUDPTestSink(t, WithMaxPayloadSize(32))
+	defer conn.Close()
+	defer sink.Close()
+
+	// every line is 12 bytes, so two of them fit in a 32 byte packet with their separator
+	for i := 0; i < 7; i++ {
+		sink.Handle(fmt.Sprintf("metric_%d", i), nil, 1, metricTypeGauge)
+	}
+	sink.Flush()
+
+	packets := readPackets(conn)
+	assert.Equal(t, []string{
+		"metric_0:1|g\nmetric_1:1|g",
+		"metric_2:1|g\nmetric_3:1|g",
+		"metric_4:1|g\nmetric_5:1|g",
+		"metric_6:1|g",
+		"obs.statsd.queued:7|ct",
+	}, packets)
+	for _, packet := range packets {
+		assert.True(t, len(packet) <= 32)
+	}
+}
+
+func TestStatsdSinkOversizedLine(t *testing.T) {
+	sink, conn := newUDPTestSink(t, WithMaxPayloadSize(16))
+	defer conn.Close()
+	defer sink.Close()
+
+	assert.Error(t, sink.Handle("a_very_long_metric_name", nil, 1, metricTypeCounter))
+	assert.NoError(t, sink.Handle("short", nil, 1, metricTypeCounter))
+	sink.Flush()
+
+	packets := readPackets(conn)
+	if assert.NotEmpty(t, packets) {
+		assert.Equal(t, "short:1|ct", packets[0])
+	}
+}
+
+func readLines(conn net.PacketConn) []string {
+	var lines []string
+	for _, packet := range readPackets(conn) {
+		lines = append(lines, strings.Split(packet, "\n")...)
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+func TestStatsdSinkAggregation(t *testing.T) {
+	s, conn := newUDPTestSink(t, WithAggregation())
+	defer conn.Close()
+	defer s.Close()
+	sink := s.(*statsdSink)
+
+	tags := Tags{"aKey": "aValue"}
+	for i := 0; i < 3; i++ {
+		sink.Handle("counter", tags, 2, metricTypeCounter)
+	}
+	sink.Handle("counter", nil, 1, metricTypeCounter)
+	sink.HandleSampled("sampled", nil, 1, metricTypeCounter, 0.5)
+	sink.Handle("gauge", tags, 1, metricTypeGauge)
+	sink.Handle("gauge", tags, 2, metricTypeGauge)
+	for i := 1; i <= 3; i++ {
+		sink.Handle("stat", nil, float64(i), metricTypeStat)
+	}
+	sink.HandleSampled("stat", nil, 4, metricTypeStat, 0.1)
+	sink.Handle("distribution", nil, 1.5, metricTypeDistribution)
+	sink.HandleSet("set", nil, "a")
+	sink.Flush()
+
+	assert.Equal(t, []string{
+		"counter:1|ct",
+		"counter:6|ct|#aKey:aValue",
+		"distribution:1.5|d",
+		"gauge:2|g|#aKey:aValue",
+		"obs.statsd.queued:1|ct",
+		"sampled:2|ct",
+		"set:a|s",
+		"stat:1:2:3|h",
+		"stat:4|h|@0.1",
+	}, readLines(conn))
+
+	// series start afresh after every flush
+	sink.Handle("counter", nil, 1, metricTypeCounter)
+	sink.Flush()
+	assert.Equal(t, []string{"counter:1|ct"}, readLines(conn))
+}
+
+func TestStatsdSinkAggregationSplitsStats(t *testing.T) {
+	sink, conn := newUDPTestSink(t, WithAggregation(), WithMaxPayloadSize(16))
+	defer conn.Close()
+	defer sink.Close()
+
+	for i := 1; i <= 7; i++ {
+		sink.Handle("stat", nil, float64(i), metricTypeStat)
+	}
+	sink.Handle("a_very_long_metric_name", nil, 1, metricTypeGauge)
+	sink.Flush()
+
+	assert.Equal(t, []string{"obs.statsd.dropped:1|ct", "stat:1:2:3:4:5|h", "stat:6:7|h"}, readLines(conn))
+}
+
+func TestStatsdSinkSanitization(t *testing.T) {
+	sink, conn := newUDPTestSink(t)
+	defer conn.Close()
+	defer sink.Close()
+
+	sink.Handle("test:metric", Tags{"a,b": "c|d e:f"}, 1, metricTypeCounter)
+	sink.(setSink).HandleSet("test.set", nil, "a|b")
+	sink.Flush()
+
+	assert.Equal(t, []string{
+		"obs.statsd.queued:2|ct",
+		"test.set:a_b|s",
+		"test_metric:1|ct|#a_b:c_d_e:f",
+	}, readLines(conn))
+}
+
+func TestStatsdSinkStrictSanitization(t *testing.T) {
+	sink, conn := newUDPTestSink(t, WithStrictSanitization())
+	defer conn.Close()
+	defer sink.Close()
+
+	sink.Handle("test.metric", Tags{"a": "new\nline"}, 1, metricTypeCounter)
+	sink.Handle("test.metric", nil, 1, metricTypeCounter)
+	sink.Flush()
+
+	assert.Equal(t, []string{"obs.statsd.invalid:1|ct", "obs.statsd.queued:1|ct", "test.metric:1|ct"}, readLines(conn))
+}
@@ -14,9 +14,10 @@ type metricType string
 type Tags map[string]string
 
 const (
-	metricTypeCounter = metricType("ct")
-	metricTypeStat    = metricType("h")
-	metricTypeGauge   = metricType("g")
+	metricTypeCounter      = metricType("ct")
+	metricTypeStat         = metricType("h")
+	metricTypeGauge        = metricType("g")
+	metricTypeDistribution = metricType("d")
 )
 
 func formatName(prefix string, name string) string {
@@ -27,6 +28,13 @@ func formatName(prefix string, name string) string {
 	return formatted + name
 }
 
+var (
+	// tagEscaper percent-encodes the separators of formatted tags, and the | that separates them from the metric name
+	// in keys like "name|tags", so that any key or value survives ParseTags.
+	tagEscaper   = strings.NewReplacer("%", "%25", ",", "%2C", ":", "%3A", "|", "%7C")
+	tagUnescaper = strings.NewReplacer("%25", "%", "%2C", ",", "%3A", ":", "%7C", "|")
+)
+
 // FormatTags is used by receivers and sinks to convert a map of tags into a string that can be
 // used as a map key
 func FormatTags(tags Tags) string {
@@ -39,7 +47,7 @@ func FormatTags(tags Tags) string {
 	formatted := ""
 
 	for _, key := range keys {
-		formatted += key + ":" + tags[key] + ","
+		formatted += tagEscaper.Replace(key) + ":" + tagEscaper.Replace(tags[key]) + ","
 	}
 
 	return formatted
@@ -56,7 +64,7 @@ func ParseTags(tagString string) (map[string]string, error) {
 			if len(entry) != 2 {
 				return nil, errors.New("incorrectly formatted tag: " + pair)
 			}
-			tags[entry[0]] = entry[1]
+			tags[tagUnescaper.Replace(entry[0])] = tagUnescaper.Replace(entry[1])
 		}
 	}
 	return tags, nil
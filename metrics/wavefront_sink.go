@@ -5,46 +5,231 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"math"
 	"math/rand"
 	"net"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	_metrics "github.com/mixpanel/obs/go-metrics"
 	"github.com/mixpanel/obs/util"
+
+	"github.com/jonboulle/clockwork"
+)
+
+const (
+	defaultWavefrontFlushInterval = 5 * time.Second
+	defaultWavefrontMaxBufferSize = 8 << 20
+
+	minWavefrontBackoff = time.Second
+	maxWavefrontBackoff = time.Minute
+	wavefrontTimeout    = 10 * time.Second
+)
+
+// WavefrontGranularity is the interval wavefront aggregates histogram distributions over.
+type WavefrontGranularity string
+
+const (
+	// WavefrontMinute aggregates distributions by the minute. This is the default.
+	WavefrontMinute WavefrontGranularity = "!M"
+	// WavefrontHour aggregates distributions by the hour.
+	WavefrontHour WavefrontGranularity = "!H"
+)
+
+// WavefrontOption configures NewWavefrontSink.
+type WavefrontOption func(*wavefrontSink)
+
+// WithWavefrontFlushInterval sets how often points are sent to wavefront in the background, 5 seconds by default.
+// A flush that fails is retried with exponential backoff instead. Zero disables background flushing, leaving it to
+// callers of Flush.
+func WithWavefrontFlushInterval(interval time.Duration) WavefrontOption {
+	return func(sink *wavefrontSink) {
+		sink.flushInterval = interval
+	}
+}
+
+// WithWavefrontMaxBufferSize sets how many bytes of points are buffered until they're sent, 8MiB by default. Points
+// reported while the buffer is full are dropped.
+func WithWavefrontMaxBufferSize(size int) WavefrontOption {
+	return func(sink *wavefrontSink) {
+		sink.batch.maxSize = size
+	}
+}
+
+// WithWavefrontHistogramGranularity sets the interval wavefront aggregates the distributions of stats over.
+func WithWavefrontHistogramGranularity(granularity WavefrontGranularity) WavefrontOption {
+	return func(sink *wavefrontSink) {
+		sink.granularity = granularity
+	}
+}
+
+// WithWavefrontStrictSanitization drops points whose name or tags contain characters that would corrupt the line,
+// and counts them as obs.wavefront.invalid_points, instead of replacing those characters with underscores.
+func WithWavefrontStrictSanitization() WavefrontOption {
+	return func(sink *wavefrontSink) {
+		sink.sanitizer.strict = true
+	}
+}
+
+// The queues of a wavefront sink's batchBuffer. Delta counters and histogram distributions are sent apart from other
+// points, since wavefront adds them up, so they mustn't be sent twice.
+const (
+	wavefrontPoints = iota
+	wavefrontAdditive
+	wavefrontQueues
 )
 
 type wavefrontSink struct {
-	origin    string
-	tags      map[string]string
-	hostPorts []string
-	mutex     sync.Mutex // protects buffer and closed
-	buffer    *bytes.Buffer
-	closed    bool
+	origin        string
+	tags          map[string]string
+	flushInterval time.Duration
+	granularity   WavefrontGranularity
+	sanitizer     sanitizer
+	mutex         sync.Mutex // protects batch, sets, histograms, closed and the counters
+	batch         batchBuffer
+	sets          map[string]*wavefrontSet
+	histograms    map[string]*wavefrontHistogram
+	closed        bool
+
+	// bytesSent and failedFlushes are reported through the sink itself as obs.wavefront.bytes_sent and
+	// obs.wavefront.failed_flushes on every flush, along with the points dropped by the batch buffer as
+	// obs.wavefront.dropped_points and by a strict sanitizer as obs.wavefront.invalid_points.
+	bytesSent, failedFlushes                                              int64
+	reportedBytesSent, reportedFailures, reportedDropped, reportedInvalid int64
+
+	sendMutex sync.Mutex // serializes flushes, and protects hosts and current
+	hosts     []*wavefrontHost
+	current   int
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// wavefrontSet holds the distinct values added to a set since the last flush.
+type wavefrontSet struct {
+	metric string
+	tags   Tags
+	values map[string]struct{}
+}
+
+// wavefrontHistogram holds a digest of the values of a stat since the last flush.
+type wavefrontHistogram struct {
+	metric string
+	tags   Tags
+	sample *_metrics.TDigestSample
+}
+
+// wavefrontHost is a persistent connection to a wavefront proxy. A host that fails isn't used again until its
+// backoff has elapsed, unless every other host is failing too.
+type wavefrontHost struct {
+	address string
+	conn    net.Conn
+	backoff time.Duration
+	retryAt time.Time
 }
 
+// wavefrontTagValueEscaper escapes the quotes and backslashes in tag values, which are written quoted.
+var wavefrontTagValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
 func writeTags(buf *bytes.Buffer, tags Tags) {
 	for k, v := range tags {
 		buf.WriteString(k)
 		buf.WriteString("=\"")
-		buf.WriteString(v)
+		buf.WriteString(wavefrontTagValueEscaper.Replace(v))
 		buf.WriteString("\" ")
 	}
 }
 
+// Handle writes counters as delta counters, which wavefront sums across sources, and adds stats to histogram
+// distributions, so that wavefront can compute percentiles across sources rather than averaging percentiles computed
+// by each. Counters that are decremented are written as plain points, since delta counters can only increase.
 func (sink *wavefrontSink) Handle(metric string, tags Tags, value float64, metricType metricType) error {
 	if len(metric) == 0 {
 		return errors.New("cannot handle empty metric")
 	}
+	metric, tags, ok := sink.sanitizer.sanitize(metric, tags)
+	if !ok {
+		return nil
+	}
+
+	if metricType == metricTypeStat || metricType == metricTypeDistribution {
+		return sink.handleHistogram(metric, tags, value)
+	}
 
 	buf := util.SharedBufferPool.Get()
 	defer util.SharedBufferPool.Put(buf)
+	queue := wavefrontPoints
+	if metricType == metricTypeCounter && value > 0 {
+		sink.writeDelta(buf, metric, tags, value)
+		queue = wavefrontAdditive
+	} else {
+		sink.writeLine(buf, metric, tags, value)
+	}
+
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+
+	if sink.closed {
+		return errors.New("sink is closed")
+	}
+	sink.batch.add(queue, buf)
+	return nil
+}
+
+func (sink *wavefrontSink) handleHistogram(metric string, tags Tags, value float64) error {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
 
+	if sink.closed {
+		return errors.New("sink is closed")
+	}
+	key := metric + "|" + FormatTags(tags)
+	histogram, ok := sink.histograms[key]
+	if !ok {
+		histogram = &wavefrontHistogram{
+			metric: metric,
+			tags:   tags,
+			sample: _metrics.NewTDigestSample(time.Hour, clockwork.NewRealClock()),
+		}
+		sink.histograms[key] = histogram
+	}
+	histogram.sample.UpdateFloat64(value)
+	return nil
+}
+
+func (sink *wavefrontSink) writeLine(buf *bytes.Buffer, metric string, tags Tags, value float64) {
 	// wavefront format: <metricName> <metricValue> [optionalTimestampInEpochSeconds] host=<host> [tag1=value1 tag2=value2 ... ]
 	_, _ = buf.WriteString(metric)
 	_, _ = buf.WriteString(" ")
-	if _, err := fmt.Fprintf(buf, "%0.6f %d ", value, time.Now().Unix()); err != nil {
-		return err
+	_, _ = fmt.Fprintf(buf, "%0.6f %d ", value, time.Now().Unix())
+	sink.writeSource(buf, tags)
+}
+
+func (sink *wavefrontSink) writeDelta(buf *bytes.Buffer, metric string, tags Tags, value float64) {
+	// delta counters have no timestamp, since wavefront aggregates them as they arrive:
+	// ∆<metricName> <metricValue> host=<host> [tag1=value1 tag2=value2 ... ]
+	_, _ = buf.WriteString("∆")
+	_, _ = buf.WriteString(metric)
+	_, _ = fmt.Fprintf(buf, " %0.6f ", value)
+	sink.writeSource(buf, tags)
+}
+
+func (sink *wavefrontSink) writeHistogram(buf *bytes.Buffer, histogram *wavefrontHistogram) {
+	// !M <timestampInEpochSeconds> #<count> <mean> [#<count> <mean> ...] <metricName> host=<host> [tag1=value1 ...]
+	_, _ = buf.WriteString(string(sink.granularity))
+	_, _ = fmt.Fprintf(buf, " %d ", time.Now().Unix())
+	for _, centroid := range histogram.sample.Centroids() {
+		_, _ = fmt.Fprintf(buf, "#%d %0.6f ", int64(math.Round(centroid.Weight)), centroid.Mean)
 	}
+	_, _ = buf.WriteString(histogram.metric)
+	_, _ = buf.WriteString(" ")
+	sink.writeSource(buf, histogram.tags)
+}
+
+// writeSource ends a line with the host and tags of a point.
+func (sink *wavefrontSink) writeSource(buf *bytes.Buffer, tags Tags) {
 	_, _ = buf.WriteString("host=")
 	_, _ = buf.WriteString(sink.origin)
 	_, _ = buf.WriteString(" ")
@@ -60,6 +245,18 @@ func (sink *wavefrontSink) Handle(metric string, tags Tags, value float64, metri
 	writeTags(buf, sinkTagsToWrite)
 
 	buf.WriteString("\n")
+}
+
+// HandleSet reports the number of distinct values added to a set since the last flush, since wavefront can't count
+// distinct values itself.
+func (sink *wavefrontSink) HandleSet(metric string, tags Tags, value string) error {
+	if len(metric) == 0 {
+		return errors.New("cannot handle empty metric")
+	}
+	metric, tags, ok := sink.sanitizer.sanitize(metric, tags)
+	if !ok {
+		return nil
+	}
 
 	sink.mutex.Lock()
 	defer sink.mutex.Unlock()
@@ -67,65 +264,237 @@ func (sink *wavefrontSink) Handle(metric string, tags Tags, value float64, metri
 	if sink.closed {
 		return errors.New("sink is closed")
 	}
-	_, _ = buf.WriteTo(sink.buffer)
+	key := metric + "|" + FormatTags(tags)
+	set, ok := sink.sets[key]
+	if !ok {
+		set = &wavefrontSet{metric: metric, tags: tags, values: make(map[string]struct{})}
+		sink.sets[key] = set
+	}
+	set.values[value] = struct{}{}
 	return nil
 }
 
-func send(address string, data []byte) error {
-	toSend := bytes.NewBuffer(data)
-	conn, err := net.Dial("tcp", address)
+// write sends data over the host's connection, connecting first if necessary, and returns how many bytes were
+// written.
+func (host *wavefrontHost) write(data []byte) (int, error) {
+	if host.conn == nil {
+		conn, err := net.DialTimeout("tcp", host.address, wavefrontTimeout)
+		if err != nil {
+			host.fail()
+			return 0, fmt.Errorf("error while connecting to %s: %v", host.address, err)
+		}
+		host.conn = conn
+	}
+	host.conn.SetWriteDeadline(time.Now().Add(wavefrontTimeout))
+	n, err := host.conn.Write(data)
 	if err != nil {
-		e := fmt.Errorf("error while connecting to %s: %v", address, err)
-		log.Printf(e.Error())
-		return e
+		host.fail()
+		return n, fmt.Errorf("error while writing data to %s: %v", host.address, err)
 	}
-	defer conn.Close()
-	if _, err := toSend.WriteTo(conn); err != nil {
-		e := fmt.Errorf("error while writing data to %s: %v", address, err)
-		log.Printf(e.Error())
-		return e
+	host.backoff = 0
+	return n, nil
+}
+
+func (host *wavefrontHost) fail() {
+	if host.conn != nil {
+		host.conn.Close()
+		host.conn = nil
 	}
-	return nil
+	host.backoff = nextWavefrontBackoff(host.backoff)
+	host.retryAt = time.Now().Add(host.backoff)
+}
+
+func (host *wavefrontHost) healthy(now time.Time) bool {
+	return !now.Before(host.retryAt)
+}
+
+func nextWavefrontBackoff(backoff time.Duration) time.Duration {
+	if backoff == 0 {
+		return minWavefrontBackoff
+	}
+	if backoff *= 2; backoff > maxWavefrontBackoff {
+		return maxWavefrontBackoff
+	}
+	return backoff
+}
+
+// send writes data to the current host, failing over to the others in turn. Healthy hosts are tried before failing
+// ones. Timestamped points may be sent twice if a connection fails part way through a write, which wavefront
+// tolerates since points with the same timestamp overwrite each other. Delta counters and histogram distributions are
+// added up instead, so if atMostOnce is set, send gives up after a partial write and returns partial rather than risk sending
+// some of them twice.
+func (sink *wavefrontSink) send(data []byte, atMostOnce bool) (partial bool, err error) {
+	if len(sink.hosts) == 0 {
+		return false, errors.New("no wavefront hosts to send to")
+	}
+	now := time.Now()
+	healthy := make([]bool, len(sink.hosts))
+	for i, host := range sink.hosts {
+		healthy[i] = host.healthy(now)
+	}
+
+	for _, pass := range []bool{true, false} {
+		for i := 0; i < len(sink.hosts); i++ {
+			idx := (sink.current + i) % len(sink.hosts)
+			host := sink.hosts[idx]
+			if healthy[idx] != pass {
+				continue
+			}
+			var n int
+			if n, err = host.write(data); err == nil {
+				sink.current = idx
+				return false, nil
+			}
+			log.Print(err)
+			if atMostOnce && n > 0 {
+				return true, err
+			}
+		}
+	}
+	return false, err
+}
+
+// writeInternalMetrics writes the changes to the internal counters since they were last reported.
+func (sink *wavefrontSink) writeInternalMetrics() {
+	invalid := atomic.LoadInt64(&sink.sanitizer.invalid)
+	reportInternalCounters(func(metric string, change float64) {
+		sink.writeDelta(sink.batch.queues[wavefrontAdditive], metric, nil, change)
+	},
+		internalCounter{"obs.wavefront.bytes_sent", &sink.bytesSent, &sink.reportedBytesSent},
+		internalCounter{"obs.wavefront.failed_flushes", &sink.failedFlushes, &sink.reportedFailures},
+		internalCounter{"obs.wavefront.dropped_points", &sink.batch.dropped, &sink.reportedDropped},
+		internalCounter{"obs.wavefront.invalid_points", &invalid, &sink.reportedInvalid},
+	)
 }
 
+// Flush sends every buffered point to wavefront, then every delta counter and histogram. If no host can be reached,
+// they're kept to be sent by the next flush, unless the buffer has filled up in the meantime. Delta counters and
+// histograms that may have been partly sent are dropped instead.
 func (sink *wavefrontSink) Flush() error {
+	sink.sendMutex.Lock()
+	defer sink.sendMutex.Unlock()
+
+	buf := util.SharedBufferPool.Get()
+	defer util.SharedBufferPool.Put(buf)
 	sink.mutex.Lock()
-	sendBuffer := &bytes.Buffer{}
-	sink.buffer.WriteTo(sendBuffer)
-	sink.buffer.Reset()
+	for _, set := range sink.sets {
+		sink.writeLine(buf, set.metric, set.tags, float64(len(set.values)))
+		sink.batch.add(wavefrontPoints, buf)
+	}
+	sink.sets = make(map[string]*wavefrontSet)
+	for _, histogram := range sink.histograms {
+		sink.writeHistogram(buf, histogram)
+		sink.batch.add(wavefrontAdditive, buf)
+	}
+	sink.histograms = make(map[string]*wavefrontHistogram)
+	sink.writeInternalMetrics()
+	batch := sink.batch.take()
 	sink.mutex.Unlock()
 
-	if sendBuffer.Len() == 0 {
-		return nil
+	sendPoints, sendAdditive := batch[wavefrontPoints], batch[wavefrontAdditive]
+	var err, additiveErr error
+	var partial bool
+	if sendPoints.Len() > 0 {
+		_, err = sink.send(sendPoints.Bytes(), false)
+	}
+	// once the points have failed, the rest would fail too, so it's kept for the next flush without trying
+	if sendAdditive.Len() > 0 && err == nil {
+		partial, additiveErr = sink.send(sendAdditive.Bytes(), true)
 	}
 
-	var err error
-
-	idx := rand.Intn(len(sink.hostPorts))
-	for i := 0; i < len(sink.hostPorts); i++ {
-		if err = send(sink.hostPorts[idx], sendBuffer.Bytes()); err == nil {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	if err == nil {
+		sink.bytesSent += int64(sendPoints.Len())
+		err = additiveErr
+		if err == nil {
+			sink.bytesSent += int64(sendAdditive.Len())
 			return nil
 		}
-		idx = (idx + 1) % len(sink.hostPorts)
+		sendPoints.Reset()
 	}
-
+	sink.failedFlushes++
+	if partial {
+		sink.batch.drop(sendAdditive)
+	}
+	sink.batch.requeue(batch)
 	return err
 }
 
+// flusher flushes the sink every flushInterval, or sooner with exponential backoff after a flush fails.
+func (sink *wavefrontSink) flusher() {
+	defer sink.wg.Done()
+
+	var backoff time.Duration
+	timer := time.NewTimer(sink.flushInterval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-sink.done:
+			return
+		case <-timer.C:
+			if err := sink.Flush(); err != nil {
+				backoff = nextWavefrontBackoff(backoff)
+				timer.Reset(backoff)
+			} else {
+				backoff = 0
+				timer.Reset(sink.flushInterval)
+			}
+		}
+	}
+}
+
 func (sink *wavefrontSink) Close() {
 	sink.mutex.Lock()
+	if sink.closed {
+		sink.mutex.Unlock()
+		return
+	}
 	sink.closed = true
 	sink.mutex.Unlock()
 
+	close(sink.done)
+	sink.wg.Wait()
 	sink.Flush()
+
+	sink.sendMutex.Lock()
+	defer sink.sendMutex.Unlock()
+	for _, host := range sink.hosts {
+		if host.conn != nil {
+			host.conn.Close()
+			host.conn = nil
+		}
+	}
 }
 
-// NewWavefrontSink returns a sink for wavefront.
-func NewWavefrontSink(origin string, tags map[string]string, hostPorts []string) Sink {
-	return &wavefrontSink{
-		origin:    origin,
-		tags:      tags,
-		hostPorts: hostPorts,
-		buffer:    &bytes.Buffer{},
+// NewWavefrontSink returns a sink for wavefront. Counters are sent as delta counters and stats as histogram
+// distributions. Points are buffered and sent in the background over a persistent
+// connection to one of the proxies at hostPorts, failing over to the others when it fails.
+func NewWavefrontSink(origin string, tags map[string]string, hostPorts []string, opts ...WavefrontOption) Sink {
+	sink := &wavefrontSink{
+		origin:        origin,
+		tags:          tags,
+		flushInterval: defaultWavefrontFlushInterval,
+		batch:         newBatchBuffer(defaultWavefrontMaxBufferSize, wavefrontQueues),
+		sets:          make(map[string]*wavefrontSet),
+		histograms:    make(map[string]*wavefrontHistogram),
+		granularity:   WavefrontMinute,
+		sanitizer:     sanitizer{rules: wavefrontSanitizeRules},
+		done:          make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(sink)
+	}
+	for _, hostPort := range hostPorts {
+		sink.hosts = append(sink.hosts, &wavefrontHost{address: hostPort})
+	}
+	if len(sink.hosts) > 0 {
+		sink.current = rand.Intn(len(sink.hosts))
+	}
+
+	if sink.flushInterval > 0 {
+		sink.wg.Add(1)
+		go sink.flusher()
 	}
+	return sink
 }
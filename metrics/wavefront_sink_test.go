@@ -2,12 +2,16 @@ package metrics
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"math/rand"
 	"net"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -16,12 +20,13 @@ func testWavefrontSinkWithoutTags(sink Sink, endpoint *tcpEndpoint, t *testing.T
 	endpoint.wg.Add(1)
 	go newServer(endpoint)
 
-	sink.Handle("test.metric", nil, 10, "ct")
+	sink.Handle("test.metric", nil, 10, "g")
 	assert.Nil(t, sink.Flush())
+	sink.Close()
 
 	endpoint.wg.Wait()
 
-	split := strings.Split(strings.TrimSpace(string(endpoint.buf.Bytes())), " ")
+	split := strings.Split(endpoint.lines()[0], " ")
 
 	assert.Equal(t, len(split), 4)
 	assert.Equal(t, "test.metric", split[0])
@@ -48,12 +53,13 @@ func TestWavefrontSinkWithTags(t *testing.T) {
 		"c": "d",
 	}
 
-	sink.Handle("test.metric", tags, 10, "ct")
+	sink.Handle("test.metric", tags, 10, "g")
 	sink.Flush()
+	sink.Close()
 
 	endpoint.wg.Wait()
 
-	split := strings.Split(strings.TrimSpace(string(endpoint.buf.Bytes())), " ")
+	split := strings.Split(endpoint.lines()[0], " ")
 
 	assert.Equal(t, len(split), 7)
 	assert.Equal(t, "test.metric", split[0])
@@ -73,6 +79,116 @@ func TestWavefrontSinkWithTags(t *testing.T) {
 	assert.True(t, mp[split[6]])
 }
 
+func TestWavefrontSinkSet(t *testing.T) {
+	endpoint := newTCPEndpoint()
+	endpoint.wg.Add(1)
+	go newServer(endpoint)
+
+	sink := newSink(endpoint.address)
+	r := NewReceiver(sink)
+	r.AddToSet("test.set", "a")
+	r.AddToSet("test.set", "b")
+	r.AddToSet("test.set", "a")
+	r.AddDistribution("test.distribution", 3)
+	assert.Nil(t, r.(Flusher).Flush())
+	sink.Close()
+
+	endpoint.wg.Wait()
+
+	lines := endpoint.lines()
+	if assert.Len(t, lines, 2) {
+		assert.True(t, strings.HasPrefix(lines[0], "test.set 2.000000 "))
+		assert.True(t, strings.HasPrefix(lines[1], "!M "))
+		assert.Contains(t, lines[1], " #1 3.000000 test.distribution host=localhost")
+	}
+}
+
+func TestWavefrontSinkDeltaCounter(t *testing.T) {
+	endpoint := newTCPEndpoint()
+	endpoint.wg.Add(1)
+	go newServer(endpoint)
+
+	sink := newSink(endpoint.address)
+	sink.Handle("test.counter", Tags{"a": "b"}, 2, "ct")
+	sink.Handle("test.counter", nil, -1, "ct")
+	assert.Nil(t, sink.Flush())
+	sink.Close()
+	endpoint.wg.Wait()
+
+	lines := endpoint.lines()
+	// delta counters are sent after the points
+	if assert.Len(t, lines, 2) {
+		assert.True(t, strings.HasPrefix(lines[0], "test.counter -1.000000 "))
+		assert.Equal(t, "∆test.counter 2.000000 host=localhost a=\"b\"", lines[1])
+	}
+}
+
+func TestWavefrontSinkHistogram(t *testing.T) {
+	endpoint := newTCPEndpoint()
+	endpoint.wg.Add(1)
+	go newServer(endpoint)
+
+	sink := NewWavefrontSink("localhost", nil, []string{endpoint.address}, WithWavefrontHistogramGranularity(WavefrontHour))
+	tags := Tags{"a": "b"}
+	for _, value := range []float64{1, 2, 2, 3} {
+		sink.Handle("test.latency", tags, value, "h")
+	}
+	assert.Nil(t, sink.Flush())
+	// histograms start afresh after every flush
+	sink.Handle("test.latency", tags, 5, "h")
+	assert.Nil(t, sink.Flush())
+	sink.Close()
+	endpoint.wg.Wait()
+
+	lines := endpoint.lines()
+	if assert.Len(t, lines, 2) {
+		for _, line := range lines {
+			assert.True(t, strings.HasPrefix(line, "!H "))
+			assert.True(t, strings.HasSuffix(line, " test.latency host=localhost a=\"b\""))
+		}
+
+		var count int64
+		var sum float64
+		for _, centroid := range regexp.MustCompile(`#(\d+) (\S+)`).FindAllStringSubmatch(lines[0], -1) {
+			weight, _ := strconv.ParseInt(centroid[1], 10, 64)
+			mean, _ := strconv.ParseFloat(centroid[2], 64)
+			count += weight
+			sum += float64(weight) * mean
+		}
+		assert.Equal(t, int64(4), count)
+		assert.Equal(t, 8.0, sum)
+		assert.Contains(t, lines[1], " #1 5.000000 test.latency ")
+	}
+}
+
+func TestWavefrontSinkHistogramFractions(t *testing.T) {
+	endpoint := newTCPEndpoint()
+	endpoint.wg.Add(1)
+	go newServer(endpoint)
+
+	sink := newSink(endpoint.address)
+	for _, value := range []float64{0.25, 0.25, 0.5} {
+		sink.Handle("test.latency", nil, value, "h")
+	}
+	assert.Nil(t, sink.Flush())
+	sink.Close()
+	endpoint.wg.Wait()
+
+	lines := endpoint.lines()
+	if assert.Len(t, lines, 1) {
+		var count int64
+		var sum float64
+		for _, centroid := range regexp.MustCompile(`#(\d+) (\S+)`).FindAllStringSubmatch(lines[0], -1) {
+			weight, _ := strconv.ParseInt(centroid[1], 10, 64)
+			mean, _ := strconv.ParseFloat(centroid[2], 64)
+			count += weight
+			sum += float64(weight) * mean
+		}
+		assert.Equal(t, int64(3), count)
+		assert.InDelta(t, 1.0, sum, 1e-6)
+	}
+}
+
 func TestWavefrontSinkRetrySuccess(t *testing.T) {
 	rand.Seed(1)
 	endpoint := newTCPEndpoint()
@@ -96,6 +212,188 @@ func TestWavefrontSinkRetryError(t *testing.T) {
 	assert.NotNil(t, sink.Flush())
 }
 
+func TestWavefrontSinkPersistentConnection(t *testing.T) {
+	endpoint := newTCPEndpoint()
+	accepted := make(chan int)
+	go func() {
+		n := 0
+		for {
+			conn, err := endpoint.listener.Accept()
+			if err != nil {
+				accepted <- n
+				return
+			}
+			n++
+			go endpoint.buf.ReadFrom(conn)
+		}
+	}()
+
+	sink := newSink(endpoint.address)
+	for i := 0; i < 3; i++ {
+		sink.Handle("test.metric", nil, 10, "ct")
+		assert.Nil(t, sink.Flush())
+	}
+	sink.Close()
+	endpoint.listener.Close()
+
+	assert.Equal(t, 1, <-accepted)
+}
+
+func TestWavefrontSinkBufferLimit(t *testing.T) {
+	sink := NewWavefrontSink("localhost", nil, nil, WithWavefrontMaxBufferSize(100)).(*wavefrontSink)
+	defer sink.Close()
+
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, sink.Handle("test.metric", nil, 10, "ct"))
+	}
+	assert.True(t, sink.batch.size() <= 100)
+	assert.Equal(t, int64(3), sink.batch.dropped)
+}
+
+func TestWavefrontSinkRequeue(t *testing.T) {
+	endpoint := newTCPEndpoint()
+	endpoint.listener.Close()
+
+	sink := NewWavefrontSink("localhost", nil, []string{endpoint.address}, WithWavefrontFlushInterval(0)).(*wavefrontSink)
+	sink.Handle("test.metric", nil, 10, "g")
+	assert.NotNil(t, sink.Flush())
+	assert.Equal(t, int64(1), sink.failedFlushes)
+	assert.True(t, strings.HasPrefix(sink.batch.queues[wavefrontPoints].String(), "test.metric 10.000000 "))
+
+	addr, _ := net.ResolveTCPAddr("tcp", endpoint.address)
+	listener, err := net.ListenTCP("tcp", addr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	endpoint.listener = listener
+	endpoint.wg.Add(1)
+	go newServer(endpoint)
+
+	// the only host is still backing off, so it's tried anyway
+	assert.Nil(t, sink.Flush())
+	sink.Close()
+	endpoint.wg.Wait()
+
+	lines := strings.Split(strings.TrimSpace(endpoint.buf.String()), "\n")
+	if assert.Len(t, lines, 3) {
+		assert.True(t, strings.HasPrefix(lines[0], "test.metric 10.000000 "))
+		assert.True(t, strings.HasPrefix(lines[1], "∆obs.wavefront.failed_flushes 1.000000 "))
+		assert.True(t, strings.HasPrefix(lines[2], "∆obs.wavefront.bytes_sent "))
+	}
+}
+
+// partialConn accepts half of the first write, then fails.
+type partialConn struct {
+	net.Conn
+	written []byte
+}
+
+func (c *partialConn) Write(b []byte) (int, error) {
+	c.written = append(c.written, b[:len(b)/2]...)
+	return len(b) / 2, errors.New("connection reset")
+}
+
+func (c *partialConn) SetWriteDeadline(time.Time) error { return nil }
+func (c *partialConn) Close() error                     { return nil }
+
+func TestWavefrontSinkPartialDeltaWrite(t *testing.T) {
+	sink := NewWavefrontSink("localhost", nil, []string{"127.0.0.1:1"}, WithWavefrontFlushInterval(0)).(*wavefrontSink)
+	conn := &partialConn{}
+	sink.hosts[0].conn = conn
+
+	sink.Handle("test.counter", nil, 1, "ct")
+	sink.Handle("test.counter", nil, 2, "ct")
+	assert.NotNil(t, sink.Flush())
+	assert.True(t, strings.HasPrefix(string(conn.written), "∆test.counter 1.000000 "))
+
+	// delta counters that may have been partly sent aren't sent again, so they're never counted twice
+	assert.Equal(t, 0, sink.batch.queues[wavefrontAdditive].Len())
+	assert.Equal(t, int64(2), sink.batch.dropped)
+	assert.Equal(t, int64(1), sink.failedFlushes)
+}
+
+func TestWavefrontSinkPartialHistogramWrite(t *testing.T) {
+	sink := NewWavefrontSink("localhost", nil, []string{"127.0.0.1:1"}, WithWavefrontFlushInterval(0)).(*wavefrontSink)
+	conn := &partialConn{}
+	sink.hosts[0].conn = conn
+
+	sink.Handle("test.latency", nil, 1, "h")
+	assert.NotNil(t, sink.Flush())
+	assert.True(t, strings.HasPrefix(string(conn.written), "!M "))
+
+	// wavefront merges distributions like delta counters, so they aren't sent again either
+	assert.Equal(t, 0, sink.batch.size())
+	assert.Equal(t, int64(1), sink.batch.dropped)
+}
+
+func TestWavefrontSinkFlushBufferLimit(t *testing.T) {
+	sink := NewWavefrontSink("localhost", nil, nil, WithWavefrontFlushInterval(0), WithWavefrontMaxBufferSize(10)).(*wavefrontSink)
+	defer sink.Close()
+
+	assert.Nil(t, sink.HandleSet("test.set", nil, "a"))
+	assert.Nil(t, sink.Handle("test.latency", nil, 1, "h"))
+	assert.NotNil(t, sink.Flush())
+	// the set and the histogram written by the flush were dropped, rather than exceed the buffer size
+	assert.Equal(t, int64(2), sink.reportedDropped)
+}
+
+func TestWavefrontSinkBackgroundFlush(t *testing.T) {
+	endpoint := newTCPEndpoint()
+	endpoint.wg.Add(1)
+	go newServer(endpoint)
+
+	sink := NewWavefrontSink("localhost", nil, []string{endpoint.address}, WithWavefrontFlushInterval(10*time.Millisecond))
+	sink.Handle("test.metric", nil, 10, "g")
+	time.Sleep(100 * time.Millisecond)
+
+	// stop the sink without flushing it, so the point must have been sent in the background
+	wf := sink.(*wavefrontSink)
+	close(wf.done)
+	wf.wg.Wait()
+	wf.hosts[0].conn.Close()
+	endpoint.wg.Wait()
+
+	assert.Equal(t, "test.metric", strings.Split(endpoint.lines()[0], " ")[0])
+}
+
+func TestWavefrontSinkSanitization(t *testing.T) {
+	endpoint := newTCPEndpoint()
+	endpoint.wg.Add(1)
+	go newServer(endpoint)
+
+	sink := newSink(endpoint.address)
+	sink.Handle("test metric", Tags{"a=b": `say "hi"` + "\n"}, 10, "g")
+	sink.Flush()
+	sink.Close()
+
+	endpoint.wg.Wait()
+
+	split := strings.Split(endpoint.lines()[0], " ")
+	assert.Equal(t, "test_metric", split[0])
+	assert.Equal(t, `a_b="say`, split[4])
+	assert.Equal(t, `\"hi\"_"`, split[5])
+}
+
+func TestWavefrontSinkStrictSanitization(t *testing.T) {
+	endpoint := newTCPEndpoint()
+	endpoint.wg.Add(1)
+	go newServer(endpoint)
+
+	sink := NewWavefrontSink("localhost", nil, []string{endpoint.address}, WithWavefrontStrictSanitization())
+	sink.Handle("test metric", nil, 10, "g")
+	sink.Handle("test.metric", nil, 10, "g")
+	sink.Flush()
+	sink.Close()
+
+	endpoint.wg.Wait()
+
+	lines := endpoint.lines()
+	if assert.Len(t, lines, 1) {
+		assert.True(t, strings.HasPrefix(lines[0], "test.metric "))
+	}
+	assert.Contains(t, endpoint.buf.String(), "∆obs.wavefront.invalid_points 1.000000 host=localhost")
+}
+
 type tcpEndpoint struct {
 	address  string
 	listener *net.TCPListener
@@ -114,6 +412,17 @@ func newServer(endpoint *tcpEndpoint) {
 	}
 }
 
+// lines returns the points received, without the sink's internal metrics.
+func (endpoint *tcpEndpoint) lines() []string {
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSpace(endpoint.buf.String()), "\n") {
+		if !strings.HasPrefix(line, "∆obs.wavefront.") {
+			lines = append(lines, strings.TrimSpace(line))
+		}
+	}
+	return lines
+}
+
 func newSink(address string) Sink {
 	return NewWavefrontSink("localhost", nil, []string{address})
 }
@@ -10,6 +10,8 @@ import (
 	"net/http"
 	"net/url"
 	"time"
+
+	"github.com/mixpanel/obs"
 )
 
 type Client interface {
@@ -60,6 +62,16 @@ func NewClient(token, apiKey, baseUrl string) Client {
 	}
 }
 
+// NewInstrumentedClient is like NewClient, but traces and counts its HTTP requests with fr.
+func NewInstrumentedClient(token, apiKey, baseUrl string, fr obs.FlightRecorder) Client {
+	return &client{
+		token:   token,
+		apiKey:  apiKey,
+		baseUrl: baseUrl,
+		api:     &http.Client{Transport: fr.ScopeName("mixpanel").HTTPRoundTripper(nil)},
+	}
+}
+
 func (c *client) TrackBatched(es []*TrackedEvent) error {
 	return c.track(es)
 }
@@ -0,0 +1,387 @@
+// Package obstest provides an in-memory FlightRecorder for testing the telemetry that code reports.
+package obstest
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mixpanel/obs"
+	"github.com/mixpanel/obs/logging"
+	"github.com/mixpanel/obs/metrics"
+
+	basictracer "github.com/opentracing/basictracer-go"
+	"github.com/stretchr/testify/assert"
+)
+
+// MetricType is the kind of a captured Metric.
+type MetricType string
+
+const (
+	Counter      = MetricType("counter")
+	Gauge        = MetricType("gauge")
+	Stat         = MetricType("stat")
+	Distribution = MetricType("distribution")
+	Set          = MetricType("set")
+	Event        = MetricType("event")
+	ServiceCheck = MetricType("service_check")
+)
+
+// Metric is a single metric reported to a Recorder. Events are named after their title, and the Value of a service
+// check is its status.
+type Metric struct {
+	Name  string
+	Type  MetricType
+	Tags  obs.Tags
+	Value float64
+	// Text is the value added to a Set, the text of an Event or the message of a ServiceCheck.
+	Text string
+}
+
+// LogEntry is a single log line reported to a Recorder.
+type LogEntry struct {
+	Level   string
+	Logger  string
+	Message string
+	Fields  logging.Fields
+}
+
+// Span is a finished span reported to a Recorder.
+type Span = basictracer.RawSpan
+
+// Recorder is a FlightRecorder that keeps every log line, metric and finished span in memory so that tests can
+// query and assert on them. All spans are sampled.
+type Recorder struct {
+	obs.FlightRecorder
+
+	mutex   sync.Mutex // protects metrics and logs
+	metrics []Metric
+	logs    []LogEntry
+
+	spans *basictracer.InMemorySpanRecorder
+}
+
+// New returns a new Recorder. Span names are not prefixed with a service name, so a span started with
+// rec.ScopeName("Service").WithNewSpan(ctx, "Method") is named "Service.Method".
+func New() *Recorder {
+	rec := &Recorder{
+		spans: basictracer.NewInMemoryRecorder(),
+	}
+
+	opts := basictracer.DefaultOptions()
+	opts.ShouldSample = func(traceID uint64) bool { return true }
+	opts.Recorder = rec.spans
+	tracer := basictracer.NewWithOptions(opts)
+
+	rec.FlightRecorder = obs.NewFlightRecorder("", &receiver{rec: rec}, &logger{rec: rec}, tracer)
+	return rec
+}
+
+// Reset forgets everything captured so far.
+func (rec *Recorder) Reset() {
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+	rec.metrics = nil
+	rec.logs = nil
+	rec.spans.Reset()
+}
+
+// Metrics returns every metric reported so far, in order.
+func (rec *Recorder) Metrics() []Metric {
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+	return append([]Metric(nil), rec.metrics...)
+}
+
+// MetricsNamed returns every metric of type mt named name reported with exactly the provided tags.
+// nil and empty tags are equivalent.
+func (rec *Recorder) MetricsNamed(name string, mt MetricType, tags obs.Tags) []Metric {
+	var res []Metric
+	for _, m := range rec.Metrics() {
+		if m.Name == name && m.Type == mt && tagsEqual(m.Tags, tags) {
+			res = append(res, m)
+		}
+	}
+	return res
+}
+
+// Counter returns the total of the counter named name with the provided tags.
+func (rec *Recorder) Counter(name string, tags obs.Tags) float64 {
+	total := 0.0
+	for _, m := range rec.MetricsNamed(name, Counter, tags) {
+		total += m.Value
+	}
+	return total
+}
+
+// Gauge returns the last value of the gauge named name with the provided tags, and whether it was ever set.
+func (rec *Recorder) Gauge(name string, tags obs.Tags) (float64, bool) {
+	ms := rec.MetricsNamed(name, Gauge, tags)
+	if len(ms) == 0 {
+		return 0, false
+	}
+	return ms[len(ms)-1].Value, true
+}
+
+// Stats returns every value added to the stat named name with the provided tags.
+func (rec *Recorder) Stats(name string, tags obs.Tags) []float64 {
+	var values []float64
+	for _, m := range rec.MetricsNamed(name, Stat, tags) {
+		values = append(values, m.Value)
+	}
+	return values
+}
+
+// Logs returns every log line reported so far, in order.
+func (rec *Recorder) Logs() []LogEntry {
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+	return append([]LogEntry(nil), rec.logs...)
+}
+
+// LogsAt returns every log line reported at level, which is one of DEBUG, INFO, WARN, ERROR or CRITICAL.
+func (rec *Recorder) LogsAt(level string) []LogEntry {
+	var res []LogEntry
+	for _, l := range rec.Logs() {
+		if l.Level == strings.ToUpper(level) {
+			res = append(res, l)
+		}
+	}
+	return res
+}
+
+// Spans returns every span finished so far, in the order they finished.
+func (rec *Recorder) Spans() []Span {
+	return rec.spans.GetSpans()
+}
+
+// SpansNamed returns the finished spans whose operation name is name, or ends with "." + name. For example,
+// SpansNamed("Service.Method") matches spans from a gRPC interceptor on a FlightRecorder scoped as "server".
+func (rec *Recorder) SpansNamed(name string) []Span {
+	var res []Span
+	for _, span := range rec.Spans() {
+		if span.Operation == name || strings.HasSuffix(span.Operation, "."+name) {
+			res = append(res, span)
+		}
+	}
+	return res
+}
+
+// AssertCounter asserts that the counter named name with the provided tags totals expected.
+func (rec *Recorder) AssertCounter(t testing.TB, name string, tags obs.Tags, expected float64) bool {
+	t.Helper()
+	return assert.Equal(t, expected, rec.Counter(name, tags), "counter %s%s\n%s", name, formatTags(tags), rec.describeMetrics())
+}
+
+// AssertGauge asserts that the last value of the gauge named name with the provided tags is expected.
+func (rec *Recorder) AssertGauge(t testing.TB, name string, tags obs.Tags, expected float64) bool {
+	t.Helper()
+	value, ok := rec.Gauge(name, tags)
+	if !ok {
+		return assert.Fail(t, fmt.Sprintf("gauge %s%s was never set", name, formatTags(tags)), rec.describeMetrics())
+	}
+	return assert.Equal(t, expected, value, "gauge %s%s", name, formatTags(tags))
+}
+
+// AssertStatCount asserts that count values were added to the stat named name with the provided tags.
+func (rec *Recorder) AssertStatCount(t testing.TB, name string, tags obs.Tags, count int) bool {
+	t.Helper()
+	return assert.Len(t, rec.Stats(name, tags), count, "stat %s%s\n%s", name, formatTags(tags), rec.describeMetrics())
+}
+
+// AssertLogged asserts that a log line containing message was reported at level.
+func (rec *Recorder) AssertLogged(t testing.TB, level, message string) bool {
+	t.Helper()
+	for _, l := range rec.LogsAt(level) {
+		if strings.Contains(l.Message, message) {
+			return true
+		}
+	}
+	return assert.Fail(t, fmt.Sprintf("no %s log containing %q", strings.ToUpper(level), message))
+}
+
+// AssertSpan asserts that exactly one span matching name finished, and returns it.
+func (rec *Recorder) AssertSpan(t testing.TB, name string) (Span, bool) {
+	t.Helper()
+	spans := rec.SpansNamed(name)
+	if !assert.Len(t, spans, 1, "spans named %s", name) {
+		return Span{}, false
+	}
+	return spans[0], true
+}
+
+func (rec *Recorder) describeMetrics() string {
+	var b strings.Builder
+	b.WriteString("reported metrics:")
+	for _, m := range rec.Metrics() {
+		fmt.Fprintf(&b, "\n\t%s %s%s %g", m.Type, m.Name, formatTags(m.Tags), m.Value)
+	}
+	return b.String()
+}
+
+func formatTags(tags obs.Tags) string {
+	if len(tags) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(tags))
+	for k, v := range tags {
+		pairs = append(pairs, k+":"+v)
+	}
+	sort.Strings(pairs)
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func tagsEqual(a, b obs.Tags) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
+}
+
+func (rec *Recorder) addMetric(m Metric) {
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+	rec.metrics = append(rec.metrics, m)
+}
+
+func (rec *Recorder) addLog(l LogEntry) {
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+	rec.logs = append(rec.logs, l)
+}
+
+type receiver struct {
+	rec    *Recorder
+	prefix string
+	tags   obs.Tags
+}
+
+func (r *receiver) handle(name string, value float64, mt MetricType) {
+	r.handleText(name, value, mt, "")
+}
+
+func (r *receiver) handleText(name string, value float64, mt MetricType, text string) {
+	if len(r.prefix) > 0 {
+		name = r.prefix + "." + name
+	}
+	tags := make(obs.Tags, len(r.tags))
+	for k, v := range r.tags {
+		tags[k] = v
+	}
+	r.rec.addMetric(Metric{Name: name, Type: mt, Tags: tags, Value: value, Text: text})
+}
+
+func (r *receiver) Incr(name string) {
+	r.IncrBy(name, 1)
+}
+
+func (r *receiver) IncrBy(name string, amount float64) {
+	r.handle(name, amount, Counter)
+}
+
+func (r *receiver) AddStat(name string, value float64) {
+	r.handle(name, value, Stat)
+}
+
+func (r *receiver) SetGauge(name string, value float64) {
+	r.handle(name, value, Gauge)
+}
+
+func (r *receiver) AddDistribution(name string, value float64) {
+	r.handle(name, value, Distribution)
+}
+
+func (r *receiver) AddToSet(name string, value string) {
+	r.handleText(name, 1, Set, value)
+}
+
+func (r *receiver) Event(event metrics.Event) {
+	tags := make(obs.Tags, len(r.tags))
+	for k, v := range r.tags {
+		tags[k] = v
+	}
+	r.rec.addMetric(Metric{Name: event.Title, Type: Event, Tags: tags, Value: 1, Text: event.Text})
+}
+
+func (r *receiver) ServiceCheck(name string, status metrics.ServiceCheckStatus, message string) {
+	r.handleText(name, float64(status), ServiceCheck, message)
+}
+
+func (r *receiver) ScopePrefix(prefix string) metrics.Receiver {
+	return r.Scope(prefix, nil)
+}
+
+func (r *receiver) ScopeTags(tags metrics.Tags) metrics.Receiver {
+	return r.Scope("", tags)
+}
+
+func (r *receiver) Scope(prefix string, tags metrics.Tags) metrics.Receiver {
+	newPrefix := r.prefix
+	if len(prefix) > 0 {
+		if len(newPrefix) > 0 {
+			newPrefix += "."
+		}
+		newPrefix += prefix
+	}
+
+	newTags := make(obs.Tags, len(r.tags)+len(tags))
+	for k, v := range r.tags {
+		newTags[k] = v
+	}
+	for k, v := range tags {
+		newTags[k] = v
+	}
+	return &receiver{rec: r.rec, prefix: newPrefix, tags: newTags}
+}
+
+// ScopeSampleRate returns r, since sampling would make tests flaky.
+func (r *receiver) ScopeSampleRate(rate float64) metrics.Receiver {
+	return r
+}
+
+func (r *receiver) StartStopwatch(name string) metrics.Stopwatch {
+	return &stopwatch{name: name, startTime: time.Now(), receiver: r}
+}
+
+type stopwatch struct {
+	name      string
+	startTime time.Time
+	receiver  metrics.Receiver
+}
+
+func (sw *stopwatch) Stop() {
+	sw.receiver.AddStat(sw.name+"_us", float64(time.Since(sw.startTime)/time.Microsecond))
+}
+
+type logger struct {
+	rec  *Recorder
+	name string
+}
+
+func (l *logger) log(level, message string, fields logging.Fields) {
+	l.rec.addLog(LogEntry{Level: level, Logger: l.name, Message: message, Fields: fields.Dupe()})
+}
+
+func (l *logger) Debug(message string, fields logging.Fields)    { l.log("DEBUG", message, fields) }
+func (l *logger) Info(message string, fields logging.Fields)     { l.log("INFO", message, fields) }
+func (l *logger) Warn(message string, fields logging.Fields)     { l.log("WARN", message, fields) }
+func (l *logger) Error(message string, fields logging.Fields)    { l.log("ERROR", message, fields) }
+func (l *logger) Critical(message string, fields logging.Fields) { l.log("CRITICAL", message, fields) }
+
+func (l *logger) IsDebug() bool    { return true }
+func (l *logger) IsInfo() bool     { return true }
+func (l *logger) IsWarn() bool     { return true }
+func (l *logger) IsError() bool    { return true }
+func (l *logger) IsCritical() bool { return true }
+
+func (l *logger) Named(name string) logging.Logger {
+	return &logger{rec: l.rec, name: name}
+}
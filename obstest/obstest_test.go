@@ -0,0 +1,71 @@
+package obstest
+
+import (
+	"context"
+	"testing"
+
+	"github.com/mixpanel/obs"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics(t *testing.T) {
+	rec := New()
+	fs := rec.ScopeName("foo").ScopeTags(obs.Tags{"a": "b"}).WithSpan(context.Background())
+	fs.Incr("success")
+	fs.IncrBy("success", 2)
+	fs.SetGauge("gauge", 1)
+	fs.SetGauge("gauge", 4)
+	fs.AddStat("stat", 10)
+	rec.WithSpan(context.Background()).Incr("untagged")
+
+	rec.AssertCounter(t, "foo.success", obs.Tags{"a": "b"}, 3)
+	rec.AssertGauge(t, "foo.gauge", obs.Tags{"a": "b"}, 4)
+	rec.AssertStatCount(t, "foo.stat", obs.Tags{"a": "b"}, 1)
+	rec.AssertCounter(t, "untagged", nil, 1)
+
+	assert.Equal(t, 0.0, rec.Counter("foo.success", nil))
+	_, ok := rec.Gauge("foo.missing", nil)
+	assert.False(t, ok)
+	assert.Len(t, rec.Metrics(), 6)
+
+	rec.Reset()
+	assert.Empty(t, rec.Metrics())
+}
+
+func TestLogs(t *testing.T) {
+	rec := New()
+	fs, _, done := rec.ScopeName("foo").WithNewSpan(context.Background(), "op")
+	fs.Info("hello", obs.Vals{"key": "value"})
+	fs.Warn("oops", "something went wrong", nil)
+	done()
+
+	rec.AssertLogged(t, "info", "hello")
+	rec.AssertLogged(t, "WARN", "went wrong")
+	rec.AssertCounter(t, "foo.oops.warning", obs.Tags{"error": "warning"}, 1)
+
+	if logs := rec.LogsAt("INFO"); assert.Len(t, logs, 1) {
+		assert.Equal(t, "foo", logs[0].Logger)
+		assert.Equal(t, "value", logs[0].Fields["key"])
+	}
+}
+
+func TestSpans(t *testing.T) {
+	rec := New()
+	fs, ctx, done := rec.ScopeName("server").ScopeName("Service").WithNewSpan(context.Background(), "Method")
+	fs.TraceSpan().SetTag("key", "value")
+	_, _, childDone := rec.WithNewSpan(ctx, "child")
+	childDone()
+	done()
+
+	assert.Len(t, rec.Spans(), 2)
+	assert.Empty(t, rec.SpansNamed("Method.child"))
+	if span, ok := rec.AssertSpan(t, "Service.Method"); ok {
+		assert.Equal(t, "server.Service.Method", span.Operation)
+		assert.Equal(t, "value", span.Tags["key"])
+		assert.NotEmpty(t, span.Logs)
+	}
+	if child, ok := rec.AssertSpan(t, "child"); ok {
+		assert.Equal(t, rec.SpansNamed("Service.Method")[0].Context.SpanID, child.ParentSpanID)
+	}
+}
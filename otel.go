@@ -0,0 +1,49 @@
+package obs
+
+import (
+	"context"
+
+	"github.com/mixpanel/obs/logging"
+	"github.com/mixpanel/obs/metrics"
+	"github.com/mixpanel/obs/tracing"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// NewOTelFlightRecorder constructs a new FlightRecorder that reports spans to an OpenTelemetry TracerProvider and
+// metrics to an OpenTelemetry MeterProvider. Spans are still exposed to callers as opentracing.Spans, so existing
+// FlightSpan users and the gRPC interceptors work unchanged. Use tracing.OTelSampler in the TracerProvider to get
+// the same sampling behavior as InitGCP, including WithRootSpan's sample rate.
+func NewOTelFlightRecorder(name string, tp trace.TracerProvider, mp metric.MeterProvider, logger logging.Logger) FlightRecorder {
+	tracer := tracing.NewOTelFromProvider(tp)
+	receiver := metrics.NewReceiver(metrics.NewOTelSinkFromProvider(mp))
+	return NewFlightRecorder(name, receiver, logger, tracer)
+}
+
+// otelSpan is implemented by opentracing.Spans that are backed by an OpenTelemetry span.
+type otelSpan interface {
+	OTelSpan() trace.Span
+}
+
+// otelContextWithSpan also stores the OpenTelemetry span behind span in ctx, so that OpenTelemetry instrumented
+// libraries called with ctx create child spans of it.
+func otelContextWithSpan(ctx context.Context, span opentracing.Span) context.Context {
+	if s, ok := span.(otelSpan); ok {
+		return trace.ContextWithSpan(ctx, s.OTelSpan())
+	}
+	return ctx
+}
+
+// otelParentContext returns the span context of an OpenTelemetry span in ctx that was not started through a
+// FlightRecorder, or nil if there isn't one or tr can't use it as a parent.
+func otelParentContext(ctx context.Context, tr opentracing.Tracer) opentracing.SpanContext {
+	if _, ok := tr.(*tracing.OTelTracer); !ok {
+		return nil
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		return tracing.OTelSpanContext{SpanContext: sc}
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package obs
+
+import (
+	"context"
+	"testing"
+
+	"github.com/mixpanel/obs/logging"
+	"github.com/mixpanel/obs/tracing"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/metric/noop"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func newOTelTestRecorder(sampleOneInN uint64) (FlightRecorder, *tracetest.SpanRecorder) {
+	sr := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithSampler(tracing.OTelSampler(sampleOneInN)),
+		sdktrace.WithSpanProcessor(sr),
+	)
+	return NewOTelFlightRecorder("test", tp, noop.NewMeterProvider(), logging.Null), sr
+}
+
+func TestOTelTraceID(t *testing.T) {
+	fr, sr := newOTelTestRecorder(1)
+	fs, _, done := fr.WithNewSpan(context.Background(), "op")
+	done()
+
+	traceID, ok := fs.TraceID()
+	assert.True(t, ok)
+	if assert.Len(t, sr.Ended(), 1) {
+		span := sr.Ended()[0]
+		assert.Equal(t, "test.op", span.Name())
+		assert.Equal(t, span.SpanContext().TraceID().String(), traceID)
+	}
+}
+
+func TestOTelChildSpans(t *testing.T) {
+	fr, sr := newOTelTestRecorder(1)
+	_, ctx, done := fr.WithNewSpan(context.Background(), "parent")
+	_, _, childDone := fr.ScopeName("child").WithNewSpan(ctx, "op")
+	childDone()
+	done()
+
+	spans := sr.Ended()
+	if assert.Len(t, spans, 2) {
+		assert.Equal(t, "test.child.op", spans[0].Name())
+		assert.Equal(t, spans[1].SpanContext().SpanID(), spans[0].Parent().SpanID())
+		assert.Equal(t, spans[1].SpanContext().TraceID(), spans[0].SpanContext().TraceID())
+	}
+}
+
+func TestOTelInjectExtract(t *testing.T) {
+	fr, sr := newOTelTestRecorder(1)
+	fs, _, done := fr.WithNewSpan(context.Background(), "client")
+	defer done()
+
+	carrier := opentracing.TextMapCarrier{}
+	tracer := fs.TraceSpan().Tracer()
+	assert.NoError(t, tracer.Inject(fs.TraceSpan().Context(), opentracing.TextMap, carrier))
+	assert.Contains(t, carrier, "traceparent")
+
+	spanCtx, err := tracer.Extract(opentracing.TextMap, carrier)
+	assert.NoError(t, err)
+	_, _, serverDone := fr.WithNewSpanContext(context.Background(), "server", spanCtx)
+	serverDone()
+
+	if assert.Len(t, sr.Ended(), 1) {
+		server := sr.Ended()[0]
+		clientID, _ := fs.TraceID()
+		assert.Equal(t, clientID, server.SpanContext().TraceID().String())
+		assert.True(t, server.Parent().IsRemote())
+	}
+
+	_, err = tracer.Extract(opentracing.TextMap, opentracing.TextMapCarrier{})
+	assert.Equal(t, opentracing.ErrSpanContextNotFound, err)
+}
+
+func TestOTelRootSpanSampling(t *testing.T) {
+	// 1 in 2^62 is effectively never sampled unless the root span overrides it.
+	fr, sr := newOTelTestRecorder(1 << 62)
+
+	_, _, done := fr.WithNewSpan(context.Background(), "unsampled")
+	done()
+	assert.Len(t, sr.Ended(), 0)
+
+	_, _, done = fr.WithRootSpan(context.Background(), "sampled", 1)
+	done()
+	if assert.Len(t, sr.Ended(), 1) {
+		for _, attr := range sr.Ended()[0].Attributes() {
+			assert.NotEqual(t, tracing.SampleOneInNTag, string(attr.Key), "the sample rate isn't recorded")
+		}
+	}
+}
+
+func TestOTelParentFromContext(t *testing.T) {
+	fr, sr := newOTelTestRecorder(1)
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))
+	ctx, parent := tp.Tracer("test").Start(context.Background(), "otel_parent")
+
+	_, ctx, done := fr.WithNewSpan(ctx, "op")
+	assert.True(t, trace.SpanContextFromContext(ctx).IsValid())
+	done()
+	parent.End()
+
+	spans := sr.Ended()
+	if assert.Len(t, spans, 2) {
+		assert.Equal(t, parent.SpanContext().SpanID(), spans[0].Parent().SpanID())
+	}
+}
+
+func TestOTelTags(t *testing.T) {
+	fr, sr := newOTelTestRecorder(1)
+	fs, _, done := fr.ScopeTags(Tags{"query_type": "segmentation"}).WithNewSpan(context.Background(), "op")
+	fs.Info("something happened", Vals{"key": "value"})
+	done()
+
+	if assert.Len(t, sr.Ended(), 1) {
+		span := sr.Ended()[0]
+		attrs := make(map[string]string)
+		for _, attr := range span.Attributes() {
+			attrs[string(attr.Key)] = attr.Value.Emit()
+		}
+		assert.Equal(t, "segmentation", attrs["query_type"])
+		if assert.NotEmpty(t, span.Events()) {
+			assert.Equal(t, "something happened", span.Events()[0].Name)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package obs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"strconv"
+
+	"github.com/mixpanel/obs/metrics"
+	"github.com/mixpanel/obs/tracing"
+
+	basictracer "github.com/opentracing/basictracer-go"
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+)
+
+type RecoverOption func(*recoverOptions)
+
+// Repanic makes Recover and Go panic again with the original value once the panic has been reported, so that the
+// process still crashes.
+var Repanic RecoverOption = func(o *recoverOptions) {
+	o.repanic = true
+}
+
+type recoverOptions struct {
+	repanic bool
+}
+
+func (fr *flightRecorder) Recover(ctx context.Context, name string, opts ...RecoverOption) {
+	if r := recover(); r != nil {
+		// the span in ctx is only finished by its owner once Recover returns, too late to be flushed, so the panic is
+		// traced on a child span that's finished right away
+		var spanOpts []opentracing.StartSpanOption
+		if spanCtx := fr.parentSpanContext(ctx); spanCtx != nil {
+			spanOpts = append(spanOpts, opentracing.ChildOf(spanCtx))
+		}
+		span := fr.tr.StartSpan(joinNames(fr.name, name+".panic"), spanOpts...)
+		for k, v := range fr.tags {
+			span = span.SetTag(k, v)
+		}
+		fs := &flightSpan{
+			span:           span,
+			ctx:            opentracing.ContextWithSpan(ctx, span),
+			flightRecorder: fr,
+		}
+		fs.reportPanic(name, r, debug.Stack(), span.Finish, opts)
+	}
+}
+
+func (fr *flightRecorder) Go(ctx context.Context, name string, f func(ctx context.Context), opts ...RecoverOption) {
+	go func() {
+		fs, ctx, done := fr.WithNewSpan(ctx, name)
+		defer func() {
+			if r := recover(); r != nil {
+				fs.(*flightSpan).reportPanic(name, r, debug.Stack(), done, opts)
+			} else {
+				done()
+			}
+		}()
+		f(ctx)
+	}()
+}
+
+// reportPanic logs, counts and traces a recovered panic, then flushes everything so that it isn't lost if the
+// process crashes. done is called to finish the span before flushing.
+func (fs *flightSpan) reportPanic(name string, r interface{}, stack []byte, done DoneFunc, opts []RecoverOption) {
+	var o recoverOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	message := fmt.Sprintf("panic in %s: %v", name, r)
+	fs.mr.Incr(name + ".panic")
+
+	fields := fs.logFields(Vals{
+		"panic":        fmt.Sprintf("%v", r),
+		"stack":        string(stack),
+		"goroutine_id": goroutineID(stack),
+	})
+	fields["critical_log_name"] = name
+	fs.l.Critical(message, fields)
+	fs.logTrace(message, fields)
+
+	span := fs.TraceSpan()
+	ext.Error.Set(span, true)
+	span.SetTag(tracing.Label.ErrorMessage, message)
+	done()
+
+	fs.flush()
+
+	if o.repanic {
+		panic(r)
+	}
+}
+
+// flush flushes the metrics sink and the tracer or its recorder, if they support it.
+func (fr *flightRecorder) flush() {
+	if f, ok := fr.mr.(metrics.Flusher); ok {
+		if err := f.Flush(); err != nil {
+			log.Printf("error flushing metrics: %v", err)
+		}
+	}
+	if f, ok := fr.tr.(interface{ Flush() error }); ok {
+		if err := f.Flush(); err != nil {
+			log.Printf("error flushing spans: %v", err)
+		}
+	} else if t, ok := fr.tr.(basictracer.Tracer); ok {
+		if f, ok := t.Options().Recorder.(interface{ Flush() }); ok {
+			f.Flush()
+		}
+	}
+}
+
+// goroutineID parses the ID of the current goroutine from the first line of its stack trace,
+// for example "goroutine 42 [running]:".
+func goroutineID(stack []byte) int64 {
+	stack = bytes.TrimPrefix(stack, []byte("goroutine "))
+	if i := bytes.IndexByte(stack, ' '); i > 0 {
+		if id, err := strconv.ParseInt(string(stack[:i]), 10, 64); err == nil {
+			return id
+		}
+	}
+	return 0
+}
@@ -0,0 +1,113 @@
+package obs
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mixpanel/obs/logging"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/codes"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestRecover(t *testing.T) {
+	fr, sink, recorder := newTestFlightRecorder()
+
+	func() {
+		_, ctx, done := fr.WithNewSpan(context.Background(), "op")
+		defer func() {
+			// the panic was traced on a span finished before Recover flushed
+			assert.Len(t, recorder.GetSpans(), 1)
+			done()
+		}()
+		defer fr.Recover(ctx, "worker")
+		panic("oops")
+	}()
+
+	assert.Equal(t, 1, sink.Invocations["worker.panic, map[], 1, ct\n"])
+	if spans := recorder.GetSpans(); assert.Len(t, spans, 2) {
+		panicSpan, opSpan := spans[0], spans[1]
+		assert.Equal(t, "test.worker.panic", panicSpan.Operation)
+		assert.Equal(t, opSpan.Context.SpanID, panicSpan.ParentSpanID)
+		assert.Equal(t, true, panicSpan.Tags["error"])
+		if assert.NotEmpty(t, panicSpan.Logs) {
+			fields := panicSpan.Logs[0].Fields
+			assert.Equal(t, "panic in worker: oops", fields[0].Value())
+		}
+	}
+}
+
+func TestRecoverOTel(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	// spans are only exported when the batch times out or the provider is flushed
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter, sdktrace.WithBatchTimeout(time.Hour)))
+	reader := sdkmetric.NewManualReader()
+	mp := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	fr := NewOTelFlightRecorder("test", tp, mp, logging.Null)
+
+	assert.PanicsWithValue(t, "oops", func() {
+		defer fr.Recover(context.Background(), "worker", Repanic)
+		panic("oops")
+	})
+
+	if spans := exporter.GetSpans(); assert.Len(t, spans, 1) {
+		assert.Equal(t, "test.worker.panic", spans[0].Name)
+		assert.Equal(t, codes.Error, spans[0].Status.Code)
+	}
+	var rm metricdata.ResourceMetrics
+	assert.NoError(t, reader.Collect(context.Background(), &rm))
+	if assert.Len(t, rm.ScopeMetrics, 1) && assert.Len(t, rm.ScopeMetrics[0].Metrics, 1) {
+		m := rm.ScopeMetrics[0].Metrics[0]
+		assert.Equal(t, "worker.panic", m.Name)
+		if sum, ok := m.Data.(metricdata.Sum[float64]); assert.True(t, ok) && assert.Len(t, sum.DataPoints, 1) {
+			assert.Equal(t, 1.0, sum.DataPoints[0].Value)
+		}
+	}
+}
+
+func TestRecoverNoPanic(t *testing.T) {
+	fr, sink, _ := newTestFlightRecorder()
+
+	func() {
+		defer fr.Recover(context.Background(), "worker")
+	}()
+	assert.Equal(t, 0, sink.NumInvocations())
+}
+
+func TestRecoverRepanic(t *testing.T) {
+	fr, sink, _ := newTestFlightRecorder()
+
+	assert.PanicsWithValue(t, "oops", func() {
+		defer fr.Recover(context.Background(), "worker", Repanic)
+		panic("oops")
+	})
+	assert.Equal(t, 1, sink.Invocations["worker.panic, map[], 1, ct\n"])
+}
+
+func TestGo(t *testing.T) {
+	fr, sink, recorder := newTestFlightRecorder()
+
+	ran := make(chan struct{})
+	fr.Go(context.Background(), "worker", func(ctx context.Context) {
+		assert.NotNil(t, fr.WithSpan(ctx).TraceSpan())
+		close(ran)
+		panic("oops")
+	})
+	<-ran
+
+	assert.Eventually(t, func() bool { return len(recorder.GetSpans()) == 1 }, time.Second, time.Millisecond)
+	span := recorder.GetSpans()[0]
+	assert.Equal(t, "test.worker", span.Operation)
+	assert.Equal(t, true, span.Tags["error"])
+	assert.Equal(t, 1, sink.Invocations["worker.panic, map[], 1, ct\n"])
+}
+
+func TestGoroutineID(t *testing.T) {
+	assert.Equal(t, int64(42), goroutineID([]byte("goroutine 42 [running]:\nmain.main()")))
+	assert.Equal(t, int64(0), goroutineID([]byte("garbage")))
+}
@@ -43,6 +43,18 @@ func (mock *mockMetrics) AddStat(name string, value float64) {
 func (mock *mockMetrics) SetGauge(name string, value float64) {
 }
 
+func (mock *mockMetrics) AddDistribution(name string, value float64) {
+}
+
+func (mock *mockMetrics) AddToSet(name string, value string) {
+}
+
+func (mock *mockMetrics) Event(event metrics.Event) {
+}
+
+func (mock *mockMetrics) ServiceCheck(name string, status metrics.ServiceCheckStatus, message string) {
+}
+
 func (mock *mockMetrics) ScopePrefix(prefix string) metrics.Receiver {
 	return mock
 }
@@ -55,6 +67,10 @@ func (mock *mockMetrics) Scope(prefix string, tags metrics.Tags) metrics.Receive
 	return mock
 }
 
+func (mock *mockMetrics) ScopeSampleRate(rate float64) metrics.Receiver {
+	return mock
+}
+
 func (mock *mockMetrics) StartStopwatch(name string) metrics.Stopwatch {
 	return nil
 }
@@ -0,0 +1,441 @@
+package tracing
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/opentracing/opentracing-go/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// SampleOneInNTag is the span tag used to ask OTelSampler for a specific sample rate on a root span.
+const SampleOneInNTag = "obs.sample_one_in_n"
+
+// otelFlushTimeout bounds how long Flush waits for the TracerProvider to export, since it's called before crashing.
+const otelFlushTimeout = 5 * time.Second
+
+// NewOTel returns an opentracing.Tracer that records its spans into tracer. Trace contexts are injected and
+// extracted with the W3C Trace Context format.
+func NewOTel(tracer trace.Tracer) *OTelTracer {
+	return &OTelTracer{
+		tracer:     tracer,
+		propagator: propagation.TraceContext{},
+	}
+}
+
+// NewOTelFromProvider returns an opentracing.Tracer like NewOTel that records its spans into a tracer of tp, and
+// whose Flush makes tp export right away if it implements ForceFlush, like the SDK's TracerProvider does.
+func NewOTelFromProvider(tp trace.TracerProvider) *OTelTracer {
+	t := NewOTel(tp.Tracer("github.com/mixpanel/obs"))
+	t.provider = tp
+	return t
+}
+
+// OTelTracer adapts an OpenTelemetry trace.Tracer to the opentracing.Tracer interface.
+type OTelTracer struct {
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+	// provider is the TracerProvider tracer came from, if it's known, so that Flush can force it to export.
+	provider trace.TracerProvider
+}
+
+// Flush makes the TracerProvider export every span ended so far, if the tracer was created from it and it supports
+// ForceFlush.
+func (t *OTelTracer) Flush() error {
+	f, ok := t.provider.(interface{ ForceFlush(context.Context) error })
+	if !ok {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), otelFlushTimeout)
+	defer cancel()
+	return f.ForceFlush(ctx)
+}
+
+// OTelSpanContext is the opentracing.SpanContext of spans started by an OTelTracer.
+type OTelSpanContext struct {
+	trace.SpanContext
+	baggage map[string]string
+}
+
+// ForeachBaggageItem implements opentracing.SpanContext.
+func (sc OTelSpanContext) ForeachBaggageItem(handler func(k, v string) bool) {
+	for k, v := range sc.baggage {
+		if !handler(k, v) {
+			return
+		}
+	}
+}
+
+func (sc OTelSpanContext) withBaggageItem(key, val string) OTelSpanContext {
+	baggage := make(map[string]string, len(sc.baggage)+1)
+	for k, v := range sc.baggage {
+		baggage[k] = v
+	}
+	baggage[key] = val
+	return OTelSpanContext{SpanContext: sc.SpanContext, baggage: baggage}
+}
+
+// RootSpanOption returns the StartSpanOption that asks OTelSampler to sample a root span one in n times.
+// OpenTelemetry decides sampling when a span starts, so the rate can't be applied afterwards.
+func (t *OTelTracer) RootSpanOption(sampleOneInN int) opentracing.StartSpanOption {
+	return opentracing.Tag{Key: SampleOneInNTag, Value: sampleOneInN}
+}
+
+func (t *OTelTracer) StartSpan(operationName string, opts ...opentracing.StartSpanOption) opentracing.Span {
+	var sso opentracing.StartSpanOptions
+	for _, o := range opts {
+		o.Apply(&sso)
+	}
+
+	ctx := context.Background()
+	var baggage map[string]string
+	for _, ref := range sso.References {
+		if parent, ok := ref.ReferencedContext.(OTelSpanContext); ok && parent.IsValid() {
+			ctx = trace.ContextWithSpanContext(ctx, parent.SpanContext)
+			baggage = parent.baggage
+			break
+		}
+	}
+
+	tags := sso.Tags
+	if n, ok := tags[SampleOneInNTag]; ok {
+		// the rate is only for OTelSampler, which samples with the context the span is started with, so it's passed
+		// there rather than recorded on the span
+		ctx = context.WithValue(ctx, sampleOneInNKey{}, toAttribute(SampleOneInNTag, n).Value.AsInt64())
+		tags = make(map[string]interface{}, len(sso.Tags)-1)
+		for k, v := range sso.Tags {
+			if k != SampleOneInNTag {
+				tags[k] = v
+			}
+		}
+	}
+
+	startOpts := []trace.SpanStartOption{
+		trace.WithAttributes(tagsToAttributes(tags)...),
+		trace.WithSpanKind(spanKind(tags[string(ext.SpanKind)])),
+	}
+	if !sso.StartTime.IsZero() {
+		startOpts = append(startOpts, trace.WithTimestamp(sso.StartTime))
+	}
+
+	_, span := t.tracer.Start(ctx, operationName, startOpts...)
+	return &otelSpan{
+		tracer:  t,
+		span:    span,
+		context: OTelSpanContext{SpanContext: span.SpanContext(), baggage: baggage},
+	}
+}
+
+func (t *OTelTracer) Inject(sm opentracing.SpanContext, format interface{}, carrier interface{}) error {
+	sc, ok := sm.(OTelSpanContext)
+	if !ok {
+		return opentracing.ErrInvalidSpanContext
+	}
+	writer, ok := carrier.(opentracing.TextMapWriter)
+	if !ok {
+		return opentracing.ErrInvalidCarrier
+	}
+	switch format {
+	case opentracing.TextMap, opentracing.HTTPHeaders:
+	default:
+		return opentracing.ErrUnsupportedFormat
+	}
+
+	ctx := trace.ContextWithSpanContext(context.Background(), sc.SpanContext)
+	t.propagator.Inject(ctx, textMapWriter{writer})
+	for k, v := range sc.baggage {
+		writer.Set(baggagePrefix+k, v)
+	}
+	return nil
+}
+
+func (t *OTelTracer) Extract(format interface{}, carrier interface{}) (opentracing.SpanContext, error) {
+	reader, ok := carrier.(opentracing.TextMapReader)
+	if !ok {
+		return nil, opentracing.ErrInvalidCarrier
+	}
+	switch format {
+	case opentracing.TextMap, opentracing.HTTPHeaders:
+	default:
+		return nil, opentracing.ErrUnsupportedFormat
+	}
+
+	values := make(textMapReader)
+	baggage := make(map[string]string)
+	err := reader.ForeachKey(func(key, val string) error {
+		key = strings.ToLower(key)
+		if strings.HasPrefix(key, baggagePrefix) {
+			baggage[strings.TrimPrefix(key, baggagePrefix)] = val
+		} else {
+			values[key] = val
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sc := trace.SpanContextFromContext(t.propagator.Extract(context.Background(), values))
+	if !sc.IsValid() {
+		return nil, opentracing.ErrSpanContextNotFound
+	}
+	return OTelSpanContext{SpanContext: sc, baggage: baggage}, nil
+}
+
+const baggagePrefix = "ot-baggage-"
+
+type textMapWriter struct {
+	opentracing.TextMapWriter
+}
+
+func (w textMapWriter) Get(key string) string { return "" }
+func (w textMapWriter) Keys() []string        { return nil }
+
+type textMapReader map[string]string
+
+func (r textMapReader) Get(key string) string { return r[strings.ToLower(key)] }
+func (r textMapReader) Set(key, val string)   { r[strings.ToLower(key)] = val }
+
+func (r textMapReader) Keys() []string {
+	keys := make([]string, 0, len(r))
+	for k := range r {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+type otelSpan struct {
+	tracer *OTelTracer
+	span   trace.Span
+
+	mu      sync.Mutex // guards context
+	context OTelSpanContext
+}
+
+// OTelSpan returns the OpenTelemetry span backing this span.
+func (s *otelSpan) OTelSpan() trace.Span {
+	return s.span
+}
+
+func (s *otelSpan) Finish() {
+	s.span.End()
+}
+
+func (s *otelSpan) FinishWithOptions(opts opentracing.FinishOptions) {
+	for _, lr := range opts.LogRecords {
+		s.logFields(lr.Timestamp, lr.Fields)
+	}
+	for _, ld := range opts.BulkLogData {
+		lr := ld.ToLogRecord()
+		s.logFields(lr.Timestamp, lr.Fields)
+	}
+	if opts.FinishTime.IsZero() {
+		s.span.End()
+	} else {
+		s.span.End(trace.WithTimestamp(opts.FinishTime))
+	}
+}
+
+func (s *otelSpan) Context() opentracing.SpanContext {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.context
+}
+
+func (s *otelSpan) SetOperationName(operationName string) opentracing.Span {
+	s.span.SetName(operationName)
+	return s
+}
+
+func (s *otelSpan) SetTag(key string, value interface{}) opentracing.Span {
+	if key == string(ext.Error) {
+		if isErr, ok := value.(bool); ok && isErr {
+			s.span.SetStatus(codes.Error, "")
+		}
+	}
+	s.span.SetAttributes(toAttribute(key, value))
+	return s
+}
+
+func (s *otelSpan) LogFields(fields ...log.Field) {
+	s.logFields(time.Time{}, fields)
+}
+
+func (s *otelSpan) LogKV(alternatingKeyValues ...interface{}) {
+	fields, err := log.InterleavedKVToFields(alternatingKeyValues...)
+	if err != nil {
+		s.span.AddEvent("log", trace.WithAttributes(attribute.String("error", err.Error())))
+		return
+	}
+	s.logFields(time.Time{}, fields)
+}
+
+func (s *otelSpan) logFields(ts time.Time, fields []log.Field) {
+	name := "log"
+	attrs := make([]attribute.KeyValue, 0, len(fields))
+	for _, f := range fields {
+		if f.Key() == "event" {
+			name = fmt.Sprintf("%v", f.Value())
+			continue
+		}
+		attrs = append(attrs, toAttribute(f.Key(), f.Value()))
+	}
+
+	opts := []trace.EventOption{trace.WithAttributes(attrs...)}
+	if !ts.IsZero() {
+		opts = append(opts, trace.WithTimestamp(ts))
+	}
+	s.span.AddEvent(name, opts...)
+}
+
+func (s *otelSpan) SetBaggageItem(restrictedKey, value string) opentracing.Span {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.context = s.context.withBaggageItem(restrictedKey, value)
+	return s
+}
+
+func (s *otelSpan) BaggageItem(restrictedKey string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.context.baggage[restrictedKey]
+}
+
+func (s *otelSpan) Tracer() opentracing.Tracer {
+	return s.tracer
+}
+
+func (s *otelSpan) LogEvent(event string) {
+	s.Log(opentracing.LogData{Event: event})
+}
+
+func (s *otelSpan) LogEventWithPayload(event string, payload interface{}) {
+	s.Log(opentracing.LogData{Event: event, Payload: payload})
+}
+
+func (s *otelSpan) Log(data opentracing.LogData) {
+	var attrs []attribute.KeyValue
+	if data.Payload != nil {
+		attrs = tagsToAttributes(toMap(data.Payload))
+	}
+
+	opts := []trace.EventOption{trace.WithAttributes(attrs...)}
+	if !data.Timestamp.IsZero() {
+		opts = append(opts, trace.WithTimestamp(data.Timestamp))
+	}
+	s.span.AddEvent(data.Event, opts...)
+}
+
+// toMap converts a log payload into a map. It uses reflection so that named map types such as obs.Vals
+// are handled too.
+func toMap(payload interface{}) map[string]interface{} {
+	v := reflect.ValueOf(payload)
+	if v.Kind() != reflect.Map || v.Type().Key().Kind() != reflect.String {
+		return map[string]interface{}{"payload": fmt.Sprintf("%v", payload)}
+	}
+	out := make(map[string]interface{}, v.Len())
+	for _, k := range v.MapKeys() {
+		out[k.String()] = v.MapIndex(k).Interface()
+	}
+	return out
+}
+
+func tagsToAttributes(tags map[string]interface{}) []attribute.KeyValue {
+	attrs := make([]attribute.KeyValue, 0, len(tags))
+	for k, v := range tags {
+		attrs = append(attrs, toAttribute(k, v))
+	}
+	return attrs
+}
+
+func toAttribute(key string, value interface{}) attribute.KeyValue {
+	switch v := value.(type) {
+	case string:
+		return attribute.String(key, v)
+	case bool:
+		return attribute.Bool(key, v)
+	case int:
+		return attribute.Int(key, v)
+	case int32:
+		return attribute.Int64(key, int64(v))
+	case int64:
+		return attribute.Int64(key, v)
+	case uint32:
+		return attribute.Int64(key, int64(v))
+	case uint16:
+		return attribute.Int64(key, int64(v))
+	case float32:
+		return attribute.Float64(key, float64(v))
+	case float64:
+		return attribute.Float64(key, v)
+	case ext.SpanKindEnum:
+		return attribute.String(key, string(v))
+	default:
+		return attribute.String(key, fmt.Sprintf("%v", v))
+	}
+}
+
+func spanKind(kind interface{}) trace.SpanKind {
+	switch kind {
+	case ext.SpanKindRPCClientEnum, string(ext.SpanKindRPCClientEnum):
+		return trace.SpanKindClient
+	case ext.SpanKindRPCServerEnum, string(ext.SpanKindRPCServerEnum):
+		return trace.SpanKindServer
+	case ext.SpanKindProducerEnum, string(ext.SpanKindProducerEnum):
+		return trace.SpanKindProducer
+	case ext.SpanKindConsumerEnum, string(ext.SpanKindConsumerEnum):
+		return trace.SpanKindConsumer
+	default:
+		return trace.SpanKindInternal
+	}
+}
+
+// OTelSampler returns an OpenTelemetry sampler that samples one in n root spans by trace ID, the same way
+// SampleRate does for basictracer. Child spans follow their parent's decision, and root spans started with
+// SampleOneInNTag use that rate instead of n.
+func OTelSampler(n uint64) sdktrace.Sampler {
+	return &otelSampler{n: n}
+}
+
+// sampleOneInNKey is the context key of the rate StartSpan takes from SampleOneInNTag for OTelSampler.
+type sampleOneInNKey struct{}
+
+type otelSampler struct {
+	n uint64
+}
+
+func (s *otelSampler) ShouldSample(p sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	psc := trace.SpanContextFromContext(p.ParentContext)
+	result := sdktrace.SamplingResult{Tracestate: psc.TraceState()}
+
+	n := s.n
+	if rate, ok := p.ParentContext.Value(sampleOneInNKey{}).(int64); ok && rate > 0 {
+		n = uint64(rate)
+		psc = trace.SpanContext{}
+	}
+
+	switch {
+	case psc.IsValid():
+		if psc.IsSampled() {
+			result.Decision = sdktrace.RecordAndSample
+		}
+	case n > 0 && binary.BigEndian.Uint64(p.TraceID[8:16])%n == 0:
+		result.Decision = sdktrace.RecordAndSample
+	}
+	return result
+}
+
+func (s *otelSampler) Description() string {
+	return fmt.Sprintf("OTelSampler{%d}", s.n)
+}
@@ -0,0 +1,282 @@
+package tracing
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	basictracer "github.com/opentracing/basictracer-go"
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+)
+
+// OTLPOptions configures NewOTLP and NewOTLPRecorder.
+type OTLPOptions struct {
+	// Endpoint is the host:port of the OTLP collector, localhost:4317 for gRPC or localhost:4318 for HTTP if empty.
+	Endpoint string
+	// HTTP exports OTLP/HTTP protobuf instead of OTLP/gRPC.
+	HTTP bool
+	// Insecure disables TLS.
+	Insecure bool
+	// Headers are sent with every export, for example for authentication.
+	Headers map[string]string
+	// ServiceName is reported as the service.name resource attribute.
+	ServiceName string
+}
+
+// NewOTLP returns a basictracer that exports sampled spans to an OTLP collector, and a function that flushes and
+// stops the exporter. Unlike New, it doesn't need any GCP credentials.
+func NewOTLP(ctx context.Context, opts basictracer.Options, otlpOpts OTLPOptions) (opentracing.Tracer, func(), error) {
+	r, err := NewOTLPRecorder(ctx, otlpOpts)
+	if err != nil {
+		return nil, nil, err
+	}
+	opts.Recorder = r
+	return basictracer.NewWithOptions(opts), r.Close, nil
+}
+
+// OTLPRecorder is a basictracer.SpanRecorder that batches sampled spans and exports them to an OTLP collector.
+type OTLPRecorder struct {
+	client   otlptrace.Client
+	resource *resourcepb.Resource
+
+	spans   chan *tracepb.Span
+	flushes chan chan struct{}
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewOTLPRecorder connects to the collector described by opts and starts exporting spans in the background.
+func NewOTLPRecorder(ctx context.Context, opts OTLPOptions) (*OTLPRecorder, error) {
+	var client otlptrace.Client
+	if opts.HTTP {
+		httpOpts := []otlptracehttp.Option{otlptracehttp.WithHeaders(opts.Headers)}
+		if opts.Endpoint != "" {
+			httpOpts = append(httpOpts, otlptracehttp.WithEndpoint(opts.Endpoint))
+		}
+		if opts.Insecure {
+			httpOpts = append(httpOpts, otlptracehttp.WithInsecure())
+		}
+		client = otlptracehttp.NewClient(httpOpts...)
+	} else {
+		grpcOpts := []otlptracegrpc.Option{otlptracegrpc.WithHeaders(opts.Headers)}
+		if opts.Endpoint != "" {
+			grpcOpts = append(grpcOpts, otlptracegrpc.WithEndpoint(opts.Endpoint))
+		}
+		if opts.Insecure {
+			grpcOpts = append(grpcOpts, otlptracegrpc.WithInsecure())
+		}
+		client = otlptracegrpc.NewClient(grpcOpts...)
+	}
+	if err := client.Start(ctx); err != nil {
+		return nil, fmt.Errorf("error initializing otlp trace client: %v", err)
+	}
+
+	r := &OTLPRecorder{
+		client: client,
+		resource: &resourcepb.Resource{
+			Attributes: []*commonpb.KeyValue{otlpKeyValue("service.name", opts.ServiceName)},
+		},
+		spans:   make(chan *tracepb.Span, 64),
+		flushes: make(chan chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		const spanBufferSize = 128
+		buf := make([]*tracepb.Span, 0, spanBufferSize)
+		var tick <-chan time.Time
+
+		flush := func() {
+			tick = nil
+			if len(buf) == 0 {
+				return
+			}
+			r.export(buf)
+			buf = buf[:0]
+		}
+
+		for {
+			select {
+			case <-r.done:
+				for pending := len(r.spans); pending > 0; pending-- {
+					buf = append(buf, <-r.spans)
+				}
+				flush()
+				return
+			case <-tick:
+				flush()
+			case flushed := <-r.flushes:
+				for pending := len(r.spans); pending > 0; pending-- {
+					buf = append(buf, <-r.spans)
+				}
+				flush()
+				close(flushed)
+
+			case span := <-r.spans:
+				buf = append(buf, span)
+
+				if len(buf) == cap(buf) {
+					// need to flush immediately, to avoid the buffer from resizing
+					flush()
+				}
+
+				if tick == nil && len(buf) > 0 {
+					tick = time.After(3 * time.Second)
+				}
+			}
+		}
+	}()
+	return r, nil
+}
+
+func (r *OTLPRecorder) RecordSpan(raw basictracer.RawSpan) {
+	if !raw.Context.Sampled {
+		return
+	}
+
+	select {
+	case r.spans <- rawSpanToOTLP(raw):
+	case <-r.done:
+	}
+}
+
+// Flush exports every span recorded so far and waits for it to complete.
+func (r *OTLPRecorder) Flush() {
+	flushed := make(chan struct{})
+	select {
+	case r.flushes <- flushed:
+		<-flushed
+	case <-r.done:
+	}
+}
+
+// Close exports every span recorded so far and disconnects from the collector.
+func (r *OTLPRecorder) Close() {
+	close(r.done)
+	r.wg.Wait()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := r.client.Stop(ctx); err != nil {
+		log.Printf("error stopping otlp trace client: %v", err)
+	}
+}
+
+func (r *OTLPRecorder) export(spans []*tracepb.Span) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err := r.client.UploadTraces(ctx, []*tracepb.ResourceSpans{{
+		Resource: r.resource,
+		ScopeSpans: []*tracepb.ScopeSpans{{
+			Scope: &commonpb.InstrumentationScope{Name: "github.com/mixpanel/obs"},
+			Spans: spans,
+		}},
+	}})
+	if err != nil {
+		log.Printf("error sending spans to otlp collector: %v", err)
+	}
+}
+
+func rawSpanToOTLP(raw basictracer.RawSpan) *tracepb.Span {
+	span := &tracepb.Span{
+		TraceId:           otlpTraceID(raw.Context.TraceID),
+		SpanId:            otlpSpanID(raw.Context.SpanID),
+		Name:              raw.Operation,
+		Kind:              otlpKind(raw),
+		StartTimeUnixNano: uint64(raw.Start.UnixNano()),
+		EndTimeUnixNano:   uint64(raw.Start.Add(raw.Duration).UnixNano()),
+		Attributes:        make([]*commonpb.KeyValue, 0, len(raw.Tags)),
+	}
+	if raw.ParentSpanID != 0 {
+		span.ParentSpanId = otlpSpanID(raw.ParentSpanID)
+	}
+	for k, v := range raw.Tags {
+		span.Attributes = append(span.Attributes, otlpKeyValue(k, v))
+	}
+	for _, record := range raw.Logs {
+		event := &tracepb.Span_Event{
+			TimeUnixNano: uint64(record.Timestamp.UnixNano()),
+			Name:         "log",
+		}
+		for _, field := range record.Fields {
+			if field.Key() == "event" {
+				event.Name = fmt.Sprintf("%v", field.Value())
+				continue
+			}
+			event.Attributes = append(event.Attributes, otlpKeyValue(field.Key(), field.Value()))
+		}
+		span.Events = append(span.Events, event)
+	}
+	if isError, _ := raw.Tags[string(ext.Error)].(bool); isError {
+		message, _ := raw.Tags[Label.ErrorMessage].(string)
+		span.Status = &tracepb.Status{Code: tracepb.Status_STATUS_CODE_ERROR, Message: message}
+	}
+	return span
+}
+
+// otlpTraceID puts the 64 bit basictracer trace ID in the low bytes of the 128 bit OTLP one, so that it formats the
+// same way as the Cloud Trace recorder's trace IDs.
+func otlpTraceID(id uint64) []byte {
+	bs := make([]byte, 16)
+	binary.BigEndian.PutUint64(bs[8:], id)
+	return bs
+}
+
+func otlpSpanID(id uint64) []byte {
+	bs := make([]byte, 8)
+	binary.BigEndian.PutUint64(bs, id)
+	return bs
+}
+
+func otlpKind(raw basictracer.RawSpan) tracepb.Span_SpanKind {
+	switch raw.Tags[string(ext.SpanKind)] {
+	case ext.SpanKindRPCClientEnum:
+		return tracepb.Span_SPAN_KIND_CLIENT
+	case ext.SpanKindRPCServerEnum:
+		return tracepb.Span_SPAN_KIND_SERVER
+	case ext.SpanKindProducerEnum:
+		return tracepb.Span_SPAN_KIND_PRODUCER
+	case ext.SpanKindConsumerEnum:
+		return tracepb.Span_SPAN_KIND_CONSUMER
+	default:
+		return tracepb.Span_SPAN_KIND_INTERNAL
+	}
+}
+
+func otlpKeyValue(key string, value interface{}) *commonpb.KeyValue {
+	var v *commonpb.AnyValue
+	switch value := value.(type) {
+	case string:
+		v = &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}}
+	case bool:
+		v = &commonpb.AnyValue{Value: &commonpb.AnyValue_BoolValue{BoolValue: value}}
+	case int:
+		v = &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: int64(value)}}
+	case int32:
+		v = &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: int64(value)}}
+	case int64:
+		v = &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: value}}
+	case uint32:
+		v = &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: int64(value)}}
+	case uint16:
+		v = &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: int64(value)}}
+	case float32:
+		v = &commonpb.AnyValue{Value: &commonpb.AnyValue_DoubleValue{DoubleValue: float64(value)}}
+	case float64:
+		v = &commonpb.AnyValue{Value: &commonpb.AnyValue_DoubleValue{DoubleValue: value}}
+	default:
+		v = &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: fmt.Sprintf("%v", value)}}
+	}
+	return &commonpb.KeyValue{Key: key, Value: v}
+}
@@ -0,0 +1,140 @@
+package tracing
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	basictracer "github.com/opentracing/basictracer-go"
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/stretchr/testify/assert"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// otlpTestCollector stands in for an OTLP/HTTP collector, recording every span it receives.
+type otlpTestCollector struct {
+	*httptest.Server
+
+	mutex sync.Mutex
+	spans []*tracepb.Span
+}
+
+func newOTLPTestCollector(t *testing.T) *otlpTestCollector {
+	c := &otlpTestCollector{}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/traces", r.URL.Path)
+		bs, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		var req coltracepb.ExportTraceServiceRequest
+		assert.NoError(t, proto.Unmarshal(bs, &req))
+
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		for _, rs := range req.ResourceSpans {
+			assert.Equal(t, "test-service", rs.Resource.Attributes[0].Value.GetStringValue())
+			for _, ss := range rs.ScopeSpans {
+				c.spans = append(c.spans, ss.Spans...)
+			}
+		}
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		bs, _ = proto.Marshal(&coltracepb.ExportTraceServiceResponse{})
+		w.Write(bs)
+	}))
+	return c
+}
+
+func (c *otlpTestCollector) received() []*tracepb.Span {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]*tracepb.Span(nil), c.spans...)
+}
+
+func newOTLPTestTracer(t *testing.T, collector *otlpTestCollector, sampled bool) (opentracing.Tracer, *OTLPRecorder) {
+	r, err := NewOTLPRecorder(context.Background(), OTLPOptions{
+		Endpoint:    strings.TrimPrefix(collector.URL, "http://"),
+		HTTP:        true,
+		Insecure:    true,
+		ServiceName: "test-service",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := basictracer.DefaultOptions()
+	opts.ShouldSample = func(uint64) bool { return sampled }
+	opts.Recorder = r
+	return basictracer.NewWithOptions(opts), r
+}
+
+func TestOTLPRecorder(t *testing.T) {
+	collector := newOTLPTestCollector(t)
+	defer collector.Close()
+	tracer, r := newOTLPTestTracer(t, collector, true)
+	defer r.Close()
+
+	parent := tracer.StartSpan("parent")
+	child := tracer.StartSpan("child", opentracing.ChildOf(parent.Context()), ext.SpanKindRPCClient)
+	child.SetTag("attempt", 2)
+	child.SetTag(Label.ErrorMessage, "boom")
+	ext.Error.Set(child, true)
+	child.LogKV("event", "retry", "delay_ms", 10)
+	child.Finish()
+	parent.Finish()
+
+	r.Flush()
+
+	spans := collector.received()
+	if !assert.Len(t, spans, 2) {
+		return
+	}
+	c, p := spans[0], spans[1]
+	assert.Equal(t, "child", c.Name)
+	assert.Equal(t, "parent", p.Name)
+	assert.Equal(t, p.TraceId, c.TraceId)
+	assert.Equal(t, p.SpanId, c.ParentSpanId)
+	assert.Empty(t, p.ParentSpanId)
+	assert.Len(t, c.TraceId, 16)
+	assert.Len(t, c.SpanId, 8)
+	assert.Equal(t, tracepb.Span_SPAN_KIND_CLIENT, c.Kind)
+	assert.Equal(t, tracepb.Span_SPAN_KIND_INTERNAL, p.Kind)
+	assert.True(t, c.EndTimeUnixNano >= c.StartTimeUnixNano)
+
+	if attempt := otlpAttribute(c, "attempt"); assert.NotNil(t, attempt) {
+		assert.Equal(t, int64(2), attempt.GetIntValue())
+	}
+	assert.Equal(t, tracepb.Status_STATUS_CODE_ERROR, c.Status.GetCode())
+	assert.Equal(t, "boom", c.Status.GetMessage())
+
+	if assert.Len(t, c.Events, 1) {
+		assert.Equal(t, "retry", c.Events[0].Name)
+		assert.Equal(t, "delay_ms", c.Events[0].Attributes[0].Key)
+		assert.Equal(t, int64(10), c.Events[0].Attributes[0].Value.GetIntValue())
+	}
+}
+
+func TestOTLPRecorderUnsampled(t *testing.T) {
+	collector := newOTLPTestCollector(t)
+	defer collector.Close()
+	tracer, r := newOTLPTestTracer(t, collector, false)
+
+	tracer.StartSpan("unsampled").Finish()
+	r.Close()
+
+	assert.Empty(t, collector.received())
+}
+
+func otlpAttribute(span *tracepb.Span, key string) *commonpb.AnyValue {
+	for _, kv := range span.Attributes {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return nil
+}
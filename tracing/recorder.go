@@ -46,6 +46,7 @@ func newRecorder() *recorder {
 		svc:     cloudtrace.NewProjectsService(service),
 		traces:  make(chan *cloudtrace.Trace, 64),
 		project: project,
+		flushes: make(chan chan struct{}),
 		done:    make(chan struct{}),
 	}
 
@@ -73,6 +74,12 @@ func newRecorder() *recorder {
 				return
 			case <-tick:
 				flush()
+			case flushed := <-r.flushes:
+				for pending := len(r.traces); pending > 0; pending-- {
+					buf = append(buf, <-r.traces)
+				}
+				flush()
+				close(flushed)
 
 			case trace := <-r.traces:
 				buf = append(buf, trace)
@@ -92,6 +99,19 @@ func newRecorder() *recorder {
 
 }
 
+// Flush sends every span recorded so far to Cloud Trace and waits for it to complete.
+func (r *recorder) Flush() {
+	if r.svc == nil {
+		return
+	}
+	flushed := make(chan struct{})
+	select {
+	case r.flushes <- flushed:
+		<-flushed
+	case <-r.done:
+	}
+}
+
 func (r *recorder) Close() {
 	close(r.done)
 	r.wg.Wait()
@@ -102,8 +122,9 @@ type recorder struct {
 	traces  chan *cloudtrace.Trace
 	project string
 
-	done chan struct{}
-	wg   sync.WaitGroup
+	flushes chan chan struct{}
+	done    chan struct{}
+	wg      sync.WaitGroup
 }
 
 func (r *recorder) RecordSpan(raw basictracer.RawSpan) {
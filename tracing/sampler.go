@@ -0,0 +1,27 @@
+package tracing
+
+import "sync/atomic"
+
+// Sampler samples 1 in n traces by trace ID. Its rate can be changed while the tracer is running.
+type Sampler struct {
+	oneInN uint64
+}
+
+// NewSampler returns a Sampler that samples 1 in oneInN traces, or none if oneInN is 0.
+func NewSampler(oneInN uint64) *Sampler {
+	return &Sampler{oneInN: oneInN}
+}
+
+// ShouldSample can be used as basictracer.Options.ShouldSample.
+func (s *Sampler) ShouldSample(traceID uint64) bool {
+	n := atomic.LoadUint64(&s.oneInN)
+	return n != 0 && traceID%n == 0
+}
+
+func (s *Sampler) OneInN() uint64 {
+	return atomic.LoadUint64(&s.oneInN)
+}
+
+func (s *Sampler) SetOneInN(oneInN uint64) {
+	atomic.StoreUint64(&s.oneInN, oneInN)
+}